@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+var (
+	adminPort  = flag.Int("admin-port", 0, "port of the maintenance API, 0 disables it")
+	adminToken = flag.String("admin-token", os.Getenv("DB_ADMIN_TOKEN"), "bearer token of the maintenance API, DB_ADMIN_TOKEN by default")
+)
+
+type segmentReport struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	LiveBytes int64  `json:"live_bytes"`
+	DeadBytes int64  `json:"dead_bytes"`
+}
+
+type shardReport struct {
+	Shard    int             `json:"shard"`
+	Segments []segmentReport `json:"segments"`
+}
+
+// maintenance serves the /admin/* operations of the separate admin port.
+type maintenance struct {
+	ss    *safestorage.SafeStorage
+	token string
+}
+
+// adminRoutes serves the maintenance API, every request needs the token.
+// The operations hold the shard worker and are not bound by -request-timeout.
+// The replication routes are served here too, replica and cluster may be nil.
+func adminRoutes(ss *safestorage.SafeStorage, replica *follower, cluster *quorum, token string) http.Handler {
+	admin := &maintenance{ss: ss, token: token}
+	h := new(http.ServeMux)
+	h.HandleFunc("/admin/replication", func(w http.ResponseWriter, r *http.Request) {
+		handleReplicationStatus(w, r, ss, replica)
+	})
+	h.HandleFunc("/admin/promote", func(w http.ResponseWriter, r *http.Request) {
+		handlePromote(w, r, replica)
+	})
+	if cluster != nil {
+		h.HandleFunc("/admin/repair", func(w http.ResponseWriter, r *http.Request) {
+			handleRepair(w, r, cluster)
+		})
+	}
+	h.HandleFunc("/admin/segments", admin.only(http.MethodGet, admin.handleSegments))
+	h.HandleFunc("/admin/compact", admin.only(http.MethodPost, admin.each((*safestorage.SafeStorage).Compact, true)))
+	h.HandleFunc("/admin/rotate", admin.only(http.MethodPost, admin.each((*safestorage.SafeStorage).Rotate, true)))
+	h.HandleFunc("/admin/sync", admin.only(http.MethodPost, admin.each((*safestorage.SafeStorage).Sync, false)))
+	h.HandleFunc("/admin/read-only", admin.only(http.MethodPut, admin.handleReadOnly))
+	return admin.authenticate(h)
+}
+
+func (admin *maintenance) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(secret), []byte(admin.token)) != 1 {
+			log.Printf("Denied an admin request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="db-admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (admin *maintenance) only(method string, handle http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handle(w, r)
+	}
+}
+
+// shards returns the shards chosen by the ?shard parameter, all of them without it.
+func (admin *maintenance) shards(w http.ResponseWriter, r *http.Request) ([]int, bool) {
+	all := make([]int, admin.ss.Shards())
+	for shard := range all {
+		all[shard] = shard
+	}
+	raw := r.URL.Query().Get("shard")
+	if raw == "" {
+		return all, true
+	}
+	shard, err := strconv.Atoi(raw)
+	if err != nil || shard < 0 || shard >= len(all) {
+		http.Error(w, "Unknown shard", http.StatusBadRequest)
+		return nil, false
+	}
+	return all[shard : shard+1], true
+}
+
+// each runs the operation on the chosen shards and answers with their segments or 204.
+func (admin *maintenance) each(operation func(*safestorage.SafeStorage, int) error, report bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		shards, ok := admin.shards(w, r)
+		if !ok {
+			return
+		}
+		for _, shard := range shards {
+			if err := operation(admin.ss, shard); err != nil {
+				maintenanceFailed(w, err)
+				return
+			}
+		}
+		if !report {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		admin.handleSegments(w, r)
+	}
+}
+
+func (admin *maintenance) handleSegments(w http.ResponseWriter, r *http.Request) {
+	shards, ok := admin.shards(w, r)
+	if !ok {
+		return
+	}
+	reports := make([]shardReport, 0, len(shards))
+	for _, shard := range shards {
+		segments, err := admin.ss.Segments(shard)
+		if err != nil {
+			maintenanceFailed(w, err)
+			return
+		}
+		report := shardReport{Shard: shard, Segments: make([]segmentReport, len(segments))}
+		for i, segment := range segments {
+			report.Segments[i] = segmentReport(segment)
+		}
+		reports = append(reports, report)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"shards": reports})
+}
+
+// handleReadOnly switches the read-only mode with {"read_only": true} or false.
+func (admin *maintenance) handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ReadOnly *bool `json:"read_only"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ReadOnly == nil {
+		http.Error(w, `Body must be {"read_only": true} or false`, http.StatusBadRequest)
+		return
+	}
+	if err := admin.ss.SetReadOnly(*body.ReadOnly); err != nil {
+		maintenanceFailed(w, err)
+		return
+	}
+	log.Printf("Read-only mode is %t", *body.ReadOnly)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func maintenanceFailed(w http.ResponseWriter, err error) {
+	if errors.Is(err, safestorage.ErrNoMaintenance) {
+		http.Error(w, "The engine has no segments to maintain", http.StatusNotImplemented)
+		return
+	}
+	log.Printf("Maintenance failed: %s", err)
+	http.Error(w, "Maintenance failed: "+err.Error(), http.StatusInternalServerError)
+}
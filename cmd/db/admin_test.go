@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+const testAdminToken = "admin-secret"
+
+// adminRequest is request to the admin port with the token of the tests.
+func adminRequest(t *testing.T, method, url string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	text, _ := io.ReadAll(response.Body)
+	return response.StatusCode, string(text)
+}
+
+func TestAdmin(t *testing.T) {
+	db, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := safestorage.Init(db)
+	server := httptest.NewServer(routes(ss, nil, nil))
+	admin := httptest.NewServer(adminRoutes(ss, nil, nil, testAdminToken))
+	t.Cleanup(func() {
+		server.Close()
+		admin.Close()
+		_ = ss.Close()
+	})
+	call := func(secret, method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, admin.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		text, _ := io.ReadAll(response.Body)
+		return response.StatusCode, string(text)
+	}
+	segments := func(body string) []segmentReport {
+		var report struct {
+			Shards []shardReport `json:"shards"`
+		}
+		if err := json.Unmarshal([]byte(body), &report); err != nil || len(report.Shards) != 1 {
+			t.Fatalf("Unexpected report %s", body)
+		}
+		return report.Shards[0].Segments
+	}
+
+	if status, _ := call("wrong", http.MethodGet, "/admin/segments", ""); status != http.StatusUnauthorized {
+		t.Errorf("Wrong token answered %d", status)
+	}
+	for _, path := range []string{"/admin/segments", "/admin/replication", "/admin/promote"} {
+		if status, _ := request(t, http.MethodPost, server.URL+path, ""); status != http.StatusNotFound {
+			t.Errorf("POST %s answered %d on the data port", path, status)
+		}
+	}
+	if status, _ := call("wrong", http.MethodPost, "/admin/promote", ""); status != http.StatusUnauthorized {
+		t.Errorf("Promotion with a wrong token answered %d", status)
+	}
+	request(t, http.MethodPost, server.URL+"/db/key", `{"value": "v1"}`)
+	request(t, http.MethodPost, server.URL+"/db/key", `{"value": "v2"}`)
+
+	status, body := call(testAdminToken, http.MethodPost, "/admin/rotate", "")
+	if status != http.StatusOK || len(segments(body)) != 2 {
+		t.Errorf("Rotate answered %d %s", status, body)
+	}
+	status, body = call(testAdminToken, http.MethodGet, "/admin/segments", "")
+	if first := segments(body)[0]; status != http.StatusOK || first.DeadBytes == 0 || first.LiveBytes == 0 {
+		t.Errorf("Segments answered %d %s", status, body)
+	}
+
+	if status, _ := call(testAdminToken, http.MethodPut, "/admin/read-only", `{"read_only": true}`); status != http.StatusNoContent {
+		t.Errorf("Read-only mode answered %d", status)
+	}
+	if status, _ := request(t, http.MethodPost, server.URL+"/db/key", `{"value": "v3"}`); status != http.StatusServiceUnavailable {
+		t.Errorf("Write in the read-only mode answered %d", status)
+	}
+	if value := valueOf(t, &node{server: server}, "key"); value != "v2" {
+		t.Errorf("Read in the read-only mode gave %q", value)
+	}
+
+	status, body = call(testAdminToken, http.MethodPost, "/admin/compact", "")
+	if compacted := segments(body); status != http.StatusOK || len(compacted) != 1 || compacted[0].DeadBytes != 0 {
+		t.Errorf("Compact answered %d %s", status, body)
+	}
+	if status, _ := call(testAdminToken, http.MethodPost, "/admin/sync?shard=0", ""); status != http.StatusNoContent {
+		t.Errorf("Sync answered %d", status)
+	}
+	if status, _ := call(testAdminToken, http.MethodPost, "/admin/sync?shard=1", ""); status != http.StatusBadRequest {
+		t.Errorf("Sync of a missing shard answered %d", status)
+	}
+
+	call(testAdminToken, http.MethodPut, "/admin/read-only", `{"read_only": false}`)
+	if status, _ := request(t, http.MethodPost, server.URL+"/db/key", `{"value": "v3"}`); status != http.StatusOK {
+		t.Errorf("Write after the read-only mode answered %d", status)
+	}
+}
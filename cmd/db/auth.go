@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	authConfigPath = flag.String("auth-config", "", "JSON file with the API tokens and their rights, without it every request is allowed")
+	auditLogPath   = flag.String("audit-log", "", "file the denied requests are appended to, the standard error by default")
+	peerToken      = flag.String("peer-token", "", "token this node sends to the leader and the quorum peers, it needs the admin right there")
+)
+
+type right int
+
+const (
+	rightRead right = iota + 1
+	rightWrite
+	// rightAdmin also allows the reads and writes
+	rightAdmin
+)
+
+var rightNames = map[string]right{"read": rightRead, "write": rightWrite, "admin": rightAdmin}
+
+func (r right) String() string {
+	for name, value := range rightNames {
+		if value == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+// authConfig is the content of the -auth-config file:
+//
+//	{"tokens": [{"id": "server", "secret": "...", "grants": [{"prefix": "", "rights": ["read"]}]}]}
+//
+// A grant gives the rights on the keys starting with the prefix, bucket keys are "bucket/key".
+type authConfig struct {
+	Tokens []struct {
+		ID     string `json:"id"`
+		Secret string `json:"secret"`
+		Grants []struct {
+			Prefix string   `json:"prefix"`
+			Rights []string `json:"rights"`
+		} `json:"grants"`
+	} `json:"tokens"`
+}
+
+type grant struct {
+	prefix string
+	right  right
+}
+
+type token struct {
+	id     string
+	grants []grant
+}
+
+// allows reports whether the token has the right, or a higher one, on the key.
+func (t *token) allows(need right, key string) bool {
+	for _, granted := range t.grants {
+		if granted.right >= need && strings.HasPrefix(key, granted.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticator checks the bearer tokens of the requests and logs the denied ones.
+type authenticator struct {
+	// tokens are found by the hash of the secret, so the secrets are not compared byte by byte
+	tokens map[[sha256.Size]byte]*token
+	audit  *log.Logger
+}
+
+func loadAuth(path string, audit io.Writer) (*authenticator, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config authConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	auth := &authenticator{
+		tokens: make(map[[sha256.Size]byte]*token),
+		audit:  log.New(audit, "audit: ", log.LstdFlags|log.LUTC),
+	}
+	ids := make(map[string]bool)
+	for _, configured := range config.Tokens {
+		if configured.ID == "" || configured.Secret == "" {
+			return nil, fmt.Errorf("%s: every token needs an id and a secret", path)
+		}
+		hash := sha256.Sum256([]byte(configured.Secret))
+		if ids[configured.ID] || auth.tokens[hash] != nil {
+			return nil, fmt.Errorf("%s: token %s is not unique", path, configured.ID)
+		}
+		ids[configured.ID] = true
+		loaded := &token{id: configured.ID}
+		for _, configuredGrant := range configured.Grants {
+			for _, name := range configuredGrant.Rights {
+				granted, known := rightNames[name]
+				if !known {
+					return nil, fmt.Errorf("%s: token %s has unknown right %q, use read, write or admin", path, configured.ID, name)
+				}
+				loaded.grants = append(loaded.grants, grant{configuredGrant.Prefix, granted})
+			}
+		}
+		auth.tokens[hash] = loaded
+	}
+	return auth, nil
+}
+
+type grantee struct {
+	auth  *authenticator
+	token *token
+}
+
+type granteeKey struct{}
+
+// requirement returns the right a request needs and the key it needs it on,
+// checked is false for the routes that check every key they touch themselves.
+func requirement(r *http.Request) (need right, key string, checked bool) {
+	reading := r.Method == http.MethodGet || r.Method == http.MethodHead
+	switch path := r.URL.Path; {
+	case path == "/db/_txn" || path == "/db/_bulk":
+		return 0, "", false
+	case path == "/metrics":
+		return rightRead, "", true
+	case path == "/db/_watch":
+		return rightRead, r.URL.Query().Get("prefix"), true
+	case strings.HasPrefix(path, "/db/_index/") && reading:
+		// an index query may return any key
+		return rightRead, "", true
+	case strings.HasPrefix(path, "/db/_index/"):
+		return rightAdmin, "", true
+	case strings.HasPrefix(path, "/db/") && reading:
+		return rightRead, strings.TrimPrefix(path, "/db/"), true
+	case strings.HasPrefix(path, "/db/"):
+		if key, _, found := counterOperation(r); found {
+			return rightWrite, key, true
+		}
+		return rightWrite, strings.TrimPrefix(path, "/db/"), true
+	default:
+		return rightAdmin, "", true
+	}
+}
+
+// wrap lets the requests with a valid token and the rights they need through.
+// A missing or unknown token is answered with 401, missing rights with 403.
+func (auth *authenticator) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" || r.URL.Path == "/livez" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		secret, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		caller := auth.tokens[sha256.Sum256([]byte(secret))]
+		if !found || caller == nil {
+			auth.audit.Printf("denied token=- remote=%s %s %s: missing or unknown token", r.RemoteAddr, r.Method, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="db"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), granteeKey{}, grantee{auth, caller}))
+		if need, key, checked := requirement(r); checked && !authorize(r, need, key) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize reports whether the token of the request has the right on the key and logs a denial.
+// Every request is authorized when the authentication is off.
+func authorize(r *http.Request, need right, key string) bool {
+	caller, found := r.Context().Value(granteeKey{}).(grantee)
+	if !found {
+		return true
+	}
+	if caller.token.allows(need, key) {
+		return true
+	}
+	caller.auth.audit.Printf("denied token=%s remote=%s %s %s: no %s right on %q", caller.token.id, r.RemoteAddr, r.Method, r.URL.Path, need, key)
+	return false
+}
+
+// peerTransport adds the -peer-token to the requests a node sends to the other nodes.
+type peerTransport struct {
+	base http.RoundTripper
+}
+
+func (transport peerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if *peerToken == "" {
+		return transport.base.RoundTrip(r)
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+*peerToken)
+	return transport.base.RoundTrip(r)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+const testAuthConfig = `{"tokens": [
+	{"id": "reader", "secret": "reader-secret", "grants": [{"prefix": "pub", "rights": ["read"]}]},
+	{"id": "writer", "secret": "writer-secret", "grants": [{"prefix": "pub", "rights": ["write"]}, {"prefix": "", "rights": ["read"]}]},
+	{"id": "root", "secret": "root-secret", "grants": [{"prefix": "", "rights": ["admin"]}]}
+]}`
+
+func writeAuthConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuth(t *testing.T) {
+	var audit bytes.Buffer
+	auth, err := loadAuth(writeAuthConfig(t, testAuthConfig), &audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := safestorage.Init(datastore.NewMemory())
+	server := httptest.NewServer(auth.wrap(routes(ss, nil, nil)))
+	t.Cleanup(func() {
+		server.Close()
+		_ = ss.Close()
+	})
+	call := func(secret, method, path, body string) int {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	tests := []struct {
+		secret, method, path, body string
+		status                     int
+	}{
+		{"", http.MethodGet, "/health", "", http.StatusOK},
+		{"", http.MethodGet, "/db/pub-1", "", http.StatusUnauthorized},
+		{"wrong", http.MethodGet, "/db/pub-1", "", http.StatusUnauthorized},
+		{"writer-secret", http.MethodPost, "/db/pub-1", `{"value": "v"}`, http.StatusOK},
+		{"reader-secret", http.MethodGet, "/db/pub-1", "", http.StatusOK},
+		{"reader-secret", http.MethodPost, "/db/pub-1", `{"value": "x"}`, http.StatusForbidden},
+		{"reader-secret", http.MethodDelete, "/db/pub-1", "", http.StatusForbidden},
+		{"reader-secret", http.MethodGet, "/db/secret", "", http.StatusForbidden},
+		{"writer-secret", http.MethodPost, "/db/secret", `{"value": "x"}`, http.StatusForbidden},
+		{"root-secret", http.MethodPost, "/db/secret", `{"value": "s"}`, http.StatusOK},
+		{"writer-secret", http.MethodGet, "/db/secret", "", http.StatusOK},
+		{"writer-secret", http.MethodPost, "/db/pub/ann", `{"value": "bucket"}`, http.StatusOK},
+		{"writer-secret", http.MethodPost, "/db/pub-count/incr", "", http.StatusOK},
+		{"writer-secret", http.MethodPost, "/db/secret/append", `{"value": "x"}`, http.StatusForbidden},
+		{"writer-secret", http.MethodPost, "/db/_index/by-name", `{"path": "name"}`, http.StatusForbidden},
+		{"writer-secret", http.MethodPost, "/admin/promote", "", http.StatusForbidden},
+		{"root-secret", http.MethodPost, "/admin/promote", "", http.StatusNotFound},
+		{"writer-secret", http.MethodPost, "/db/_txn", `{"writes": [{"key": "pub-2", "value": "v"}, {"key": "secret", "delete": true}]}`, http.StatusForbidden},
+		{"writer-secret", http.MethodPost, "/db/_txn", `{"writes": [{"key": "pub-2", "value": "v"}]}`, http.StatusOK},
+		{"reader-secret", http.MethodPost, "/db/_bulk", `{"atomic": true, "operations": [{"op": "put", "key": "pub-3", "value": "v"}]}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if status := call(tt.secret, tt.method, tt.path, tt.body); status != tt.status {
+			t.Errorf("%s %s with %q answered %d, wanted %d", tt.method, tt.path, tt.secret, status, tt.status)
+		}
+	}
+	if value, _ := ss.Get("secret"); value != "s" {
+		t.Errorf("Denied requests changed the secret to %q", value)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/db/_bulk", strings.NewReader(`{"operations": [
+		{"op": "get", "key": "secret"}, {"op": "put", "key": "pub-4", "value": "v"}, {"op": "get", "key": "pub-1"}
+	]}`))
+	req.Header.Set("Authorization", "Bearer reader-secret")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var bulk struct {
+		Results []bulkResult `json:"results"`
+	}
+	_ = json.NewDecoder(response.Body).Decode(&bulk)
+	if len(bulk.Results) != 3 || bulk.Results[0].Status != http.StatusForbidden || bulk.Results[1].Status != http.StatusForbidden || bulk.Results[2].Status != http.StatusOK {
+		t.Errorf("Unexpected bulk results %+v", bulk.Results)
+	}
+
+	logged := audit.String()
+	for _, line := range []string{
+		"denied token=- ",
+		`denied token=reader remote=`,
+		`POST /db/pub-1: no write right on "pub-1"`,
+		`denied token=writer remote=`,
+		`POST /db/_txn: no write right on "secret"`,
+	} {
+		if !strings.Contains(logged, line) {
+			t.Errorf("Audit log has no %q:\n%s", line, logged)
+		}
+	}
+	if strings.Contains(logged, "root") {
+		t.Errorf("Allowed requests were logged:\n%s", logged)
+	}
+}
+
+func TestLoadAuth(t *testing.T) {
+	for _, config := range []string{
+		`{"tokens": [{"id": "a", "secret": "s", "grants": [{"prefix": "", "rights": ["delete"]}]}]}`,
+		`{"tokens": [{"id": "a", "secret": ""}]}`,
+		`{"tokens": [{"id": "a", "secret": "s"}, {"id": "a", "secret": "t"}]}`,
+		`{"tokens": [{"id": "a", "secret": "s"}, {"id": "b", "secret": "s"}]}`,
+		`{"tokens": `,
+	} {
+		if _, err := loadAuth(writeAuthConfig(t, config), &bytes.Buffer{}); err == nil {
+			t.Errorf("Config %s was accepted", config)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"sync"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/dbwire"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+var binaryPort = flag.Int("binary-port", 0, "port of the binary protocol of the dbwire package, 0 disables it")
+
+// binaryInFlight is the number of requests of a connection served at once,
+// the connection is not read while all of them are busy
+const binaryInFlight = 64
+
+// binaryServer serves the requests of a connection concurrently and answers each
+// as soon as it is done, the client pairs the answers with the requests by id.
+type binaryServer struct {
+	*tcpServer
+	ss      *safestorage.SafeStorage
+	replica *follower
+}
+
+func serveBinary(listener net.Listener, ss *safestorage.SafeStorage, replica *follower) *binaryServer {
+	server := &binaryServer{ss: ss, replica: replica}
+	server.tcpServer = serveTCP("Binary protocol", listener, server.serve)
+	return server
+}
+
+func (server *binaryServer) serve(connection net.Conn) {
+	reader := bufio.NewReader(connection)
+	writer := bufio.NewWriter(connection)
+	var writeMutex sync.Mutex
+	slots := make(chan struct{}, binaryInFlight)
+	var answering sync.WaitGroup
+	defer answering.Wait()
+	for {
+		// a malformed frame leaves the stream at an unknown place, so the connection is dropped
+		request, err := dbwire.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		slots <- struct{}{}
+		answering.Add(1)
+		go func() {
+			defer answering.Done()
+			response := server.answer(request)
+			writeMutex.Lock()
+			err := dbwire.WriteResponse(writer, response)
+			if errors.Is(err, dbwire.ErrFrameSize) {
+				// nothing was written, the client still gets an answer to the request
+				err = dbwire.WriteResponse(writer, failedResponse(request.ID, "value does not fit in a frame"))
+			}
+			if err == nil {
+				_ = writer.Flush()
+			}
+			writeMutex.Unlock()
+			<-slots
+		}()
+	}
+}
+
+func (server *binaryServer) answer(request dbwire.Request) dbwire.Response {
+	ctx, cancel := context.WithTimeout(context.Background(), *requestTimeout)
+	defer cancel()
+	ss := server.ss.WithContext(ctx)
+	response := dbwire.Response{ID: request.ID, Status: dbwire.StatusOK}
+	if (request.Op == dbwire.OpPut || request.Op == dbwire.OpDelete) && server.replica != nil && server.replica.isFollowing() {
+		return failedResponse(request.ID, "follower is read-only, write to the leader "+server.replica.leader)
+	}
+	if request.Op != dbwire.OpPing && request.Key == "" {
+		return failedResponse(request.ID, "key is required")
+	}
+	var err error
+	switch request.Op {
+	case dbwire.OpPing:
+	case dbwire.OpGet:
+		response.Value, err = ss.GetBytes(request.Key)
+	case dbwire.OpPut:
+		err = ss.PutBytes(request.Key, request.Value)
+	case dbwire.OpDelete:
+		err = ss.Delete(request.Key)
+	default:
+		return failedResponse(request.ID, "unknown operation")
+	}
+	switch {
+	case errors.Is(err, datastore.ErrNotFound):
+		return dbwire.Response{ID: request.ID, Status: dbwire.StatusNotFound}
+	case errors.Is(err, context.DeadlineExceeded):
+		return failedResponse(request.ID, "storage timeout")
+	case err != nil:
+		return failedResponse(request.ID, err.Error())
+	}
+	return response
+}
+
+func failedResponse(id uint32, message string) dbwire.Response {
+	return dbwire.Response{ID: id, Status: dbwire.StatusError, Value: []byte(message)}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/dbwire"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+func TestBinaryProtocol(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := safestorage.InitSharded([]safestorage.Storage{datastore.NewMemory(), datastore.NewMemory()})
+	server := serveBinary(listener, ss, nil)
+	client, err := dbwire.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		server.stop()
+		_ = ss.Close()
+	})
+	ctx := context.Background()
+
+	if err := client.Ping(ctx); err != nil {
+		t.Fatalf("Ping failed: %s", err)
+	}
+	// the requests of all goroutines share the connection
+	var writers sync.WaitGroup
+	for i := range 100 {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			key := fmt.Sprintf("key-%d", i)
+			if err := client.Put(ctx, key, "value of "+key); err != nil {
+				t.Errorf("Cannot put %s: %s", key, err)
+			}
+			if value, err := client.Get(ctx, key); err != nil || value != "value of "+key {
+				t.Errorf("Get(%s) = %q, %v", key, value, err)
+			}
+		}()
+	}
+	writers.Wait()
+	if server.connected() != 1 {
+		t.Errorf("Client has %d connections", server.connected())
+	}
+	if value, err := ss.Get("key-42"); err != nil || value != "value of key-42" {
+		t.Errorf("HTTP storage has %q, %v", value, err)
+	}
+
+	if err := client.Delete(ctx, "key-1"); err != nil {
+		t.Errorf("Cannot delete: %s", err)
+	}
+	if err := client.Delete(ctx, "key-1"); !errors.Is(err, dbwire.ErrNotFound) {
+		t.Errorf("Second delete gave %v", err)
+	}
+	if _, err := client.Get(ctx, "key-1"); !errors.Is(err, dbwire.ErrNotFound) {
+		t.Errorf("Deleted key gave %v", err)
+	}
+	var serverError dbwire.ServerError
+	if err := client.Put(ctx, "", "v"); !errors.As(err, &serverError) {
+		t.Errorf("Empty key gave %v", err)
+	}
+
+	// a value stored over HTTP may be too large for a response frame
+	if err := ss.PutBytes("huge", make([]byte, dbwire.MaxFrame)); err != nil {
+		t.Fatal(err)
+	}
+	waiting, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := client.Get(waiting, "huge"); !errors.As(err, &serverError) {
+		t.Errorf("Value over the frame limit gave %v", err)
+	}
+	if value, err := client.Get(ctx, "key-42"); err != nil || value != "value of key-42" {
+		t.Errorf("Get after the oversized value = %q, %v", value, err)
+	}
+}
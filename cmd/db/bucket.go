@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+// handleBucket serves /db/{bucket}/{key}, an empty key lists the keys of the bucket
+// and DELETE of it drops the whole bucket.
+func handleBucket(w http.ResponseWriter, r *http.Request, ss *safestorage.SafeStorage, bucket, key string) {
+	if bucket == "" {
+		http.Error(w, "Bucket is required", http.StatusBadRequest)
+		return
+	}
+	if key == "" && r.Method == http.MethodDelete {
+		err := ss.DropBucket(bucket)
+		if storageGaveUp(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Cannot drop bucket", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if key == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		keys, err := ss.ScanIn(bucket, r.URL.Query().Get("prefix"))
+		if storageGaveUp(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Cannot scan bucket", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"bucket": bucket,
+			"keys":   keys,
+		})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		value, getError := ss.GetIn(bucket, key)
+		if storageGaveUp(w, getError) {
+			return
+		}
+		if getError != nil {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"bucket": bucket,
+			"key":    key,
+			"value":  value,
+		})
+	case http.MethodPost:
+		var body struct {
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := ss.PutIn(bucket, key, body.Value); err != nil {
+			if storageGaveUp(w, err) {
+				return
+			}
+			http.Error(w, "Cannot store value", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		err := ss.DeleteIn(bucket, key)
+		if storageGaveUp(w, err) {
+			return
+		}
+		if errors.Is(err, datastore.ErrNotFound) {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Cannot delete value", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+var bulkLimit = flag.Int("bulk-max-operations", 1000, "the largest number of operations accepted by POST /db/_bulk")
+
+type bulkOperation struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type bulkRequest struct {
+	Atomic     bool            `json:"atomic"`
+	Operations []bulkOperation `json:"operations"`
+}
+
+// bulkResult is the answer to one operation, the status is the one of the single key request.
+type bulkResult struct {
+	Key     string  `json:"key"`
+	Status  int     `json:"status"`
+	Value   *string `json:"value,omitempty"`
+	Version uint64  `json:"version,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// bulkFailure stops an atomic batch at the operation that cannot be applied.
+type bulkFailure struct {
+	operation int
+	result    bulkResult
+}
+
+func (failure bulkFailure) Error() string {
+	return fmt.Sprintf("operation %d on %q failed: %s", failure.operation, failure.result.Key, failure.result.Error)
+}
+
+func (operation bulkOperation) validate() error {
+	switch {
+	case operation.Key == "":
+		return errors.New("key is required")
+	case operation.Op != "get" && operation.Op != "put" && operation.Op != "delete":
+		return fmt.Errorf("unknown operation %q, use get, put or delete", operation.Op)
+	}
+	return nil
+}
+
+func failedResult(key string, status int, message string) bulkResult {
+	return bulkResult{Key: key, Status: status, Error: message}
+}
+
+// handleBulk serves POST /db/_bulk with a list of get, put and delete operations of root keys.
+// Every operation gets its own result and a failed one does not stop the others.
+// An atomic batch is a single transaction: the reads see the state the writes are applied to,
+// and if any write fails, like a delete of a missing key, nothing is applied and the answer is 409.
+func handleBulk(w http.ResponseWriter, r *http.Request, ss *safestorage.SafeStorage, replica *follower, cluster *quorum) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body bulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if len(body.Operations) > *bulkLimit {
+		http.Error(w, fmt.Sprintf("Batch has %d operations, at most %d are allowed", len(body.Operations), *bulkLimit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	writes := false
+	denied := make([]bool, len(body.Operations))
+	for i, operation := range body.Operations {
+		need := rightRead
+		if operation.Op != "get" {
+			writes, need = true, rightWrite
+		}
+		denied[i] = !authorize(r, need, operation.Key)
+		if denied[i] && body.Atomic {
+			http.Error(w, fmt.Sprintf("Nothing was applied, operation %d on %q is forbidden", i, operation.Key), http.StatusForbidden)
+			return
+		}
+	}
+	if writes && readOnly(w, r, replica) {
+		return
+	}
+
+	var results []bulkResult
+	var err error
+	switch {
+	case body.Atomic && cluster != nil:
+		http.Error(w, "Atomic batches are not replicated", http.StatusNotImplemented)
+		return
+	case body.Atomic:
+		results, err = applyAtomic(ss, body.Operations)
+	default:
+		ctx, cancel := context.WithTimeout(r.Context(), *requestTimeout)
+		defer cancel()
+		results, err = applyEach(ctx, ss, cluster, body.Operations, denied)
+	}
+	if storageGaveUp(w, err) {
+		return
+	}
+	var failure bulkFailure
+	switch {
+	case errors.As(err, &failure):
+		http.Error(w, "Nothing was applied, "+failure.Error(), failure.result.Status)
+		return
+	case errors.Is(err, safestorage.ErrCrossShard):
+		http.Error(w, "Keys of an atomic batch belong to different shards", http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, "Cannot apply the batch", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"results": results})
+}
+
+// applyEach runs the operations one by one, only an abandoned request stops the batch.
+// The denied operations are answered with 403.
+func applyEach(ctx context.Context, ss *safestorage.SafeStorage, cluster *quorum, operations []bulkOperation, denied []bool) ([]bulkResult, error) {
+	results := make([]bulkResult, len(operations))
+	for i, operation := range operations {
+		if err := operation.validate(); err != nil {
+			results[i] = failedResult(operation.Key, http.StatusBadRequest, err.Error())
+			continue
+		}
+		if denied[i] {
+			results[i] = failedResult(operation.Key, http.StatusForbidden, "forbidden")
+			continue
+		}
+		result, err := applyOne(ctx, ss, cluster, operation)
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+		results[i] = result
+	}
+	return results, nil
+}
+
+func applyOne(ctx context.Context, ss *safestorage.SafeStorage, cluster *quorum, operation bulkOperation) (bulkResult, error) {
+	result := bulkResult{Key: operation.Key, Status: http.StatusOK}
+	var err error
+	switch {
+	case cluster != nil && operation.Op == "get":
+		var value replicaValue
+		var found bool
+		if value, found, err = cluster.read(ctx, ss, operation.Key); err == nil && !found {
+			err = datastore.ErrNotFound
+		}
+		result.Value, result.Version = &value.Value, value.Version
+	case cluster != nil && operation.Op == "put":
+		_, err = cluster.write(ctx, operation.Key, replicaValue{Value: operation.Value})
+	case cluster != nil:
+		var found bool
+		if found, err = cluster.remove(ctx, ss, operation.Key); err == nil && !found {
+			err = datastore.ErrNotFound
+		}
+		result.Status = http.StatusNoContent
+	case operation.Op == "get":
+		var value string
+		value, result.Version, err = ss.GetVersioned(operation.Key)
+		result.Value = &value
+	case operation.Op == "put":
+		err = ss.Put(operation.Key, operation.Value)
+	default:
+		err = ss.Delete(operation.Key)
+		result.Status = http.StatusNoContent
+	}
+	var missing quorumError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled):
+		return result, err
+	case errors.Is(err, datastore.ErrNotFound):
+		return failedResult(operation.Key, http.StatusNotFound, "key not found"), nil
+	case errors.As(err, &missing) || errors.Is(err, datastore.ErrReadOnly):
+		return failedResult(operation.Key, http.StatusServiceUnavailable, err.Error()), nil
+	case errors.Is(err, datastore.ErrQuotaExceeded):
+		return failedResult(operation.Key, http.StatusInsufficientStorage, err.Error()), nil
+	case err != nil:
+		return failedResult(operation.Key, http.StatusInternalServerError, err.Error()), nil
+	}
+	return result, nil
+}
+
+// applyAtomic runs the operations in a transaction, which is repeated if a key it has read changes.
+func applyAtomic(ss *safestorage.SafeStorage, operations []bulkOperation) ([]bulkResult, error) {
+	for i, operation := range operations {
+		if err := operation.validate(); err != nil {
+			return nil, bulkFailure{i, failedResult(operation.Key, http.StatusBadRequest, err.Error())}
+		}
+	}
+	for {
+		results := make([]bulkResult, len(operations))
+		err := ss.Update(func(tx *datastore.Tx) error {
+			for i, operation := range operations {
+				results[i] = bulkResult{Key: operation.Key, Status: http.StatusOK}
+				switch operation.Op {
+				case "get":
+					value, err := tx.Get(operation.Key)
+					if errors.Is(err, datastore.ErrNotFound) {
+						results[i] = failedResult(operation.Key, http.StatusNotFound, "key not found")
+						continue
+					}
+					if err != nil {
+						return err
+					}
+					results[i].Value = &value
+				case "put":
+					tx.Put(operation.Key, operation.Value)
+				case "delete":
+					_, err := tx.Get(operation.Key)
+					if errors.Is(err, datastore.ErrNotFound) {
+						return bulkFailure{i, failedResult(operation.Key, http.StatusConflict, "key not found")}
+					}
+					if err != nil {
+						return err
+					}
+					tx.Delete(operation.Key)
+					results[i].Status = http.StatusNoContent
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, datastore.ErrConflict) {
+			continue
+		}
+		return results, err
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+func TestBulk(t *testing.T) {
+	ss := safestorage.Init(datastore.NewMemory())
+	server := httptest.NewServer(routes(ss, nil, nil))
+	t.Cleanup(func() {
+		server.Close()
+		_ = ss.Close()
+	})
+	bulk := func(body string) (int, []bulkResult) {
+		status, text := request(t, http.MethodPost, server.URL+"/db/_bulk", body)
+		var response struct {
+			Results []bulkResult `json:"results"`
+		}
+		_ = json.Unmarshal([]byte(text), &response)
+		return status, response.Results
+	}
+	request(t, http.MethodPost, server.URL+"/db/a", `{"value": "1"}`)
+
+	status, results := bulk(`{"operations": [
+		{"op": "get", "key": "a"},
+		{"op": "put", "key": "b", "value": "2"},
+		{"op": "get", "key": "b"},
+		{"op": "delete", "key": "missing"},
+		{"op": "rename", "key": "a"},
+		{"op": "delete", "key": "a"}
+	]}`)
+	if status != http.StatusOK || len(results) != 6 {
+		t.Fatalf("Bulk answered %d with %d results", status, len(results))
+	}
+	expected := []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusNotFound, http.StatusBadRequest, http.StatusNoContent}
+	for i, result := range results {
+		if result.Status != expected[i] {
+			t.Errorf("Operation %d has status %d, wanted %d: %+v", i, result.Status, expected[i], result)
+		}
+	}
+	if *results[0].Value != "1" || results[0].Version == 0 || *results[2].Value != "2" {
+		t.Errorf("Unexpected values %+v", results)
+	}
+	if results[3].Error == "" || results[4].Error == "" {
+		t.Errorf("Failed operations have no errors %+v", results)
+	}
+
+	t.Run("atomic", func(t *testing.T) {
+		status, results := bulk(`{"atomic": true, "operations": [
+			{"op": "put", "key": "c", "value": "3"},
+			{"op": "get", "key": "c"},
+			{"op": "delete", "key": "b"},
+			{"op": "get", "key": "b"}
+		]}`)
+		if status != http.StatusOK || len(results) != 4 {
+			t.Fatalf("Atomic bulk answered %d with %d results", status, len(results))
+		}
+		if *results[1].Value != "3" || results[2].Status != http.StatusNoContent || results[3].Status != http.StatusNotFound {
+			t.Errorf("Reads do not see the writes of the batch: %+v", results)
+		}
+
+		status, _ = bulk(`{"atomic": true, "operations": [
+			{"op": "put", "key": "d", "value": "4"},
+			{"op": "delete", "key": "missing"}
+		]}`)
+		if status != http.StatusConflict {
+			t.Errorf("Failed atomic bulk answered %d", status)
+		}
+		if status, _ := request(t, http.MethodGet, server.URL+"/db/d", ""); status != http.StatusNotFound {
+			t.Errorf("Write of a failed atomic batch was applied, status %d", status)
+		}
+		if status, _ := bulk(`{"atomic": true, "operations": [{"op": "put", "key": ""}]}`); status != http.StatusBadRequest {
+			t.Errorf("Invalid atomic bulk answered %d", status)
+		}
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		defer func(limit int) {
+			*bulkLimit = limit
+		}(*bulkLimit)
+		*bulkLimit = 2
+		operations := strings.Repeat(`{"op": "get", "key": "a"},`, 3)
+		if status, _ := bulk(`{"operations": [` + strings.TrimSuffix(operations, ",") + `]}`); status != http.StatusRequestEntityTooLarge {
+			t.Errorf("Too large batch answered %d", status)
+		}
+		if status, results := bulk(`{"operations": [{"op": "get", "key": "a"}, {"op": "get", "key": "c"}]}`); status != http.StatusOK || len(results) != 2 {
+			t.Errorf("Batch at the limit answered %d", status)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+// counterKey tells whether a key is reserved for the counter operations. POST /db/{key}/incr
+// would also be a write of the bucket key incr, so it always changes the root key,
+// while the other methods still reach the bucket keys incr and append.
+func counterKey(key string) bool {
+	return key == "incr" || key == "append"
+}
+
+// counterOperation recognizes POST /db/{key}/incr and POST /db/{key}/append.
+func counterOperation(r *http.Request) (key, operation string, found bool) {
+	if r.Method != http.MethodPost {
+		return "", "", false
+	}
+	key, operation, found = strings.Cut(strings.TrimPrefix(r.URL.Path, "/db/"), "/")
+	if !found || key == "" || !counterKey(operation) {
+		return "", "", false
+	}
+	return key, operation, true
+}
+
+// handleCounter applies {"delta": n} to a counter and answers with its new value,
+// a missing delta adds 1. Append adds {"value": "suffix"} to the value.
+func handleCounter(w http.ResponseWriter, r *http.Request, ss *safestorage.SafeStorage, key, operation string) {
+	var body struct {
+		Delta *int64 `json:"delta"`
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	var counter int64
+	var err error
+	if operation == "incr" {
+		delta := int64(1)
+		if body.Delta != nil {
+			delta = *body.Delta
+		}
+		counter, err = ss.Increment(key, delta)
+	} else {
+		err = ss.Append(key, body.Value)
+	}
+	if storageGaveUp(w, err) {
+		return
+	}
+	switch {
+	case errors.Is(err, datastore.ErrNotInteger) || errors.Is(err, datastore.ErrOverflow):
+		http.Error(w, "Cannot increment: "+err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Cannot store value", http.StatusInternalServerError)
+		return
+	}
+	if operation == "append" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"key": key, "value": counter})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+func TestCounters(t *testing.T) {
+	ss := safestorage.Init(datastore.NewMemory())
+	server := httptest.NewServer(routes(ss, nil, nil))
+	t.Cleanup(func() {
+		server.Close()
+		_ = ss.Close()
+	})
+
+	// concurrent increments are not lost
+	var clients sync.WaitGroup
+	for range 50 {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			if status, body := request(t, http.MethodPost, server.URL+"/db/hits/incr", ""); status != http.StatusOK {
+				t.Errorf("Increment answered %d %s", status, body)
+			}
+		}()
+	}
+	clients.Wait()
+	status, body := request(t, http.MethodPost, server.URL+"/db/hits/incr", `{"delta": -10}`)
+	if status != http.StatusOK || !strings.Contains(body, `"value":40`) {
+		t.Errorf("Increment by -10 answered %d %s", status, body)
+	}
+
+	request(t, http.MethodPost, server.URL+"/db/name", `{"value": "text"}`)
+	if status, _ := request(t, http.MethodPost, server.URL+"/db/name/incr", ""); status != http.StatusConflict {
+		t.Errorf("Increment of a text answered %d", status)
+	}
+	if status, _ := request(t, http.MethodPost, server.URL+"/db/name/append", `{"value": "-more"}`); status != http.StatusOK {
+		t.Errorf("Append answered %d", status)
+	}
+	if value := valueOf(t, &node{server: server}, "name"); value != "text-more" {
+		t.Errorf("Appended value is %q", value)
+	}
+	if status, _ := request(t, http.MethodPost, server.URL+"/db/name/incr", "{"); status != http.StatusBadRequest {
+		t.Errorf("Invalid body answered %d", status)
+	}
+
+	// /db/{bucket}/incr is always the counter of the root key, never a key of the bucket
+	request(t, http.MethodPost, server.URL+"/db/bucket/incr", "")
+	if value := valueOf(t, &node{server: server}, "bucket"); value != "1" {
+		t.Errorf("POST /db/bucket/incr left the root key at %q", value)
+	}
+	if keys, _ := ss.ScanIn("bucket", ""); len(keys) != 0 {
+		t.Errorf("Counter operations wrote the bucket keys %v", keys)
+	}
+	if status, _ := request(t, http.MethodGet, server.URL+"/db/bucket/append", ""); status != http.StatusNotFound {
+		t.Errorf("GET of a missing bucket key append answered %d", status)
+	}
+	_ = ss.PutIn("bucket", "append", "stored")
+	if status, body := request(t, http.MethodGet, server.URL+"/db/bucket/append", ""); status != http.StatusOK || !strings.Contains(body, "stored") {
+		t.Errorf("GET of the bucket key append answered %d %s", status, body)
+	}
+	if status, _ := request(t, http.MethodDelete, server.URL+"/db/bucket/append", ""); status != http.StatusNoContent {
+		t.Errorf("DELETE of the bucket key append answered %d", status)
+	}
+}
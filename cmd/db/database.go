@@ -1,31 +1,161 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/KatePril/architecture-lab-5/datastore"
 	"github.com/KatePril/architecture-lab-5/httptools"
 	"github.com/KatePril/architecture-lab-5/safestorage"
 	"github.com/KatePril/architecture-lab-5/signal"
+	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 )
 
-var port = flag.Int("port", 8091, "server port")
+var (
+	port            = flag.Int("port", 8091, "server port")
+	shards          = flag.Int("shards", 1, "number of database partitions, each served by its own worker")
+	dataDir         = flag.String("data", "db1/", "directory of the database files")
+	engine          = flag.String("engine", "bitcask", "storage engine, bitcask keeps the data on disk, memory loses it on exit")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "time to finish requests and flush the database on shutdown")
+	maxDiskBytes    = flag.Int64("max-disk-bytes", 0, "largest size of the database files, split evenly between the shards, 0 means no limit")
+	minFreeBytes    = flag.Uint64("min-free-bytes", 16<<20, "disk space the writes must leave free, deletes and merges may still use it")
+)
 
-const confHealthFailure = "CONF_HEALTH_FAILURE"
+const (
+	confHealthFailure = "CONF_HEALTH_FAILURE"
+	octetStream       = "application/octet-stream"
+)
 
 func main() {
-	db, err := datastore.Open("db1/")
+	flag.Parse()
+
+	storages, err := openStorages(*engine, *shards)
 	if err != nil {
 		fmt.Println("Error opening database: ", err)
 		os.Exit(1)
 	}
-	ss := safestorage.Init(db)
+	ss := safestorage.InitSharded(storages)
+
+	// stops end the background work in this order before the HTTP server shuts down
+	var stops []func()
+
+	var replica *follower
+	if *leaderAddress != "" {
+		if *engine != "bitcask" {
+			fmt.Println("Replication requires the bitcask engine")
+			os.Exit(1)
+		}
+		if *adminPort == 0 {
+			// /admin/promote is only served on the admin port
+			fmt.Println("A follower requires -admin-port, otherwise it cannot be promoted")
+			os.Exit(1)
+		}
+		if replica, err = follow(*leaderAddress, ss, *dataDir); err != nil {
+			fmt.Println("Error starting replication: ", err)
+			os.Exit(1)
+		}
+		stops = append(stops, replica.stop)
+	}
 
+	var cluster *quorum
+	if peers := parsePeers(*peerList); len(peers) > 0 {
+		if replica != nil {
+			fmt.Println("A node is either a follower or a quorum replica")
+			os.Exit(1)
+		}
+		if cluster, err = newQuorum(ss, peers, *writeQuorum, *readQuorum); err != nil {
+			fmt.Println("Error starting replication: ", err)
+			os.Exit(1)
+		}
+		cluster.start(*antiEntropyInterval)
+		stops = append(stops, cluster.stop)
+	}
+
+	var handler http.Handler = routes(ss, replica, cluster)
+	if *authConfigPath != "" {
+		if *respPort != 0 || *binaryPort != 0 {
+			fmt.Println("The RESP and binary protocol listeners do not support authentication")
+			os.Exit(1)
+		}
+		audit := io.Writer(os.Stderr)
+		if *auditLogPath != "" {
+			file, err := os.OpenFile(*auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+			if err != nil {
+				fmt.Println("Error opening the audit log: ", err)
+				os.Exit(1)
+			}
+			defer file.Close()
+			audit = file
+		}
+		auth, err := loadAuth(*authConfigPath, audit)
+		if err != nil {
+			fmt.Println("Error loading the tokens: ", err)
+			os.Exit(1)
+		}
+		handler = auth.wrap(handler)
+	}
+	handler = instrument(handler)
+
+	if *respPort != 0 {
+		resp := serveRESP(listen("RESP", *respPort, cluster), ss, replica)
+		stops = append(stops, resp.stop)
+	}
+	if *binaryPort != 0 {
+		binary := serveBinary(listen("binary protocol", *binaryPort, cluster), ss, replica)
+		stops = append(stops, binary.stop)
+	}
+
+	if *adminPort != 0 {
+		if *adminToken == "" {
+			fmt.Println("The admin port requires -admin-token or DB_ADMIN_TOKEN")
+			os.Exit(1)
+		}
+		admin := httptools.CreateServer(*adminPort, adminRoutes(ss, replica, cluster, *adminToken))
+		admin.Start()
+		log.Printf("Serving the admin API on port %d...", *adminPort)
+		stops = append(stops, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+			defer cancel()
+			if err := admin.Shutdown(ctx); err != nil {
+				log.Printf("Admin server shutdown: %s", err)
+			}
+		})
+	}
+
+	server := httptools.CreateServer(*port, handler)
+	server.Start()
+	log.Printf("Starting server on port %d...", *port)
+	signal.WaitForTerminationSignal()
+	shutdown(server, ss, stops)
+}
+
+// listen opens the port of a TCP protocol, the protocols read the local values,
+// which are not the newest ones with quorum replication.
+func listen(name string, port int, cluster *quorum) net.Listener {
+	if cluster != nil {
+		fmt.Printf("The %s listener does not support quorum replication\n", name)
+		os.Exit(1)
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		fmt.Printf("Error starting the %s listener: %s\n", name, err)
+		os.Exit(1)
+	}
+	log.Printf("Serving the %s on port %d...", name, port)
+	return listener
+}
+
+// routes serves the storage, replica is nil on the leader and cluster is nil without quorum replication.
+func routes(ss *safestorage.SafeStorage, replica *follower, cluster *quorum) *http.ServeMux {
 	h := new(http.ServeMux)
 
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
@@ -33,33 +163,155 @@ func main() {
 		if failConfig := os.Getenv(confHealthFailure); failConfig == "true" {
 			rw.WriteHeader(http.StatusInternalServerError)
 			_, _ = rw.Write([]byte("FAILURE"))
+		} else if replica != nil && replica.ready() != nil {
+			// a follower that copies a shard again would answer with a part of the keys
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = rw.Write([]byte("SYNCING"))
 		} else {
 			rw.WriteHeader(http.StatusOK)
 			_, _ = rw.Write([]byte("OK"))
 		}
 	})
 
+	h.Handle("/livez", livez())
+	h.Handle("/readyz", readyz(ss, replica))
+
+	h.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		handleMetrics(w, r, ss)
+	})
+
+	h.HandleFunc("/internal/log", func(w http.ResponseWriter, r *http.Request) {
+		ss, cancel := scoped(r, ss)
+		defer cancel()
+		handleLog(w, r, ss)
+	})
+
+	if cluster != nil {
+		h.HandleFunc("/internal/replica/", func(w http.ResponseWriter, r *http.Request) {
+			ss, cancel := scoped(r, ss)
+			defer cancel()
+			handleReplica(w, r, ss, cluster, strings.TrimPrefix(r.URL.Path, "/internal/replica/"))
+		})
+		h.HandleFunc("/internal/merkle", func(w http.ResponseWriter, r *http.Request) {
+			ss, cancel := scoped(r, ss)
+			defer cancel()
+			handleMerkle(w, r, ss, cluster)
+		})
+	}
+
+	h.HandleFunc("/db/_txn", func(w http.ResponseWriter, r *http.Request) {
+		if unreplicated(w, cluster, "Transactions") || readOnly(w, r, replica) {
+			return
+		}
+		ss, cancel := scoped(r, ss)
+		defer cancel()
+		handleTransaction(w, r, ss)
+	})
+
+	h.HandleFunc("/db/_bulk", func(w http.ResponseWriter, r *http.Request) {
+		ss, cancel := scoped(r, ss)
+		defer cancel()
+		handleBulk(w, r, ss, replica, cluster)
+	})
+
+	h.HandleFunc("/db/_watch", func(w http.ResponseWriter, r *http.Request) {
+		if unreplicated(w, cluster, "Watches") {
+			return
+		}
+		handleWatch(w, r, ss)
+	})
+
+	h.HandleFunc("/db/_index/", func(w http.ResponseWriter, r *http.Request) {
+		if unreplicated(w, cluster, "Indexes") || readOnly(w, r, replica) {
+			return
+		}
+		ss, cancel := scoped(r, ss)
+		defer cancel()
+		handleIndex(w, r, ss, strings.TrimPrefix(r.URL.Path, "/db/_index/"))
+	})
+
 	h.HandleFunc("/db/", func(w http.ResponseWriter, r *http.Request) {
+		if readOnly(w, r, replica) {
+			return
+		}
+		ss, cancel := scoped(r, ss)
+		defer cancel()
+		if key, operation, found := counterOperation(r); found {
+			if unreplicated(w, cluster, "Counters") {
+				return
+			}
+			handleCounter(w, r, ss, key, operation)
+			return
+		}
 		key := strings.TrimPrefix(r.URL.Path, "/db/")
+		if bucket, bucketKey, found := strings.Cut(key, "/"); found {
+			if unreplicated(w, cluster, "Buckets") {
+				return
+			}
+			handleBucket(w, r, ss, bucket, bucketKey)
+			return
+		}
 		if key == "" {
 			http.Error(w, "Key is required", http.StatusBadRequest)
 			return
 		}
+		if cluster != nil {
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mediaType == octetStream || strings.Contains(r.Header.Get("Accept"), octetStream) {
+				http.Error(w, "Streams are not replicated", http.StatusUnsupportedMediaType)
+				return
+			}
+			handleQuorum(w, r, ss, cluster, key)
+			return
+		}
 		switch r.Method {
 		case http.MethodGet:
-			value, getError := ss.Get(key)
+			if strings.Contains(r.Header.Get("Accept"), octetStream) {
+				stream, getError := ss.GetStream(key)
+				if storageGaveUp(w, getError) {
+					return
+				}
+				if getError != nil {
+					http.Error(w, "Key not found", http.StatusNotFound)
+					return
+				}
+				defer stream.Close()
+				w.Header().Set("Content-Type", octetStream)
+				_, _ = io.Copy(w, stream)
+				return
+			}
+			value, version, getError := ss.GetVersioned(key)
+			if storageGaveUp(w, getError) {
+				return
+			}
 			if getError != nil {
 				http.Error(w, "Key not found", http.StatusNotFound)
 				return
 			}
 			response := map[string]any{
-				"key":   key,
-				"value": value,
+				"key":     key,
+				"value":   value,
+				"version": version,
 			}
 
 			w.Header().Set("Content-Type", "application/json")
 			_ = json.NewEncoder(w).Encode(response)
 		case http.MethodPost:
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == octetStream {
+				if r.ContentLength < 0 {
+					http.Error(w, "Content-Length is required", http.StatusLengthRequired)
+					return
+				}
+				if err := ss.PutStream(key, r.Body, r.ContentLength); err != nil {
+					if storageGaveUp(w, err) {
+						return
+					}
+					http.Error(w, "Cannot store body", http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				return
+			}
 			var body struct {
 				Value string `json:"value"`
 			}
@@ -69,15 +321,91 @@ func main() {
 				return
 			}
 
-			ss.Put(key, body.Value)
+			if err := ss.Put(key, body.Value); err != nil {
+				if storageGaveUp(w, err) {
+					return
+				}
+				http.Error(w, "Cannot store value", http.StatusInternalServerError)
+				return
+			}
 			w.WriteHeader(http.StatusOK)
+		case http.MethodDelete:
+			err := ss.Delete(key)
+			if storageGaveUp(w, err) {
+				return
+			}
+			if errors.Is(err, datastore.ErrNotFound) {
+				http.Error(w, "Key not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Cannot delete value", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
 		default:
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
-	server := httptools.CreateServer(*port, h)
-	server.Start()
-	log.Printf("Starting server on port %d...", *port)
-	signal.WaitForTerminationSignal()
+	return h
+}
+
+// openStorages creates a storage for every partition with the chosen engine.
+func openStorages(engine string, count int) ([]safestorage.Storage, error) {
+	switch engine {
+	case "bitcask":
+		options := datastore.Options{MinFreeBytes: *minFreeBytes}
+		if count > 0 {
+			options.MaxDiskBytes = *maxDiskBytes / int64(count)
+		}
+		partitions, err := datastore.OpenShardsWithOptions(*dataDir, count, options)
+		if err != nil {
+			return nil, err
+		}
+		storages := make([]safestorage.Storage, len(partitions))
+		for i, partition := range partitions {
+			storages[i] = partition
+		}
+		return storages, nil
+	case "memory":
+		if count < 1 {
+			return nil, fmt.Errorf("invalid shard count %d", count)
+		}
+		storages := make([]safestorage.Storage, count)
+		for i := range storages {
+			storages[i] = datastore.NewMemory()
+		}
+		return storages, nil
+	default:
+		return nil, fmt.Errorf("unknown engine %q, use bitcask or memory", engine)
+	}
+}
+
+// shutdown stops the background work, finishes the active requests, then drains the storage queue and closes the database.
+func shutdown(server httptools.Server, ss *safestorage.SafeStorage, stops []func()) {
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	close(stopWatching)
+	for _, stop := range stops {
+		stop()
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("HTTP server shutdown: %s", err)
+	}
+	closed := make(chan error, 1)
+	go func() {
+		closed <- ss.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			log.Printf("Cannot close the database: %s", err)
+			os.Exit(1)
+		}
+		log.Println("Database closed")
+	case <-ctx.Done():
+		log.Println("Database was not closed in time")
+		os.Exit(1)
+	}
 }
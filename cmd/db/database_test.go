@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+func TestDelete(t *testing.T) {
+	ss := safestorage.Init(datastore.NewMemory())
+	server := httptest.NewServer(routes(ss, nil, nil))
+	t.Cleanup(func() {
+		server.Close()
+		_ = ss.Close()
+	})
+
+	request(t, http.MethodPost, server.URL+"/db/key", `{"value": "v1"}`)
+	if status, _ := request(t, http.MethodDelete, server.URL+"/db/key", ""); status != http.StatusNoContent {
+		t.Errorf("Delete of an existing key answered %d", status)
+	}
+	if status, _ := request(t, http.MethodGet, server.URL+"/db/key", ""); status != http.StatusNotFound {
+		t.Errorf("Deleted key answered %d", status)
+	}
+	// a repeated delete leaves the key deleted and tells the client it was already gone
+	for range 2 {
+		if status, _ := request(t, http.MethodDelete, server.URL+"/db/key", ""); status != http.StatusNotFound {
+			t.Errorf("Repeated delete answered %d", status)
+		}
+	}
+	if status, _ := request(t, http.MethodDelete, server.URL+"/db/never", ""); status != http.StatusNotFound {
+		t.Errorf("Delete of a missing key answered %d", status)
+	}
+
+	request(t, http.MethodPost, server.URL+"/db/key", `{"value": "v2"}`)
+	if value := valueOf(t, &node{server: server}, "key"); value != "v2" {
+		t.Errorf("Key written after the delete has %q", value)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	db, err := datastore.OpenWithOptions(t.TempDir(), datastore.Options{MaxDiskBytes: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := safestorage.Init(db)
+	server := httptest.NewServer(routes(ss, nil, nil))
+	t.Cleanup(func() {
+		server.Close()
+		_ = ss.Close()
+	})
+
+	value := `{"value": "` + strings.Repeat("v", 100) + `"}`
+	if status, _ := request(t, http.MethodPost, server.URL+"/db/first", value); status != http.StatusOK {
+		t.Fatalf("Write within the quota answered %d", status)
+	}
+	if status, _ := request(t, http.MethodPost, server.URL+"/db/second", value); status != http.StatusInsufficientStorage {
+		t.Errorf("Write over the quota answered %d", status)
+	}
+	status, body := request(t, http.MethodPost, server.URL+"/db/_bulk", `{"operations": [{"op": "put", "key": "second", "value": "`+strings.Repeat("v", 100)+`"}]}`)
+	if status != http.StatusOK || !strings.Contains(body, `"status":507`) {
+		t.Errorf("Bulk write over the quota answered %d %s", status, body)
+	}
+	if status, _ := request(t, http.MethodDelete, server.URL+"/db/first", ""); status != http.StatusNoContent {
+		t.Errorf("Delete over the quota answered %d", status)
+	}
+}
+
+func TestBucketDelete(t *testing.T) {
+	ss := safestorage.Init(datastore.NewMemory())
+	server := httptest.NewServer(routes(ss, nil, nil))
+	t.Cleanup(func() {
+		server.Close()
+		_ = ss.Close()
+	})
+
+	request(t, http.MethodPost, server.URL+"/db/users/ann", `{"value": "a"}`)
+	request(t, http.MethodPost, server.URL+"/db/users/bob", `{"value": "b"}`)
+	request(t, http.MethodPost, server.URL+"/db/users", `{"value": "root"}`)
+	if status, _ := request(t, http.MethodDelete, server.URL+"/db/users/ann", ""); status != http.StatusNoContent {
+		t.Errorf("Delete of a bucket key answered %d", status)
+	}
+	if status, _ := request(t, http.MethodDelete, server.URL+"/db/users/ann", ""); status != http.StatusNotFound {
+		t.Errorf("Repeated delete of a bucket key answered %d", status)
+	}
+	if status, _ := request(t, http.MethodGet, server.URL+"/db/users/bob", ""); status != http.StatusOK {
+		t.Errorf("Other bucket key answered %d", status)
+	}
+
+	if status, _ := request(t, http.MethodDelete, server.URL+"/db/users/", ""); status != http.StatusNoContent {
+		t.Errorf("Drop of the bucket answered %d", status)
+	}
+	if status, body := request(t, http.MethodGet, server.URL+"/db/users/", ""); status != http.StatusOK || !strings.Contains(body, `"keys":[]`) {
+		t.Errorf("Dropped bucket lists %d %s", status, body)
+	}
+	if value := valueOf(t, &node{server: server}, "users"); value != "root" {
+		t.Errorf("Drop of the bucket changed the root key to %q", value)
+	}
+}
+
+func TestTransactionShards(t *testing.T) {
+	ss := safestorage.InitSharded([]safestorage.Storage{datastore.NewMemory(), datastore.NewMemory()})
+	server := httptest.NewServer(routes(ss, nil, nil))
+	t.Cleanup(func() {
+		server.Close()
+		_ = ss.Close()
+	})
+	first := "key-0"
+	other := first
+	for i := 1; safestorage.ShardOf(other, 2) == safestorage.ShardOf(first, 2); i++ {
+		other = fmt.Sprintf("key-%d", i)
+	}
+
+	body := fmt.Sprintf(`{"writes": [{"key": %q, "value": "v"}, {"key": %q, "value": "v"}]}`, first, other)
+	if status, _ := request(t, http.MethodPost, server.URL+"/db/_txn", body); status != http.StatusBadRequest {
+		t.Errorf("Transaction across shards answered %d", status)
+	}
+	if _, err := ss.Get(first); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("Transaction across shards was applied, error %v", err)
+	}
+	body = fmt.Sprintf(`{"writes": [{"key": %q, "value": "v"}]}`, other)
+	if status, _ := request(t, http.MethodPost, server.URL+"/db/_txn", body); status != http.StatusOK {
+		t.Errorf("Transaction of one shard answered %d", status)
+	}
+}
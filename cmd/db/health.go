@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/KatePril/architecture-lab-5/httptools"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+var (
+	readyFreeBytes = flag.Uint64("ready-min-free-bytes", 64<<20, "free disk space below which the node is not ready")
+	maxQueueDepth  = flag.Int("ready-max-queue-depth", 64, "commands waiting for a shard worker above which the node is not ready")
+	checkTimeout   = flag.Duration("ready-timeout", 2*time.Second, "how long the readiness checks may take")
+)
+
+// livez only tells that the process serves HTTP, a restart would not fix a failing readiness check.
+func livez() http.Handler {
+	return httptools.HealthHandler(*checkTimeout, nil)
+}
+
+// readyz tells whether the node can serve the traffic: every shard answers and takes writes,
+// the disk has space and the workers keep up with the commands. A follower is also
+// not ready until all its shards have caught up with the leader.
+func readyz(ss *safestorage.SafeStorage, replica *follower) http.Handler {
+	checks := map[string]httptools.Check{
+		"storage": func(ctx context.Context) error {
+			for shard := range ss.Shards() {
+				stats, err := ss.WithContext(ctx).Health(shard)
+				switch {
+				case errors.Is(err, safestorage.ErrNoStats):
+					// the memory engine is always writable
+				case err != nil:
+					return fmt.Errorf("shard %d: %w", shard, err)
+				case stats.ReadOnly:
+					return fmt.Errorf("shard %d is read-only", shard)
+				}
+			}
+			return nil
+		},
+		"disk": func(ctx context.Context) error {
+			for shard := range ss.Shards() {
+				stats, err := ss.WithContext(ctx).Health(shard)
+				if errors.Is(err, safestorage.ErrNoStats) {
+					continue
+				}
+				if err != nil {
+					return fmt.Errorf("shard %d: %w", shard, err)
+				}
+				if stats.FreeBytes < *readyFreeBytes {
+					return fmt.Errorf("shard %d has %d free bytes, at least %d are required", shard, stats.FreeBytes, *readyFreeBytes)
+				}
+			}
+			return nil
+		},
+		"queue": func(ctx context.Context) error {
+			for shard, depth := range ss.QueueDepth() {
+				if depth > *maxQueueDepth {
+					return fmt.Errorf("shard %d has %d queued commands, at most %d are allowed", shard, depth, *maxQueueDepth)
+				}
+			}
+			return nil
+		},
+	}
+	if replica != nil {
+		checks["replication"] = func(ctx context.Context) error {
+			return replica.ready()
+		}
+	}
+	return httptools.HealthHandler(*checkTimeout, checks)
+}
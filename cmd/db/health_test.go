@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+func TestReadiness(t *testing.T) {
+	storages := make([]safestorage.Storage, 2)
+	for i := range storages {
+		db, err := datastore.Open(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		storages[i] = db
+	}
+	ss := safestorage.InitSharded(storages)
+	server := httptest.NewServer(routes(ss, nil, nil))
+	t.Cleanup(server.Close)
+	checks := func(path string) (int, map[string]map[string]string) {
+		t.Helper()
+		status, body := request(t, http.MethodGet, server.URL+path, "")
+		var report struct {
+			Checks map[string]map[string]string `json:"checks"`
+		}
+		if err := json.Unmarshal([]byte(body), &report); err != nil {
+			t.Fatalf("%s answered %s", path, body)
+		}
+		return status, report.Checks
+	}
+
+	if status, result := checks("/readyz"); status != http.StatusOK || len(result) != 3 || result["disk"]["status"] != "ok" {
+		t.Errorf("Ready node answered %d %v", status, result)
+	}
+
+	if err := ss.SetReadOnly(true); err != nil {
+		t.Fatal(err)
+	}
+	if status, result := checks("/readyz"); status != http.StatusServiceUnavailable || result["storage"]["status"] != "failing" || result["queue"]["status"] != "ok" {
+		t.Errorf("Read-only node answered %d %v", status, result)
+	}
+	_ = ss.SetReadOnly(false)
+
+	defer func(free uint64) {
+		*readyFreeBytes = free
+	}(*readyFreeBytes)
+	*readyFreeBytes = 1 << 62
+	if status, result := checks("/readyz"); status != http.StatusServiceUnavailable || result["disk"]["status"] != "failing" {
+		t.Errorf("Node with a full disk answered %d %v", status, result)
+	}
+
+	_ = ss.Close()
+	if status, result := checks("/readyz"); status != http.StatusServiceUnavailable || result["storage"]["error"] == "" {
+		t.Errorf("Closed node answered %d %v", status, result)
+	}
+	if status, _ := checks("/livez"); status != http.StatusOK {
+		t.Errorf("Live node answered %d", status)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+// handleIndex serves /db/_index/{name}: GET with ?eq= queries the index,
+// POST with a JSON path in the body registers it.
+func handleIndex(w http.ResponseWriter, r *http.Request, ss *safestorage.SafeStorage, name string) {
+	if name == "" {
+		http.Error(w, "Index name is required", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if !r.URL.Query().Has("eq") {
+			http.Error(w, "Query parameter eq is required", http.StatusBadRequest)
+			return
+		}
+		keys, err := ss.QueryIndex(name, r.URL.Query().Get("eq"))
+		if storageGaveUp(w, err) {
+			return
+		}
+		if errors.Is(err, datastore.ErrNoIndex) {
+			http.Error(w, "Index not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Cannot query index", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"index": name,
+			"keys":  keys,
+		})
+	case http.MethodPost:
+		var body struct {
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := ss.RegisterIndex(name, body.Path); err != nil {
+			if storageGaveUp(w, err) {
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
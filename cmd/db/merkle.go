@@ -0,0 +1,385 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+var antiEntropyInterval = flag.Duration("anti-entropy-interval", time.Minute, "how often a quorum replica compares its hash tree with the peers and exchanges the differing keys")
+
+const (
+	merkleDepth = 10
+	// merkleLeaves is the number of key ranges, the keys are spread over them by hash
+	merkleLeaves = 1 << merkleDepth
+)
+
+// merkleTree is a hash tree over the root keys. Every leaf covers a range of key hashes,
+// its hash combines the keys of the range with their values and versions, and every other node
+// hashes its two children. Replicas with equal hashes of a node have the same keys under it.
+type merkleTree struct {
+	mutex sync.Mutex
+	// nodes is a heap: the root is 1, the children of n are 2n and 2n+1, the last merkleLeaves are the leaves
+	nodes []uint64
+	// items has the hashes of the keys of every leaf
+	items []map[string]uint64
+	// pending collects the changes made while the tree is being rebuilt
+	pending map[string]*replicaValue
+}
+
+func newMerkleTree() *merkleTree {
+	tree := &merkleTree{
+		nodes: make([]uint64, 2*merkleLeaves),
+		items: make([]map[string]uint64, merkleLeaves),
+	}
+	for leaf := range tree.items {
+		tree.items[leaf] = make(map[string]uint64)
+	}
+	for node := merkleLeaves - 1; node > 0; node-- {
+		tree.nodes[node] = combine(tree.nodes[2*node], tree.nodes[2*node+1])
+	}
+	return tree
+}
+
+// leafOf returns the number of the leaf covering the key.
+func leafOf(key string) int {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(key))
+	return int(hash.Sum64() >> (64 - merkleDepth))
+}
+
+func itemHash(key string, value replicaValue) uint64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(key + encodeReplica(value)))
+	return hash.Sum64()
+}
+
+func combine(left, right uint64) uint64 {
+	var buffer [16]byte
+	binary.BigEndian.PutUint64(buffer[:8], left)
+	binary.BigEndian.PutUint64(buffer[8:], right)
+	hash := fnv.New64a()
+	_, _ = hash.Write(buffer[:])
+	return hash.Sum64()
+}
+
+// set records the value of the key, nil removes the key.
+func (tree *merkleTree) set(key string, value *replicaValue) {
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+	if tree.pending != nil {
+		tree.pending[key] = value
+	}
+	tree.setLocked(key, value)
+}
+
+func (tree *merkleTree) setLocked(key string, value *replicaValue) {
+	leaf := leafOf(key)
+	if value == nil {
+		delete(tree.items[leaf], key)
+	} else {
+		tree.items[leaf][key] = itemHash(key, *value)
+	}
+	// the leaf hash does not depend on the order of the keys
+	var hash uint64
+	for _, item := range tree.items[leaf] {
+		hash ^= item
+	}
+	node := merkleLeaves + leaf
+	tree.nodes[node] = hash
+	for node /= 2; node > 0; node /= 2 {
+		tree.nodes[node] = combine(tree.nodes[2*node], tree.nodes[2*node+1])
+	}
+}
+
+// hashes returns the hashes of the nodes, the caller checks that they exist.
+func (tree *merkleTree) hashes(nodes []int) []uint64 {
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+	hashes := make([]uint64, len(nodes))
+	for i, node := range nodes {
+		hashes[i] = tree.nodes[node]
+	}
+	return hashes
+}
+
+func (tree *merkleTree) keys(leaf int) []string {
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+	keys := make([]string, 0, len(tree.items[leaf]))
+	for key := range tree.items[leaf] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// rebuild reads all root keys into a new tree, so the tree also covers the keys written
+// around the quorum, like the ones of transactions. The changes made meanwhile are applied again.
+func (q *quorum) rebuild() error {
+	q.tree.mutex.Lock()
+	q.tree.pending = make(map[string]*replicaValue)
+	q.tree.mutex.Unlock()
+
+	fresh := newMerkleTree()
+	keys, err := q.ss.ScanIn("", "")
+	for _, key := range keys {
+		if err != nil {
+			break
+		}
+		var value replicaValue
+		var found bool
+		if value, found, err = q.load(q.ss, key); found {
+			fresh.setLocked(key, &value)
+		}
+	}
+
+	q.tree.mutex.Lock()
+	defer q.tree.mutex.Unlock()
+	pending := q.tree.pending
+	q.tree.pending = nil
+	if err != nil {
+		return err
+	}
+	q.tree.nodes, q.tree.items = fresh.nodes, fresh.items
+	for key, value := range pending {
+		q.tree.setLocked(key, value)
+	}
+	return nil
+}
+
+// syncReport tells what the comparison with a peer has found and fixed.
+type syncReport struct {
+	Peer string `json:"peer"`
+	// Ranges is the number of leaves whose hashes differ
+	Ranges int    `json:"differing_ranges"`
+	Pulled int    `json:"pulled"`
+	Pushed int    `json:"pushed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// repairAll rebuilds the tree and synchronizes it with every peer.
+func (q *quorum) repairAll() ([]syncReport, error) {
+	q.syncing.Lock()
+	defer q.syncing.Unlock()
+	if err := q.rebuild(); err != nil {
+		return nil, err
+	}
+	reports := make([]syncReport, len(q.peers))
+	for i, peer := range q.peers {
+		reports[i] = syncReport{Peer: peer}
+		if err := q.syncWith(peer, &reports[i]); err != nil {
+			reports[i].Error = err.Error()
+		}
+	}
+	return reports, nil
+}
+
+// syncWith walks down the trees of this node and the peer along the nodes whose hashes differ
+// and exchanges the keys of the differing leaves, the newer version of every key wins.
+func (q *quorum) syncWith(peer string, report *syncReport) error {
+	level := []int{1}
+	for len(level) > 0 {
+		remote, err := q.fetchHashes(peer, level)
+		if err != nil {
+			return err
+		}
+		local := q.tree.hashes(level)
+		var differing []int
+		for i, node := range level {
+			if local[i] != remote[i] {
+				differing = append(differing, node)
+			}
+		}
+		level = nil
+		for _, node := range differing {
+			if node < merkleLeaves {
+				level = append(level, 2*node, 2*node+1)
+				continue
+			}
+			report.Ranges++
+			if err := q.exchange(peer, node-merkleLeaves, report); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (q *quorum) exchange(peer string, leaf int, report *syncReport) error {
+	remote, err := q.fetchRange(peer, leaf)
+	if err != nil {
+		return err
+	}
+	for _, key := range q.tree.keys(leaf) {
+		local, found, err := q.load(q.ss, key)
+		if err != nil {
+			return err
+		}
+		if theirs, exists := remote[key]; !found || exists && !theirs.olderThan(local) {
+			continue
+		}
+		if err := q.send(peer, key, local); err != nil {
+			return err
+		}
+		report.Pushed++
+	}
+	for key, theirs := range remote {
+		local, found, err := q.load(q.ss, key)
+		if err != nil {
+			return err
+		}
+		if found && !local.olderThan(theirs) {
+			continue
+		}
+		if err := q.store(q.ss, key, theirs); err != nil {
+			return err
+		}
+		report.Pulled++
+	}
+	return nil
+}
+
+func (q *quorum) fetchHashes(peer string, nodes []int) ([]uint64, error) {
+	list := make([]string, len(nodes))
+	for i, node := range nodes {
+		list[i] = strconv.Itoa(node)
+	}
+	var body struct {
+		Hashes []uint64 `json:"hashes"`
+	}
+	if err := q.getJSON(peer+"/internal/merkle?"+url.Values{"nodes": {strings.Join(list, ",")}}.Encode(), &body); err != nil {
+		return nil, err
+	}
+	if len(body.Hashes) != len(nodes) {
+		return nil, fmt.Errorf("replica %s returned %d hashes for %d nodes", peer, len(body.Hashes), len(nodes))
+	}
+	return body.Hashes, nil
+}
+
+func (q *quorum) fetchRange(peer string, leaf int) (map[string]replicaValue, error) {
+	var body struct {
+		Keys map[string]replicaValue `json:"keys"`
+	}
+	if err := q.getJSON(peer+"/internal/merkle?leaf="+strconv.Itoa(leaf), &body); err != nil {
+		return nil, err
+	}
+	return body.Keys, nil
+}
+
+func (q *quorum) getJSON(address string, body any) error {
+	response, err := q.client.Get(address)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", address, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(body)
+}
+
+// start runs the anti-entropy loop until stop.
+func (q *quorum) start(interval time.Duration) {
+	q.running.Add(1)
+	go func() {
+		defer q.running.Done()
+		for {
+			select {
+			case <-q.done:
+				return
+			case <-time.After(interval):
+			}
+			reports, err := q.repairAll()
+			if err != nil {
+				log.Printf("Anti-entropy: %s", err)
+			}
+			for _, report := range reports {
+				if report.Error != "" {
+					log.Printf("Anti-entropy with %s: %s", report.Peer, report.Error)
+				} else if report.Ranges > 0 {
+					log.Printf("Anti-entropy with %s: %d ranges differed, pulled %d keys, pushed %d", report.Peer, report.Ranges, report.Pulled, report.Pushed)
+				}
+			}
+		}
+	}()
+}
+
+// stop ends the anti-entropy loop and waits for the running round.
+func (q *quorum) stop() {
+	q.stopOnce.Do(func() {
+		close(q.done)
+		q.running.Wait()
+	})
+}
+
+// handleMerkle serves GET /internal/merkle. With ?nodes=1,2,3 it returns the hashes of the tree nodes,
+// with ?leaf= it returns the keys of the leaf range with their values and versions.
+func handleMerkle(w http.ResponseWriter, r *http.Request, ss *safestorage.SafeStorage, q *quorum) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	if query.Has("leaf") {
+		leaf, err := strconv.Atoi(query.Get("leaf"))
+		if err != nil || leaf < 0 || leaf >= merkleLeaves {
+			http.Error(w, "Invalid leaf", http.StatusBadRequest)
+			return
+		}
+		keys := make(map[string]replicaValue)
+		for _, key := range q.tree.keys(leaf) {
+			value, found, err := q.load(ss, key)
+			if storageGaveUp(w, err) {
+				return
+			}
+			if err != nil {
+				http.Error(w, "Cannot read value", http.StatusInternalServerError)
+				return
+			}
+			if found {
+				keys[key] = value
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+		return
+	}
+	var nodes []int
+	for _, text := range strings.Split(cmp.Or(query.Get("nodes"), "1"), ",") {
+		node, err := strconv.Atoi(text)
+		if err != nil || node < 1 || node >= 2*merkleLeaves {
+			http.Error(w, "Invalid node "+text, http.StatusBadRequest)
+			return
+		}
+		nodes = append(nodes, node)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"hashes": q.tree.hashes(nodes)})
+}
+
+// handleRepair serves POST /admin/repair, a full synchronization with all peers.
+func handleRepair(w http.ResponseWriter, r *http.Request, q *quorum) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reports, err := q.repairAll()
+	if err != nil {
+		http.Error(w, "Cannot read the keys: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"peers": reports})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestMerkleTree(t *testing.T) {
+	first, second := newMerkleTree(), newMerkleTree()
+	if first.hashes([]int{1})[0] != second.hashes([]int{1})[0] {
+		t.Fatal("Empty trees differ")
+	}
+	values := make([]replicaValue, 50)
+	for i := range values {
+		values[i] = replicaValue{Value: fmt.Sprintf("value-%d", i), Version: uint64(i + 1)}
+		first.set(fmt.Sprintf("key-%d", i), &values[i])
+	}
+	for i := len(values) - 1; i >= 0; i-- {
+		second.set(fmt.Sprintf("key-%d", i), &values[i])
+	}
+	if first.hashes([]int{1})[0] != second.hashes([]int{1})[0] {
+		t.Error("Trees with the same keys differ")
+	}
+
+	newer := replicaValue{Value: "value-7", Version: 100}
+	second.set("key-7", &newer)
+	leaf := merkleLeaves + leafOf("key-7")
+	if first.hashes([]int{leaf})[0] == second.hashes([]int{leaf})[0] {
+		t.Error("A newer version did not change the leaf")
+	}
+	sibling := leaf ^ 1
+	if first.hashes([]int{sibling})[0] != second.hashes([]int{sibling})[0] {
+		t.Error("A change of one leaf changed another")
+	}
+	second.set("key-7", &values[7])
+	second.set("extra", &newer)
+	second.set("extra", nil)
+	if first.hashes([]int{1})[0] != second.hashes([]int{1})[0] {
+		t.Error("Trees differ after the changes were undone")
+	}
+}
+
+func TestAntiEntropy(t *testing.T) {
+	servers, outages, admins := startCluster(t, 3, 2, 2)
+	repair := func(server int) []syncReport {
+		status, body := adminRequest(t, http.MethodPost, admins[server].URL+"/admin/repair")
+		if status != http.StatusOK {
+			t.Fatalf("Repair answered %d: %s", status, body)
+		}
+		var response struct {
+			Peers []syncReport `json:"peers"`
+		}
+		if err := json.Unmarshal([]byte(body), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Peers
+	}
+
+	outages[2].down.Store(true)
+	for i := range 20 {
+		if status, _ := request(t, http.MethodPost, servers[0].URL+fmt.Sprintf("/db/key-%d", i), `{"value": "v"}`); status != http.StatusOK {
+			t.Fatalf("Write answered %d", status)
+		}
+	}
+	outages[2].down.Store(false)
+	// a key that only node 2 has, written to it directly
+	only, _ := json.Marshal(replicaValue{Value: "local", Version: 1})
+	request(t, http.MethodPut, servers[2].URL+"/internal/replica/only", string(only))
+
+	for _, report := range repair(2) {
+		if report.Error != "" {
+			t.Errorf("Sync with %s failed: %s", report.Peer, report.Error)
+		}
+		if report.Ranges == 0 || report.Pushed != 1 {
+			t.Errorf("Unexpected report %+v", report)
+		}
+	}
+	for i := range 20 {
+		if value := replicaOf(t, servers[2], fmt.Sprintf("key-%d", i)); value.Value != "v" {
+			t.Errorf("key-%d was not pulled, node 2 has %+v", i, value)
+		}
+	}
+	for _, server := range servers[:2] {
+		if value := replicaOf(t, server, "only"); value.Value != "local" {
+			t.Errorf("The key of node 2 was not pushed, %s has %+v", server.URL, value)
+		}
+	}
+
+	for _, report := range repair(0) {
+		if report.Ranges != 0 || report.Pulled != 0 || report.Pushed != 0 {
+			t.Errorf("Synchronized replicas still differ: %+v", report)
+		}
+	}
+	status, body := request(t, http.MethodGet, servers[0].URL+"/internal/merkle?nodes=1,2047", "")
+	var hashes struct {
+		Hashes []uint64 `json:"hashes"`
+	}
+	if _ = json.Unmarshal([]byte(body), &hashes); status != http.StatusOK || len(hashes.Hashes) != 2 {
+		t.Errorf("Unexpected hashes %d %s", status, body)
+	}
+	if status, _ := request(t, http.MethodGet, servers[0].URL+"/internal/merkle?nodes=2048", ""); status != http.StatusBadRequest {
+		t.Errorf("A node outside the tree answered %d", status)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+// latencyBuckets are the upper bounds of the request duration histogram in seconds.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type series struct {
+	method string
+	status int
+}
+
+type histogram struct {
+	// counts[i] is the number of observations in the bucket i, the last one has no upper bound
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// requestMetrics counts the HTTP requests and their durations by method and status.
+type requestMetrics struct {
+	mutex  sync.Mutex
+	series map[series]*histogram
+}
+
+// requests are the metrics of all requests served by the process.
+var requests = &requestMetrics{series: make(map[series]*histogram)}
+
+func (metrics *requestMetrics) observe(method string, status int, duration time.Duration) {
+	seconds := duration.Seconds()
+	bucket, _ := slices.BinarySearch(latencyBuckets, seconds)
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	key := series{method, status}
+	observed := metrics.series[key]
+	if observed == nil {
+		observed = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		metrics.series[key] = observed
+	}
+	observed.counts[bucket]++
+	observed.sum += seconds
+	observed.count++
+}
+
+// observedSeries is a copy of the histogram of a series.
+type observedSeries struct {
+	series
+	histogram
+}
+
+// snapshot copies the series sorted by method and status, so a slow scraper
+// does not hold the lock that every request takes.
+func (metrics *requestMetrics) snapshot() []observedSeries {
+	metrics.mutex.Lock()
+	observed := make([]observedSeries, 0, len(metrics.series))
+	for key, histogram := range metrics.series {
+		copied := *histogram
+		copied.counts = slices.Clone(histogram.counts)
+		observed = append(observed, observedSeries{key, copied})
+	}
+	metrics.mutex.Unlock()
+	slices.SortFunc(observed, func(a, b observedSeries) int {
+		return cmp.Or(strings.Compare(a.method, b.method), cmp.Compare(a.status, b.status))
+	})
+	return observed
+}
+
+// statusRecorder remembers the status the handler has answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(data)
+}
+
+// Unwrap lets http.ResponseController flush the watch streams.
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// instrument records every request handled by next in requests.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		requests.observe(r.Method, recorder.status, time.Since(start))
+	})
+}
+
+// handleMetrics writes the metrics in the Prometheus text exposition format.
+func handleMetrics(w http.ResponseWriter, r *http.Request, ss *safestorage.SafeStorage) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	observed := requests.snapshot()
+	describe(out, "db_http_requests_total", "counter", "HTTP requests by method and status.")
+	for _, item := range observed {
+		fmt.Fprintf(out, "db_http_requests_total{method=%q,status=\"%d\"} %d\n", item.method, item.status, item.count)
+	}
+	describe(out, "db_http_request_duration_seconds", "histogram", "Duration of the HTTP requests by method and status.")
+	for _, item := range observed {
+		labels := fmt.Sprintf("method=%q,status=\"%d\"", item.method, item.status)
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += item.counts[i]
+			fmt.Fprintf(out, "db_http_request_duration_seconds_bucket{%s,le=%q} %d\n", labels, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(out, "db_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, item.count)
+		fmt.Fprintf(out, "db_http_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(item.sum))
+		fmt.Fprintf(out, "db_http_request_duration_seconds_count{%s} %d\n", labels, item.count)
+	}
+
+	describe(out, "db_queue_depth", "gauge", "Commands waiting for the storage worker of the shard.")
+	for shard, depth := range ss.QueueDepth() {
+		fmt.Fprintf(out, "db_queue_depth{shard=\"%d\"} %d\n", shard, depth)
+	}
+
+	ss, cancel := scoped(r, ss)
+	defer cancel()
+	var lines [5][]string
+	for shard := range ss.Shards() {
+		// the memory engine has no segments to report
+		stats, err := ss.Stats(shard)
+		if err != nil {
+			continue
+		}
+		label := fmt.Sprintf("{shard=\"%d\"}", shard)
+		for i, line := range []string{
+			fmt.Sprintf("db_size_bytes%s %d", label, stats.Size),
+			fmt.Sprintf("db_segments%s %d", label, stats.Segments),
+			fmt.Sprintf("db_live_keys%s %d", label, stats.Keys),
+			fmt.Sprintf("db_merges_total%s %d", label, stats.Merges),
+			fmt.Sprintf("db_merge_duration_seconds_sum%s %s\ndb_merge_duration_seconds_count%s %d", label, formatFloat(stats.MergeDuration.Seconds()), label, stats.Merges),
+		} {
+			lines[i] = append(lines[i], line)
+		}
+	}
+	for i, metric := range []struct{ name, kind, help string }{
+		{"db_size_bytes", "gauge", "Total size of the segments of the shard."},
+		{"db_segments", "gauge", "Segment files of the shard."},
+		{"db_live_keys", "gauge", "Keys of the shard that are neither deleted nor expired."},
+		{"db_merges_total", "counter", "Completed merges of the shard segments."},
+		{"db_merge_duration_seconds", "summary", "Time spent merging the shard segments."},
+	} {
+		if len(lines[i]) == 0 {
+			continue
+		}
+		describe(out, metric.name, metric.kind, metric.help)
+		for _, line := range lines[i] {
+			fmt.Fprintln(out, line)
+		}
+	}
+}
+
+func describe(out *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+func TestMetrics(t *testing.T) {
+	db, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := safestorage.InitSharded([]safestorage.Storage{db, datastore.NewMemory()})
+	server := httptest.NewServer(instrument(routes(ss, nil, nil)))
+	t.Cleanup(func() {
+		server.Close()
+		_ = ss.Close()
+	})
+
+	request(t, http.MethodPost, server.URL+"/db/key", `{"value": "v"}`)
+	request(t, http.MethodGet, server.URL+"/db/missing", "")
+	status, body := request(t, http.MethodGet, server.URL+"/metrics", "")
+	if status != http.StatusOK {
+		t.Fatalf("Metrics answered %d", status)
+	}
+	for _, line := range []string{
+		"# TYPE db_http_requests_total counter",
+		`db_http_request_duration_seconds_bucket{method="GET",status="404",le="+Inf"} `,
+		`db_http_request_duration_seconds_count{method="POST",status="200"} `,
+		`db_queue_depth{shard="1"} 0`,
+		`db_segments{shard="0"} 1`,
+		`db_merges_total{shard="0"} 0`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Metrics have no %q:\n%s", line, body)
+		}
+	}
+	// the memory shard has no segments
+	if strings.Contains(body, `db_size_bytes{shard="1"}`) {
+		t.Errorf("Memory shard reported its size:\n%s", body)
+	}
+	keys := `db_live_keys{shard="0"} 1`
+	if safestorage.ShardOf("key", 2) == 1 {
+		keys = `db_live_keys{shard="0"} 0`
+	}
+	if !strings.Contains(body, keys) {
+		t.Errorf("Metrics have no %q:\n%s", keys, body)
+	}
+}
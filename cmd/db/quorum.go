@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+var (
+	peerList       = flag.String("peers", "", "comma separated addresses of the other replicas, like http://db2:8091,http://db3:8091, enables quorum replication of root keys")
+	writeQuorum    = flag.Int("write-quorum", 2, "W, the number of replicas that must store a write before it is acknowledged")
+	readQuorum     = flag.Int("read-quorum", 2, "R, the number of replicas that must answer a read")
+	replicaTimeout = flag.Duration("replica-timeout", 2*time.Second, "how long a replica may take to answer the coordinator")
+)
+
+var errNotNewer = errors.New("replica already has a newer value")
+
+// quorumError reports a read or write that did not get enough answers.
+type quorumError struct {
+	answered, required int
+}
+
+func (err quorumError) Error() string {
+	return fmt.Sprintf("only %d of the required %d replicas answered", err.answered, err.required)
+}
+
+// replicaValue is a value with the version the coordinator of its write has given it.
+// Versions come from the hybrid clocks of the nodes, the newest version wins.
+// A delete is a Deleted value, the tombstone, so read repair does not bring the key back.
+type replicaValue struct {
+	Value   string `json:"value"`
+	Version uint64 `json:"version"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// olderThan orders the values by version, equal versions written by different
+// coordinators are ordered by the value with a tombstone last, so all replicas pick the same one.
+func (value replicaValue) olderThan(other replicaValue) bool {
+	if value.Version != other.Version {
+		return value.Version < other.Version
+	}
+	if value.Deleted != other.Deleted {
+		return other.Deleted
+	}
+	return value.Value < other.Value
+}
+
+// Replicated values are stored in the root keys with their version in front:
+// a zero byte, the decimal version and another zero byte. A tombstone ends
+// with the byte 1 instead of the second zero byte and has no value.
+func encodeReplica(value replicaValue) string {
+	if value.Deleted {
+		return "\x00" + strconv.FormatUint(value.Version, 10) + "\x01"
+	}
+	return "\x00" + strconv.FormatUint(value.Version, 10) + "\x00" + value.Value
+}
+
+// decodeReplica reads a stored value, the ones written without replication have version 0.
+func decodeReplica(raw string) replicaValue {
+	if header, found := strings.CutPrefix(raw, "\x00"); found {
+		end := strings.IndexAny(header, "\x00\x01")
+		if version, err := strconv.ParseUint(header[:max(end, 0)], 10, 64); end >= 0 && err == nil {
+			if header[end] == 1 && end == len(header)-1 {
+				return replicaValue{Version: version, Deleted: true}
+			}
+			if header[end] == 0 {
+				return replicaValue{Value: header[end+1:], Version: version}
+			}
+		}
+	}
+	return replicaValue{Value: raw}
+}
+
+// clock is a hybrid logical clock: it follows the wall time,
+// but never goes back and stays ahead of every version it has seen.
+type clock struct {
+	mutex sync.Mutex
+	last  uint64
+}
+
+func (c *clock) next() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.last = max(c.last+1, uint64(time.Now().UnixNano()))
+	return c.last
+}
+
+func (c *clock) observe(version uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.last = max(c.last, version)
+}
+
+// quorum coordinates the reads and writes of root keys over this node and its peers.
+// A write is acknowledged after W of the N nodes have stored it, a read waits for R answers,
+// returns the newest value and repairs the replicas that answered with older ones.
+type quorum struct {
+	ss     *safestorage.SafeStorage
+	peers  []string
+	writes int
+	reads  int
+	client *http.Client
+	clock  clock
+	tree   *merkleTree
+
+	// syncing serializes the anti-entropy rounds
+	syncing  sync.Mutex
+	done     chan struct{}
+	running  sync.WaitGroup
+	stopOnce sync.Once
+}
+
+func newQuorum(ss *safestorage.SafeStorage, peers []string, writes, reads int) (*quorum, error) {
+	nodes := len(peers) + 1
+	if writes < 1 || writes > nodes || reads < 1 || reads > nodes {
+		return nil, fmt.Errorf("quorums must be between 1 and %d nodes, got W=%d and R=%d", nodes, writes, reads)
+	}
+	if writes+reads <= nodes {
+		log.Printf("W=%d and R=%d do not overlap on %d nodes, reads may miss acknowledged writes", writes, reads, nodes)
+	}
+	q := &quorum{
+		ss:     ss,
+		peers:  peers,
+		writes: writes,
+		reads:  reads,
+		client: &http.Client{Timeout: *replicaTimeout, Transport: peerTransport{http.DefaultTransport}},
+		tree:   newMerkleTree(),
+		done:   make(chan struct{}),
+	}
+	if err := q.rebuild(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// store writes the value unless the replica already has the same or a newer one.
+func (q *quorum) store(ss *safestorage.SafeStorage, key string, value replicaValue) error {
+	q.clock.observe(value.Version)
+	for {
+		err := ss.Update(func(tx *datastore.Tx) error {
+			raw, err := tx.Get(key)
+			if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+				return err
+			}
+			if err == nil && !decodeReplica(raw).olderThan(value) {
+				return errNotNewer
+			}
+			tx.Put(key, encodeReplica(value))
+			return nil
+		})
+		switch {
+		case errors.Is(err, datastore.ErrConflict):
+			continue
+		case errors.Is(err, errNotNewer):
+			return nil
+		case err == nil:
+			q.tree.set(key, &value)
+		}
+		return err
+	}
+}
+
+// load reads the local replica, found is false for a missing key.
+func (q *quorum) load(ss *safestorage.SafeStorage, key string) (replicaValue, bool, error) {
+	raw, err := ss.Get(key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return replicaValue{}, false, nil
+	}
+	if err != nil {
+		return replicaValue{}, false, err
+	}
+	value := decodeReplica(raw)
+	q.clock.observe(value.Version)
+	return value, true, nil
+}
+
+func (q *quorum) send(peer, key string, value replicaValue) error {
+	body, _ := json.Marshal(value)
+	request, err := http.NewRequest(http.MethodPut, peer+"/internal/replica/"+url.PathEscape(key), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response, err := q.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, response.Body)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("replica %s answered %s", peer, response.Status)
+	}
+	return nil
+}
+
+func (q *quorum) fetch(peer, key string) (replicaValue, bool, error) {
+	response, err := q.client.Get(peer + "/internal/replica/" + url.PathEscape(key))
+	if err != nil {
+		return replicaValue{}, false, err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+		var value replicaValue
+		if err := json.NewDecoder(response.Body).Decode(&value); err != nil {
+			return replicaValue{}, false, err
+		}
+		q.clock.observe(value.Version)
+		return value, true, nil
+	case http.StatusNotFound:
+		return replicaValue{}, false, nil
+	default:
+		return replicaValue{}, false, fmt.Errorf("replica %s answered %s", peer, response.Status)
+	}
+}
+
+// write stores the value or the tombstone with a new version on W nodes. The nodes that
+// have not answered yet keep receiving the write after the coordinator has answered the client,
+// so the local write does not use the storage bound to the request.
+func (q *quorum) write(ctx context.Context, key string, value replicaValue) (replicaValue, error) {
+	value.Version = q.clock.next()
+	results := make(chan error, len(q.peers)+1)
+	go func() {
+		results <- q.store(q.ss, key, value)
+	}()
+	for _, peer := range q.peers {
+		go func() {
+			results <- q.send(peer, key, value)
+		}()
+	}
+	acknowledged, failed := 0, 0
+	for range len(q.peers) + 1 {
+		var err error
+		select {
+		case err = <-results:
+		case <-ctx.Done():
+			return value, ctx.Err()
+		}
+		if err != nil {
+			failed++
+			log.Printf("Replicated write of %s: %s", key, err)
+		} else {
+			acknowledged++
+		}
+		if acknowledged == q.writes {
+			return value, nil
+		}
+		if failed > len(q.peers)+1-q.writes {
+			break
+		}
+	}
+	return value, quorumError{acknowledged, q.writes}
+}
+
+// replicaAnswer is the answer of a node to a read, peer is empty for this node.
+type replicaAnswer struct {
+	peer  string
+	value replicaValue
+	found bool
+	err   error
+}
+
+// read returns the newest of the values of R nodes, found is false if none of them has the key
+// or the newest is a tombstone. The replicas with older values, including the ones that answer
+// after R others, are repaired.
+func (q *quorum) read(ctx context.Context, ss *safestorage.SafeStorage, key string) (replicaValue, bool, error) {
+	answers := make(chan replicaAnswer, len(q.peers)+1)
+	go func() {
+		value, found, err := q.load(ss, key)
+		answers <- replicaAnswer{"", value, found, err}
+	}()
+	for _, peer := range q.peers {
+		go func() {
+			value, found, err := q.fetch(peer, key)
+			answers <- replicaAnswer{peer, value, found, err}
+		}()
+	}
+
+	var collected []replicaAnswer
+	answered, failed := 0, 0
+	for answered < q.reads && failed <= len(q.peers)+1-q.reads {
+		var answer replicaAnswer
+		select {
+		case answer = <-answers:
+		case <-ctx.Done():
+			return replicaValue{}, false, ctx.Err()
+		}
+		if answer.err != nil {
+			failed++
+			log.Printf("Replicated read of %s: %s", key, answer.err)
+			continue
+		}
+		answered++
+		collected = append(collected, answer)
+	}
+	if answered < q.reads {
+		go q.repair(key, collected, answers, len(q.peers)+1-answered-failed)
+		return replicaValue{}, false, quorumError{answered, q.reads}
+	}
+	newest, found := newestOf(collected)
+	go q.repair(key, collected, answers, len(q.peers)+1-answered-failed)
+	return newest, found && !newest.Deleted, nil
+}
+
+// remove writes a tombstone of the key, found is false if the key did not exist on R nodes.
+// Tombstones are kept, a replica that missed the delete is repaired like after a missed put.
+func (q *quorum) remove(ctx context.Context, ss *safestorage.SafeStorage, key string) (bool, error) {
+	if _, found, err := q.read(ctx, ss, key); err != nil || !found {
+		return found, err
+	}
+	_, err := q.write(ctx, key, replicaValue{Deleted: true})
+	return true, err
+}
+
+func newestOf(answers []replicaAnswer) (replicaValue, bool) {
+	var newest replicaValue
+	found := false
+	for _, answer := range answers {
+		if answer.found && (!found || newest.olderThan(answer.value)) {
+			newest, found = answer.value, true
+		}
+	}
+	return newest, found
+}
+
+// repair waits for the remaining answers and writes the newest value to the replicas that
+// answered with an older one or without any. It runs after the client has got its answer.
+func (q *quorum) repair(key string, answers []replicaAnswer, late <-chan replicaAnswer, remaining int) {
+	for range remaining {
+		if answer := <-late; answer.err == nil {
+			answers = append(answers, answer)
+		}
+	}
+	newest, found := newestOf(answers)
+	if !found {
+		return
+	}
+	for _, answer := range answers {
+		if answer.found && !answer.value.olderThan(newest) {
+			continue
+		}
+		var err error
+		if answer.peer == "" {
+			err = q.store(q.ss, key, newest)
+		} else {
+			err = q.send(answer.peer, key, newest)
+		}
+		if err != nil {
+			log.Printf("Read repair of %s: %s", key, err)
+		}
+	}
+}
+
+// unreplicated answers 501 on a replicated node to the routes that would only change
+// or read the local storage and bypass the quorums.
+func unreplicated(w http.ResponseWriter, q *quorum, what string) bool {
+	if q == nil {
+		return false
+	}
+	http.Error(w, what+" are not replicated", http.StatusNotImplemented)
+	return true
+}
+
+// handleQuorum serves GET, POST and DELETE /db/{key} of a replicated node.
+func handleQuorum(w http.ResponseWriter, r *http.Request, ss *safestorage.SafeStorage, q *quorum, key string) {
+	ctx, cancel := context.WithTimeout(r.Context(), *requestTimeout)
+	defer cancel()
+	switch r.Method {
+	case http.MethodGet:
+		value, found, err := q.read(ctx, ss, key)
+		if storageGaveUp(w, err) {
+			return
+		}
+		var missing quorumError
+		if errors.As(err, &missing) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Cannot read value", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"key":     key,
+			"value":   value.Value,
+			"version": value.Version,
+		})
+	case http.MethodPost:
+		var body struct {
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		_, err := q.write(ctx, key, replicaValue{Value: body.Value})
+		if storageGaveUp(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		found, err := q.remove(ctx, ss, key)
+		if storageGaveUp(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if !found {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleReplica serves /internal/replica/{key}, the coordinators read the local value
+// with GET and store a newer one with PUT.
+func handleReplica(w http.ResponseWriter, r *http.Request, ss *safestorage.SafeStorage, q *quorum, key string) {
+	switch r.Method {
+	case http.MethodGet:
+		value, found, err := q.load(ss, key)
+		if storageGaveUp(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Cannot read value", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(value)
+	case http.MethodPut:
+		var value replicaValue
+		if err := json.NewDecoder(r.Body).Decode(&value); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := q.store(ss, key, value); err != nil {
+			if storageGaveUp(w, err) {
+				return
+			}
+			http.Error(w, "Cannot store value", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parsePeers splits the peer list, an empty list disables the quorum replication.
+func parsePeers(list string) []string {
+	var peers []string
+	for _, peer := range strings.Split(list, ",") {
+		if peer = strings.TrimSuffix(strings.TrimSpace(peer), "/"); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
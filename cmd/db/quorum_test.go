@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+// outage answers 503 to everything while the node is down.
+type outage struct {
+	down    atomic.Bool
+	handler http.Handler
+}
+
+func (o *outage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if o.down.Load() {
+		http.Error(w, "Node is down", http.StatusServiceUnavailable)
+		return
+	}
+	o.handler.ServeHTTP(w, r)
+}
+
+// startCluster runs count in-process nodes that replicate to each other with the quorums,
+// it returns their data ports, their switches and their admin ports.
+func startCluster(t *testing.T, count, writes, reads int) ([]*httptest.Server, []*outage, []*httptest.Server) {
+	t.Helper()
+	servers := make([]*httptest.Server, count)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+	}
+	outages := make([]*outage, count)
+	admins := make([]*httptest.Server, count)
+	for i, server := range servers {
+		var peers []string
+		for j, peer := range servers {
+			if j != i {
+				peers = append(peers, "http://"+peer.Listener.Addr().String())
+			}
+		}
+		ss := safestorage.Init(datastore.NewMemory())
+		cluster, err := newQuorum(ss, peers, writes, reads)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outages[i] = &outage{handler: routes(ss, nil, cluster)}
+		server.Config.Handler = outages[i]
+		server.Start()
+		admins[i] = httptest.NewServer(adminRoutes(ss, nil, cluster, testAdminToken))
+		t.Cleanup(func() {
+			server.Close()
+			admins[i].Close()
+			_ = ss.Close()
+		})
+	}
+	return servers, outages, admins
+}
+
+func replicaOf(t *testing.T, server *httptest.Server, key string) replicaValue {
+	t.Helper()
+	var value replicaValue
+	if status, body := request(t, http.MethodGet, server.URL+"/internal/replica/"+key, ""); status == http.StatusOK {
+		_ = json.Unmarshal([]byte(body), &value)
+	}
+	return value
+}
+
+func TestQuorum(t *testing.T) {
+	servers, outages, _ := startCluster(t, 3, 2, 2)
+	write := func(server *httptest.Server, key, value string) int {
+		status, _ := request(t, http.MethodPost, server.URL+"/db/"+key, `{"value": "`+value+`"}`)
+		return status
+	}
+	read := func(server *httptest.Server, key string) string {
+		_, body := request(t, http.MethodGet, server.URL+"/db/"+key, "")
+		var response struct {
+			Value string `json:"value"`
+		}
+		_ = json.Unmarshal([]byte(body), &response)
+		return response.Value
+	}
+
+	if status := write(servers[0], "key", "v1"); status != http.StatusOK {
+		t.Fatalf("Write answered %d", status)
+	}
+	for i, server := range servers[1:] {
+		if value := read(server, "key"); value != "v1" {
+			t.Errorf("Node %d read %q", i+1, value)
+		}
+	}
+	if status, _ := request(t, http.MethodGet, servers[1].URL+"/db/missing", ""); status != http.StatusNotFound {
+		t.Errorf("Missing key answered %d", status)
+	}
+
+	t.Run("write quorum", func(t *testing.T) {
+		outages[2].down.Store(true)
+		if status := write(servers[0], "key", "v2"); status != http.StatusOK {
+			t.Errorf("Write with 2 of 3 nodes answered %d", status)
+		}
+		outages[1].down.Store(true)
+		if status := write(servers[0], "other", "lost"); status != http.StatusServiceUnavailable {
+			t.Errorf("Write with 1 of 3 nodes answered %d", status)
+		}
+		if status, _ := request(t, http.MethodGet, servers[0].URL+"/db/key", ""); status != http.StatusServiceUnavailable {
+			t.Errorf("Read with 1 of 3 nodes answered %d", status)
+		}
+		outages[1].down.Store(false)
+		outages[2].down.Store(false)
+	})
+
+	t.Run("read repair", func(t *testing.T) {
+		if stale := replicaOf(t, servers[2], "key"); stale.Value != "v1" {
+			t.Fatalf("Node 2 was expected to miss the write, it has %+v", stale)
+		}
+		if value := read(servers[2], "key"); value != "v2" {
+			t.Errorf("Read through the stale node returned %q", value)
+		}
+		eventually(t, "the stale node to be repaired", func() bool {
+			return replicaOf(t, servers[2], "key").Value == "v2"
+		})
+	})
+
+	t.Run("versions", func(t *testing.T) {
+		current := replicaOf(t, servers[0], "key")
+		older, _ := json.Marshal(replicaValue{Value: "older", Version: current.Version - 1})
+		if status, _ := request(t, http.MethodPut, servers[0].URL+"/internal/replica/key", string(older)); status != http.StatusOK {
+			t.Fatalf("Replica write answered %d", status)
+		}
+		if value := replicaOf(t, servers[0], "key"); value != current {
+			t.Errorf("Older version replaced %+v with %+v", current, value)
+		}
+		if status := write(servers[1], "key", "v3"); status != http.StatusOK {
+			t.Fatalf("Write answered %d", status)
+		}
+		if newer := replicaOf(t, servers[1], "key"); newer.Version <= current.Version {
+			t.Errorf("New write got version %d after %d", newer.Version, current.Version)
+		}
+		if value := read(servers[0], "key"); value != "v3" {
+			t.Errorf("Read returned %q after the newer write", value)
+		}
+	})
+
+	t.Run("local routes", func(t *testing.T) {
+		for _, route := range []struct{ method, path, body string }{
+			{http.MethodPost, "/db/_txn", `{"writes": [{"key": "key", "value": "local"}]}`},
+			{http.MethodGet, "/db/_index/city/Kyiv", ""},
+			{http.MethodGet, "/db/_watch", ""},
+			{http.MethodPost, "/db/bucket/key", `{"value": "local"}`},
+			{http.MethodGet, "/db/bucket/key", ""},
+		} {
+			if status, _ := request(t, route.method, servers[0].URL+route.path, route.body); status != http.StatusNotImplemented {
+				t.Errorf("%s %s answered %d on a replicated node", route.method, route.path, status)
+			}
+		}
+		if value := read(servers[0], "key"); value != "v3" {
+			t.Errorf("Local routes changed the value to %q", value)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if status := write(servers[0], "gone", "v"); status != http.StatusOK {
+			t.Fatalf("Write answered %d", status)
+		}
+		eventually(t, "the write to reach all nodes", func() bool {
+			return replicaOf(t, servers[2], "gone").Value == "v"
+		})
+		outages[2].down.Store(true)
+		if status, _ := request(t, http.MethodDelete, servers[0].URL+"/db/gone", ""); status != http.StatusNoContent {
+			t.Fatalf("Delete answered %d", status)
+		}
+		outages[2].down.Store(false)
+		// the stale node still has the value, the newer tombstone wins and repairs it
+		if status, _ := request(t, http.MethodGet, servers[2].URL+"/db/gone", ""); status != http.StatusNotFound {
+			t.Errorf("Deleted key answered %d through the stale node", status)
+		}
+		eventually(t, "the tombstone to reach the stale node", func() bool {
+			return replicaOf(t, servers[2], "gone").Deleted
+		})
+		if status, _ := request(t, http.MethodDelete, servers[1].URL+"/db/gone", ""); status != http.StatusNotFound {
+			t.Errorf("Second delete answered %d", status)
+		}
+		if status := write(servers[1], "gone", "back"); status != http.StatusOK || read(servers[2], "gone") != "back" {
+			t.Errorf("Write after the delete answered %d", status)
+		}
+	})
+}
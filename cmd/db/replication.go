@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+var (
+	leaderAddress       = flag.String("leader", "", "address of the leader to follow, like http://db-leader:8091, a node without it is the leader")
+	replicationInterval = flag.Duration("replication-interval", time.Second, "how often a follower that has caught up asks the leader for new records")
+)
+
+const (
+	positionsFile = "replication.json"
+	// logChunk is the number of log bytes a follower asks for at once
+	logChunk      = 1 << 20
+	logNextHeader = "Log-Next"
+	logEndHeader  = "Log-End"
+)
+
+// follower pulls the segment log of every shard from the leader and applies it to the local shard.
+// The positions are saved after every applied chunk, so a restarted follower continues where it stopped.
+// Applying a chunk again after a crash is harmless, the records only repeat the same writes.
+type follower struct {
+	leader   string
+	client   *http.Client
+	ss       *safestorage.SafeStorage
+	path     string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	running  sync.WaitGroup
+	stopOnce sync.Once
+
+	mutex     sync.Mutex
+	shards    []shardReplica
+	following bool
+}
+
+type shardReplica struct {
+	position  datastore.LogPosition
+	leaderEnd datastore.LogPosition
+	// caughtUp is the last time the shard had all the records of the leader
+	caughtUp time.Time
+	// synced is false until the shard catches up after the start or after it is copied again,
+	// the node is not ready meanwhile
+	synced bool
+	err    error
+}
+
+// follow starts the replication of all shards from the leader.
+func follow(leader string, ss *safestorage.SafeStorage, directory string) (*follower, error) {
+	replica := &follower{
+		leader:    leader,
+		client:    &http.Client{Timeout: 30 * time.Second, Transport: peerTransport{http.DefaultTransport}},
+		ss:        ss,
+		path:      filepath.Join(directory, positionsFile),
+		shards:    make([]shardReplica, ss.Shards()),
+		following: true,
+	}
+	positions, err := loadPositions(replica.path, ss.Shards())
+	if err != nil {
+		return nil, err
+	}
+	for shard, position := range positions {
+		replica.shards[shard] = shardReplica{position: position, caughtUp: time.Now()}
+	}
+	replica.ctx, replica.cancel = context.WithCancel(context.Background())
+	for shard := range replica.shards {
+		replica.running.Add(1)
+		go replica.run(shard)
+	}
+	return replica, nil
+}
+
+func loadPositions(path string, shards int) ([]datastore.LogPosition, error) {
+	positions := make([]datastore.LogPosition, shards)
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return positions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &positions); err != nil {
+		return nil, err
+	}
+	if len(positions) != shards {
+		return nil, fmt.Errorf("%s has %d positions for %d shards", path, len(positions), shards)
+	}
+	return positions, nil
+}
+
+// savePositions writes the positions with the mutex held, through a temporary file,
+// so a crash never leaves a half written file.
+func (replica *follower) savePositions() error {
+	positions := make([]datastore.LogPosition, len(replica.shards))
+	for shard, state := range replica.shards {
+		positions[shard] = state.position
+	}
+	raw, err := json.Marshal(positions)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(replica.path), 0o700); err != nil {
+		return err
+	}
+	temporary := replica.path + ".new"
+	if err := os.WriteFile(temporary, raw, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, replica.path)
+}
+
+func (replica *follower) run(shard int) {
+	defer replica.running.Done()
+	for {
+		caughtUp, err := replica.step(shard)
+		if err != nil && replica.ctx.Err() == nil {
+			log.Printf("Replication of shard %d: %s", shard, err)
+		}
+		wait := time.Duration(0)
+		if caughtUp || err != nil {
+			wait = *replicationInterval
+		}
+		select {
+		case <-replica.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// step applies the next chunk of the leader log and reports whether the shard has caught up.
+func (replica *follower) step(shard int) (bool, error) {
+	replica.mutex.Lock()
+	position, leaderEnd := replica.shards[shard].position, replica.shards[shard].leaderEnd
+	replica.mutex.Unlock()
+
+	query := url.Values{
+		"shard":   {strconv.Itoa(shard)},
+		"segment": {strconv.Itoa(position.Segment)},
+		"offset":  {strconv.FormatInt(position.Offset, 10)},
+	}
+	request, err := http.NewRequestWithContext(replica.ctx, http.MethodGet, replica.leader+"/internal/log?"+query.Encode(), nil)
+	if err != nil {
+		return false, replica.failed(shard, err)
+	}
+	response, err := replica.client.Do(request)
+	if err != nil {
+		return false, replica.failed(shard, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusGone {
+		// the leader has merged the segments, the merged ones have all the live records
+		log.Printf("Position %v of shard %d is gone on the leader, copying the shard again", position, shard)
+		replica.mutex.Lock()
+		replica.shards[shard].synced = false
+		replica.mutex.Unlock()
+		if err := replica.ss.Clear(shard); err != nil {
+			return false, replica.failed(shard, err)
+		}
+		return false, replica.advance(shard, datastore.LogPosition{}, leaderEnd)
+	}
+	if response.StatusCode != http.StatusOK {
+		return false, replica.failed(shard, fmt.Errorf("leader answered %s", response.Status))
+	}
+	next, err := parseLogPosition(response.Header.Get(logNextHeader))
+	if err != nil {
+		return false, replica.failed(shard, err)
+	}
+	end, err := parseLogPosition(response.Header.Get(logEndHeader))
+	if err != nil {
+		return false, replica.failed(shard, err)
+	}
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return false, replica.failed(shard, err)
+	}
+	if len(data) > 0 {
+		if err := replica.ss.ApplyLog(shard, data); err != nil {
+			return false, replica.failed(shard, err)
+		}
+	}
+	return next == end, replica.advance(shard, next, end)
+}
+
+func (replica *follower) advance(shard int, position, leaderEnd datastore.LogPosition) error {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	state := &replica.shards[shard]
+	state.position, state.leaderEnd, state.err = position, leaderEnd, nil
+	// the copy starts at the empty position, it has caught up only once the leader confirms it
+	if position == leaderEnd && position != (datastore.LogPosition{}) {
+		state.caughtUp = time.Now()
+		state.synced = true
+	}
+	return replica.savePositions()
+}
+
+// ready fails while a shard of the follower has not caught up with the leader,
+// for example while it is copied again and serves only a part of the keys.
+func (replica *follower) ready() error {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	if !replica.following {
+		return nil
+	}
+	for shard, state := range replica.shards {
+		if !state.synced {
+			return fmt.Errorf("shard %d has not caught up with the leader", shard)
+		}
+	}
+	return nil
+}
+
+func (replica *follower) failed(shard int, err error) error {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	replica.shards[shard].err = err
+	return err
+}
+
+// stop ends the replication and waits for the chunks that are being applied.
+func (replica *follower) stop() {
+	replica.stopOnce.Do(func() {
+		replica.cancel()
+		replica.running.Wait()
+	})
+}
+
+// promote stops following, so the node accepts writes.
+func (replica *follower) promote() {
+	replica.stop()
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	replica.following = false
+}
+
+func (replica *follower) isFollowing() bool {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	return replica.following
+}
+
+// readOnly rejects the writes to a follower with 403 and reports whether it did.
+func readOnly(w http.ResponseWriter, r *http.Request, replica *follower) bool {
+	if replica == nil || r.Method == http.MethodGet || r.Method == http.MethodHead || !replica.isFollowing() {
+		return false
+	}
+	http.Error(w, "Follower is read-only, write to the leader "+replica.leader, http.StatusForbidden)
+	return true
+}
+
+func formatLogPosition(position datastore.LogPosition) string {
+	return fmt.Sprintf("%d:%d", position.Segment, position.Offset)
+}
+
+func parseLogPosition(text string) (datastore.LogPosition, error) {
+	var position datastore.LogPosition
+	if _, err := fmt.Sscanf(text, "%d:%d", &position.Segment, &position.Offset); err != nil {
+		return position, fmt.Errorf("invalid log position %q", text)
+	}
+	return position, nil
+}
+
+// handleLog serves GET /internal/log?shard=&segment=&offset= with the records of the shard log
+// after the position. The position after them and the end of the log are in the headers,
+// 410 means the position is gone after a merge and the follower has to start from the beginning.
+func handleLog(w http.ResponseWriter, r *http.Request, ss *safestorage.SafeStorage) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	shard, err := strconv.Atoi(query.Get("shard"))
+	if err != nil || shard < 0 || shard >= ss.Shards() {
+		http.Error(w, "Invalid shard", http.StatusBadRequest)
+		return
+	}
+	var position datastore.LogPosition
+	if query.Has("segment") || query.Has("offset") {
+		position, err = parseLogPosition(query.Get("segment") + ":" + query.Get("offset"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	data, next, end, err := ss.ReadLog(shard, position, logChunk)
+	if storageGaveUp(w, err) {
+		return
+	}
+	switch {
+	case errors.Is(err, datastore.ErrPositionGone):
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	case errors.Is(err, safestorage.ErrNoLog):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case err != nil:
+		http.Error(w, "Cannot read the log", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", octetStream)
+	w.Header().Set(logNextHeader, formatLogPosition(next))
+	w.Header().Set(logEndHeader, formatLogPosition(end))
+	_, _ = w.Write(data)
+}
+
+// handleReplicationStatus serves GET /admin/replication with the role of the node
+// and, on a follower, the position and the lag of every shard.
+func handleReplicationStatus(w http.ResponseWriter, r *http.Request, ss *safestorage.SafeStorage, replica *follower) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	shards := make([]map[string]any, ss.Shards())
+	role := "leader"
+	if replica != nil && replica.isFollowing() {
+		role = "follower"
+		replica.mutex.Lock()
+		for shard, state := range replica.shards {
+			lag := time.Duration(0)
+			if state.position != state.leaderEnd {
+				lag = time.Since(state.caughtUp)
+			}
+			shards[shard] = map[string]any{
+				"position":    state.position,
+				"leader_end":  state.leaderEnd,
+				"lag_seconds": lag.Seconds(),
+			}
+			if state.err != nil {
+				shards[shard]["error"] = state.err.Error()
+			}
+		}
+		replica.mutex.Unlock()
+	} else {
+		for shard := range shards {
+			end, err := ss.LogEnd(shard)
+			if storageGaveUp(w, err) {
+				return
+			}
+			if err != nil {
+				http.Error(w, "Cannot read the log", http.StatusInternalServerError)
+				return
+			}
+			shards[shard] = map[string]any{"end": end}
+		}
+	}
+	response := map[string]any{
+		"role":   role,
+		"shards": shards,
+	}
+	if role == "follower" {
+		response["leader"] = replica.leader
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// handlePromote serves POST /admin/promote, the follower stops replicating and accepts writes.
+func handlePromote(w http.ResponseWriter, r *http.Request, replica *follower) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if replica == nil || !replica.isFollowing() {
+		http.Error(w, "Node is already the leader", http.StatusConflict)
+		return
+	}
+	replica.promote()
+	log.Printf("Promoted to the leader, stopped following %s", replica.leader)
+	w.WriteHeader(http.StatusOK)
+}
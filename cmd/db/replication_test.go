@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+type node struct {
+	server  *httptest.Server
+	admin   *httptest.Server
+	ss      *safestorage.SafeStorage
+	replica *follower
+}
+
+// startNode runs a node with two shards in the directory, it follows the leader if one is given.
+func startNode(t *testing.T, directory, leader string) *node {
+	t.Helper()
+	partitions, err := datastore.OpenShards(directory, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storages := make([]safestorage.Storage, len(partitions))
+	for i, partition := range partitions {
+		storages[i] = partition
+	}
+	started := &node{ss: safestorage.InitSharded(storages)}
+	if leader != "" {
+		if started.replica, err = follow(leader, started.ss, directory); err != nil {
+			t.Fatal(err)
+		}
+	}
+	started.server = httptest.NewServer(routes(started.ss, started.replica, nil))
+	started.admin = httptest.NewServer(adminRoutes(started.ss, started.replica, nil, testAdminToken))
+	return started
+}
+
+func (n *node) stop() {
+	n.server.Close()
+	n.admin.Close()
+	if n.replica != nil {
+		n.replica.stop()
+	}
+	_ = n.ss.Close()
+}
+
+func request(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	text, _ := io.ReadAll(response.Body)
+	return response.StatusCode, string(text)
+}
+
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+func valueOf(t *testing.T, n *node, key string) string {
+	t.Helper()
+	status, body := request(t, http.MethodGet, n.server.URL+"/db/"+key, "")
+	if status != http.StatusOK {
+		return ""
+	}
+	var response struct {
+		Value string `json:"value"`
+	}
+	_ = json.Unmarshal([]byte(body), &response)
+	return response.Value
+}
+
+func TestReplication(t *testing.T) {
+	*replicationInterval = 10 * time.Millisecond
+	leader := startNode(t, t.TempDir(), "")
+	defer leader.stop()
+	followerDir := t.TempDir()
+	replica := startNode(t, followerDir, leader.server.URL)
+	defer func() {
+		replica.stop()
+	}()
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, key := range keys {
+		if status, _ := request(t, http.MethodPost, leader.server.URL+"/db/"+key, `{"value": "v-`+key+`"}`); status != http.StatusOK {
+			t.Fatalf("Cannot write %s to the leader: %d", key, status)
+		}
+	}
+	request(t, http.MethodPost, leader.server.URL+"/db/users/ann", `{"value": "bucket"}`)
+	request(t, http.MethodPost, leader.server.URL+"/db/_txn", `{"writes": [{"key": "a", "delete": true}]}`)
+
+	eventually(t, "the follower to get the writes", func() bool {
+		return valueOf(t, replica, "h") == "v-h"
+	})
+	for _, key := range keys[1:] {
+		if value := valueOf(t, replica, key); value != "v-"+key {
+			t.Errorf("Follower has %q for %s", value, key)
+		}
+	}
+	if status, _ := request(t, http.MethodGet, replica.server.URL+"/db/a", ""); status != http.StatusNotFound {
+		t.Errorf("Deleted key is on the follower, status %d", status)
+	}
+	if status, body := request(t, http.MethodGet, replica.server.URL+"/db/users/ann", ""); status != http.StatusOK || !strings.Contains(body, "bucket") {
+		t.Errorf("Bucket key is not on the follower: %d %s", status, body)
+	}
+	if status, _ := request(t, http.MethodPost, replica.server.URL+"/db/x", `{"value": "x"}`); status != http.StatusForbidden {
+		t.Errorf("Follower accepted a write, status %d", status)
+	}
+
+	t.Run("lag", func(t *testing.T) {
+		eventually(t, "the follower to catch up", func() bool {
+			_, body := adminRequest(t, http.MethodGet, replica.admin.URL+"/admin/replication")
+			var status struct {
+				Role   string `json:"role"`
+				Shards []struct {
+					Position  datastore.LogPosition `json:"position"`
+					LeaderEnd datastore.LogPosition `json:"leader_end"`
+					Lag       float64               `json:"lag_seconds"`
+				} `json:"shards"`
+			}
+			_ = json.Unmarshal([]byte(body), &status)
+			if status.Role != "follower" || len(status.Shards) != 2 {
+				t.Fatalf("Unexpected status %s", body)
+			}
+			for _, shard := range status.Shards {
+				if shard.Position != shard.LeaderEnd || shard.Lag != 0 {
+					return false
+				}
+			}
+			return true
+		})
+		if _, body := adminRequest(t, http.MethodGet, leader.admin.URL+"/admin/replication"); !strings.Contains(body, `"role":"leader"`) {
+			t.Errorf("Unexpected leader status %s", body)
+		}
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		replica.stop()
+		if _, err := os.Stat(filepath.Join(followerDir, positionsFile)); err != nil {
+			t.Errorf("Positions were not saved: %s", err)
+		}
+		request(t, http.MethodPost, leader.server.URL+"/db/after-restart", `{"value": "new"}`)
+		replica = startNode(t, followerDir, leader.server.URL)
+		eventually(t, "the restarted follower to continue", func() bool {
+			return valueOf(t, replica, "after-restart") == "new"
+		})
+	})
+
+	t.Run("promote", func(t *testing.T) {
+		if status, _ := adminRequest(t, http.MethodPost, replica.admin.URL+"/admin/promote"); status != http.StatusOK {
+			t.Fatalf("Cannot promote, status %d", status)
+		}
+		request(t, http.MethodPost, leader.server.URL+"/db/b", `{"value": "after promotion"}`)
+		if status, _ := request(t, http.MethodPost, replica.server.URL+"/db/b", `{"value": "promoted"}`); status != http.StatusOK {
+			t.Errorf("Promoted node rejected a write, status %d", status)
+		}
+		time.Sleep(5 * *replicationInterval)
+		if value := valueOf(t, replica, "b"); value != "promoted" {
+			t.Errorf("Promoted node still follows, b is %q", value)
+		}
+		if status, _ := adminRequest(t, http.MethodPost, replica.admin.URL+"/admin/promote"); status != http.StatusConflict {
+			t.Errorf("Second promotion answered %d", status)
+		}
+	})
+}
+
+func TestFollowerCopiesAgain(t *testing.T) {
+	*replicationInterval = 10 * time.Millisecond
+	leader := startNode(t, t.TempDir(), "")
+	defer leader.stop()
+	// the proxy answers like a leader that has merged the segments the follower reads
+	var merged atomic.Bool
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if merged.Load() && r.URL.Path == "/internal/log" {
+			http.Error(w, "Position is gone", http.StatusGone)
+			return
+		}
+		leader.server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+	replica := startNode(t, t.TempDir(), proxy.URL)
+	defer replica.stop()
+	ready := func(path string) bool {
+		status, _ := request(t, http.MethodGet, replica.server.URL+path, "")
+		return status == http.StatusOK
+	}
+
+	request(t, http.MethodPost, leader.server.URL+"/db/key", `{"value": "v"}`)
+	eventually(t, "the follower to catch up", func() bool {
+		return ready("/readyz") && ready("/health")
+	})
+	merged.Store(true)
+	eventually(t, "the follower to copy the shards again", func() bool {
+		return !ready("/readyz") && !ready("/health")
+	})
+	merged.Store(false)
+	eventually(t, "the copy to catch up", func() bool {
+		return ready("/readyz") && valueOf(t, replica, "key") == "v"
+	})
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+var respPort = flag.Int("resp-port", 0, "port of the Redis protocol (RESP2) listener, 0 disables it")
+
+const (
+	// respMaxBulk is the largest value a client may send in one argument
+	respMaxBulk = 64 << 20
+	// respMaxCommand is the largest size of all arguments of a command together
+	respMaxCommand = 2 * respMaxBulk
+	// respMaxLine is the longest inline command or header line
+	respMaxLine = 64 << 10
+	// respMaxArguments is the largest number of arguments of a command
+	respMaxArguments = 1 << 20
+	// respMaxCursors is the number of unfinished SCAN iterations a connection may keep
+	respMaxCursors = 1024
+)
+
+var errRESPProtocol = errors.New("Protocol error")
+
+// respArity has the smallest and the largest number of arguments of every command.
+var respArity = map[string][2]int{
+	"PING":    {0, 1},
+	"GET":     {1, 1},
+	"SET":     {2, 4},
+	"DEL":     {1, respMaxArguments},
+	"EXISTS":  {1, respMaxArguments},
+	"SCAN":    {1, 5},
+	"INFO":    {0, 1},
+	"COMMAND": {0, respMaxArguments},
+	"QUIT":    {0, 0},
+}
+
+// respServer answers the Redis commands GET, SET, DEL, EXISTS, SCAN, PING and INFO from the storage.
+// Replies are flushed when the client has no more pipelined commands in the buffer.
+type respServer struct {
+	*tcpServer
+	ss      *safestorage.SafeStorage
+	replica *follower
+	started time.Time
+}
+
+// serveRESP accepts RESP connections on the listener until stop.
+func serveRESP(listener net.Listener, ss *safestorage.SafeStorage, replica *follower) *respServer {
+	server := &respServer{
+		ss:      ss,
+		replica: replica,
+		started: time.Now(),
+	}
+	server.tcpServer = serveTCP("RESP", listener, server.serve)
+	return server
+}
+
+// respConnection is the state of a client, it is used by a single goroutine.
+type respConnection struct {
+	server *respServer
+	reader *bufio.Reader
+	writer *bufio.Writer
+	// cursors maps the SCAN cursors given to the client to the last key they returned
+	cursors    map[uint64]string
+	lastCursor uint64
+}
+
+func (server *respServer) serve(connection net.Conn) {
+	client := &respConnection{
+		server:  server,
+		reader:  bufio.NewReader(connection),
+		writer:  bufio.NewWriter(connection),
+		cursors: make(map[uint64]string),
+	}
+	for {
+		arguments, err := readCommand(client.reader)
+		if errors.Is(err, errRESPProtocol) {
+			client.errorReply("ERR " + err.Error())
+			_ = client.writer.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(arguments) == 0 {
+			continue
+		}
+		quit := client.run(arguments)
+		if client.reader.Buffered() == 0 || quit {
+			if err := client.writer.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// readCommand reads an array of bulk strings, or an inline command separated by spaces.
+// Memory follows the bytes that have arrived, a client cannot make the server allocate
+// by announcing a large argument or many of them.
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > respMaxArguments {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+	arguments := make([]string, 0, min(max(count, 0), 64))
+	remaining := respMaxCommand
+	for range count {
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errRESPProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > respMaxBulk {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+		// every argument costs its header too, so empty arguments are bounded as well
+		remaining -= len(line) + size + 4
+		if remaining < 0 {
+			return nil, fmt.Errorf("%w: command is too large", errRESPProtocol)
+		}
+		var data bytes.Buffer
+		if _, err := io.CopyN(&data, reader, int64(size)+2); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(data.Bytes(), []byte("\r\n")) {
+			return nil, fmt.Errorf("%w: bulk string is not terminated", errRESPProtocol)
+		}
+		arguments = append(arguments, string(data.Bytes()[:size]))
+	}
+	return arguments, nil
+}
+
+// readLine reads a line of at most respMaxLine bytes.
+func readLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > respMaxLine {
+			return "", fmt.Errorf("%w: too big inline request", errRESPProtocol)
+		}
+		line = append(line, chunk...)
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			if err != nil {
+				return "", err
+			}
+			break
+		}
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+func (client *respConnection) simpleReply(text string) {
+	_, _ = client.writer.WriteString("+" + text + "\r\n")
+}
+
+func (client *respConnection) errorReply(text string) {
+	_, _ = client.writer.WriteString("-" + text + "\r\n")
+}
+
+func (client *respConnection) integerReply(value int) {
+	_, _ = client.writer.WriteString(":" + strconv.Itoa(value) + "\r\n")
+}
+
+func (client *respConnection) bulkReply(value string) {
+	_, _ = client.writer.WriteString("$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n")
+}
+
+func (client *respConnection) nullReply() {
+	_, _ = client.writer.WriteString("$-1\r\n")
+}
+
+func (client *respConnection) arrayReply(length int) {
+	_, _ = client.writer.WriteString("*" + strconv.Itoa(length) + "\r\n")
+}
+
+// storageError answers the error of a storage call.
+func (client *respConnection) storageError(err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		client.errorReply("ERR storage timeout")
+	default:
+		client.errorReply("ERR " + err.Error())
+	}
+}
+
+// run answers the command and reports whether the client has asked to close the connection.
+func (client *respConnection) run(arguments []string) bool {
+	command, name := arguments[0], strings.ToUpper(arguments[0])
+	arguments = arguments[1:]
+	ctx, cancel := context.WithTimeout(context.Background(), *requestTimeout)
+	defer cancel()
+	ss := client.server.ss.WithContext(ctx)
+
+	limits, known := respArity[name]
+	switch {
+	case !known:
+		client.errorReply(fmt.Sprintf("ERR unknown command '%.64s'", command))
+		return false
+	case len(arguments) < limits[0] || len(arguments) > limits[1]:
+		client.errorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	case (name == "SET" || name == "DEL") && client.server.replica != nil && client.server.replica.isFollowing():
+		client.errorReply("READONLY You can't write against a read only replica.")
+		return false
+	}
+
+	switch name {
+	case "PING":
+		if len(arguments) == 1 {
+			client.bulkReply(arguments[0])
+		} else {
+			client.simpleReply("PONG")
+		}
+	case "GET":
+		value, err := ss.Get(arguments[0])
+		switch {
+		case errors.Is(err, datastore.ErrNotFound):
+			client.nullReply()
+		case err != nil:
+			client.storageError(err)
+		default:
+			client.bulkReply(value)
+		}
+	case "SET":
+		client.set(ss, arguments)
+	case "DEL":
+		deleted := 0
+		for _, key := range arguments {
+			err := ss.Delete(key)
+			if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+				client.storageError(err)
+				return false
+			}
+			if err == nil {
+				deleted++
+			}
+		}
+		client.integerReply(deleted)
+	case "EXISTS":
+		found := 0
+		for _, key := range arguments {
+			_, _, err := ss.GetVersioned(key)
+			if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+				client.storageError(err)
+				return false
+			}
+			if err == nil {
+				found++
+			}
+		}
+		client.integerReply(found)
+	case "SCAN":
+		client.scan(ss, arguments)
+	case "INFO":
+		client.info(ss)
+	case "COMMAND":
+		// redis-cli asks for the command documentation, it works without it
+		client.arrayReply(0)
+	case "QUIT":
+		client.simpleReply("OK")
+		return true
+	}
+	return false
+}
+
+// set serves SET key value [EX seconds].
+func (client *respConnection) set(ss *safestorage.SafeStorage, arguments []string) {
+	key, value := arguments[0], arguments[1]
+	var ttl time.Duration
+	if len(arguments) > 2 {
+		if len(arguments) != 4 || strings.ToUpper(arguments[2]) != "EX" {
+			client.errorReply("ERR syntax error")
+			return
+		}
+		seconds, err := strconv.ParseInt(arguments[3], 10, 64)
+		if err != nil || seconds <= 0 || seconds > int64(time.Duration(1<<63-1)/time.Second) {
+			client.errorReply("ERR invalid expire time in 'set' command")
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	var err error
+	if ttl > 0 {
+		err = ss.PutWithTTL(key, value, ttl)
+	} else {
+		err = ss.Put(key, value)
+	}
+	if err != nil {
+		client.storageError(err)
+		return
+	}
+	client.simpleReply("OK")
+}
+
+// scan serves SCAN cursor [MATCH pattern] [COUNT count]. The keys are returned in order
+// and every cursor remembers the last key it has returned, so a key that exists during
+// the whole iteration is returned exactly once.
+func (client *respConnection) scan(ss *safestorage.SafeStorage, arguments []string) {
+	cursor, err := strconv.ParseUint(arguments[0], 10, 64)
+	if err != nil {
+		client.errorReply("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", 10
+	for i := 1; i < len(arguments); i += 2 {
+		if i+1 == len(arguments) {
+			client.errorReply("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(arguments[i]) {
+		case "MATCH":
+			pattern = arguments[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(arguments[i+1])
+			if err != nil || count < 1 {
+				client.errorReply("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			client.errorReply("ERR syntax error")
+			return
+		}
+	}
+	after, known := client.cursors[cursor]
+	if cursor != 0 && !known {
+		client.errorReply("ERR invalid cursor")
+		return
+	}
+	delete(client.cursors, cursor)
+
+	// one key more than COUNT tells whether the iteration goes on
+	keys, err := ss.ScanAfter("", after, count+1)
+	if err != nil {
+		client.storageError(err)
+		return
+	}
+	next := uint64(0)
+	if len(keys) > count {
+		keys = keys[:count]
+		if len(client.cursors) >= respMaxCursors {
+			for unfinished := range client.cursors {
+				delete(client.cursors, unfinished)
+				break
+			}
+		}
+		client.lastCursor++
+		next = client.lastCursor
+		client.cursors[next] = keys[count-1]
+	}
+	// COUNT is the number of keys looked at, so a MATCH may return fewer or none
+	var matched []string
+	for _, key := range keys {
+		if globMatch(pattern, key) {
+			matched = append(matched, key)
+		}
+	}
+	client.arrayReply(2)
+	client.bulkReply(strconv.FormatUint(next, 10))
+	client.arrayReply(len(matched))
+	for _, key := range matched {
+		client.bulkReply(key)
+	}
+}
+
+// globMatch reports whether the key matches the pattern the way Redis does: * matches any bytes,
+// ? one byte, [abc], [^abc] and [a-z] one byte of the set and \ escapes the next byte.
+// Unlike path.Match, / is an ordinary byte and no pattern is malformed, an unclosed [ ends with it.
+func globMatch(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for i := range len(key) + 1 {
+				if globMatch(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if key == "" {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		case '[':
+			if key == "" {
+				return false
+			}
+			matched, rest := globClass(pattern[1:], key[0])
+			if !matched {
+				return false
+			}
+			pattern, key = rest, key[1:]
+		default:
+			literal := pattern[0]
+			if literal == '\\' && len(pattern) >= 2 {
+				pattern = pattern[1:]
+				literal = pattern[0]
+			}
+			if key == "" || key[0] != literal {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		}
+	}
+	return key == ""
+}
+
+// globClass matches the byte against the set after a [ and returns the pattern after the ].
+func globClass(class string, b byte) (bool, string) {
+	negated := strings.HasPrefix(class, "^")
+	if negated {
+		class = class[1:]
+	}
+	matched := false
+	for class != "" && class[0] != ']' {
+		switch {
+		case class[0] == '\\' && len(class) >= 2:
+			matched = matched || class[1] == b
+			class = class[2:]
+		case len(class) >= 3 && class[1] == '-':
+			low, high := min(class[0], class[2]), max(class[0], class[2])
+			matched = matched || (low <= b && b <= high)
+			class = class[3:]
+		default:
+			matched = matched || class[0] == b
+			class = class[1:]
+		}
+	}
+	return matched != negated, strings.TrimPrefix(class, "]")
+}
+
+func (client *respConnection) info(ss *safestorage.SafeStorage) {
+	keys, err := ss.ScanIn("", "")
+	if err != nil {
+		client.storageError(err)
+		return
+	}
+	role := "master"
+	if client.server.replica != nil && client.server.replica.isFollowing() {
+		role = "slave"
+	}
+	lines := []string{
+		"# Server",
+		"redis_mode:standalone",
+		"uptime_in_seconds:" + strconv.Itoa(int(time.Since(client.server.started).Seconds())),
+		"storage_engine:" + *engine,
+		"storage_shards:" + strconv.Itoa(ss.Shards()),
+		"",
+		"# Clients",
+		"connected_clients:" + strconv.Itoa(client.server.connected()),
+		"",
+		"# Replication",
+		"role:" + role,
+		"",
+		"# Keyspace",
+		"db0:keys=" + strconv.Itoa(len(keys)),
+	}
+	client.bulkReply(strings.Join(lines, "\r\n") + "\r\n")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+// encodeCommand encodes the arguments as a RESP array of bulk strings.
+func encodeCommand(arguments ...string) string {
+	command := fmt.Sprintf("*%d\r\n", len(arguments))
+	for _, argument := range arguments {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(argument), argument)
+	}
+	return command
+}
+
+func startRESP(t *testing.T) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := safestorage.Init(datastore.NewMemory())
+	server := serveRESP(listener, ss, nil)
+	connection, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		connection.Close()
+		server.stop()
+		_ = ss.Close()
+	})
+	return connection, bufio.NewReader(connection)
+}
+
+func expectReplies(t *testing.T, reader *bufio.Reader, expected string) {
+	t.Helper()
+	replies := make([]byte, len(expected))
+	if _, err := io.ReadFull(reader, replies); err != nil {
+		t.Fatalf("Cannot read the replies: %s", err)
+	}
+	if string(replies) != expected {
+		t.Errorf("Replies are\n%q, wanted\n%q", replies, expected)
+	}
+}
+
+func TestRESP(t *testing.T) {
+	connection, reader := startRESP(t)
+
+	// all the commands are sent before any reply is read
+	pipeline := encodeCommand("PING") +
+		encodeCommand("SET", "key", "value with\r\nnew line") +
+		encodeCommand("GET", "key") +
+		encodeCommand("GET", "missing") +
+		encodeCommand("SET", "short", "v", "EX", "100") +
+		encodeCommand("SET", "short", "v", "EX", "0") +
+		encodeCommand("SET", "short", "v", "PX", "100") +
+		encodeCommand("EXISTS", "key", "short", "missing") +
+		encodeCommand("DEL", "key", "missing") +
+		encodeCommand("EXISTS", "key") +
+		encodeCommand("ping", "hello") +
+		encodeCommand("GET") +
+		encodeCommand("FLUSHALL") +
+		"PING\r\n"
+	if _, err := connection.Write([]byte(pipeline)); err != nil {
+		t.Fatal(err)
+	}
+	expectReplies(t, reader, "+PONG\r\n"+
+		"+OK\r\n"+
+		"$20\r\nvalue with\r\nnew line\r\n"+
+		"$-1\r\n"+
+		"+OK\r\n"+
+		"-ERR invalid expire time in 'set' command\r\n"+
+		"-ERR syntax error\r\n"+
+		":2\r\n"+
+		":1\r\n"+
+		":0\r\n"+
+		"$5\r\nhello\r\n"+
+		"-ERR wrong number of arguments for 'get' command\r\n"+
+		"-ERR unknown command 'FLUSHALL'\r\n"+
+		"+PONG\r\n")
+
+	t.Run("scan", func(t *testing.T) {
+		var pipeline string
+		for i := range 25 {
+			pipeline += encodeCommand("SET", fmt.Sprintf("scan:%02d", i), "v")
+		}
+		connection.Write([]byte(pipeline))
+		expectReplies(t, reader, strings.Repeat("+OK\r\n", 25))
+
+		seen := make(map[string]int)
+		cursor := "0"
+		for {
+			connection.Write([]byte(encodeCommand("SCAN", cursor, "MATCH", "scan:*", "COUNT", "7")))
+			if line, _ := readLine(reader); line != "*2" {
+				t.Fatalf("SCAN answered %q", line)
+			}
+			readLine(reader)
+			cursor, _ = readLine(reader)
+			count, _ := readLine(reader)
+			var keys int
+			fmt.Sscanf(count, "*%d", &keys)
+			for range keys {
+				readLine(reader)
+				key, _ := readLine(reader)
+				seen[key]++
+			}
+			if cursor == "0" {
+				break
+			}
+		}
+		if len(seen) != 25 {
+			t.Errorf("SCAN returned %d keys, wanted 25", len(seen))
+		}
+		for key, times := range seen {
+			if times != 1 || !strings.HasPrefix(key, "scan:") {
+				t.Errorf("SCAN returned %s %d times", key, times)
+			}
+		}
+		connection.Write([]byte(encodeCommand("SCAN", "12345")))
+		expectReplies(t, reader, "-ERR invalid cursor\r\n")
+	})
+
+	t.Run("info", func(t *testing.T) {
+		connection.Write([]byte(encodeCommand("INFO")))
+		header, _ := readLine(reader)
+		var size int
+		fmt.Sscanf(header, "$%d", &size)
+		info := make([]byte, size+2)
+		io.ReadFull(reader, info)
+		for _, line := range []string{"# Server", "role:master", "db0:keys=26", "connected_clients:1"} {
+			if !strings.Contains(string(info), line+"\r\n") {
+				t.Errorf("INFO has no %q:\n%s", line, info)
+			}
+		}
+	})
+
+	t.Run("protocol error", func(t *testing.T) {
+		connection.Write([]byte("*1\r\n+PING\r\n"))
+		expectReplies(t, reader, "-ERR Protocol error: expected '$', got '+'\r\n")
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Errorf("Connection was not closed after a protocol error: %v", err)
+		}
+	})
+}
+
+func TestReadCommand(t *testing.T) {
+	for _, test := range []struct {
+		name, input string
+		err         string
+	}{
+		{"announced bulk", "*1\r\n$67108864\r\nshort", "EOF"},
+		{"too large", "*2\r\n$67108864\r\n" + strings.Repeat("v", respMaxBulk) + "\r\n$67108864\r\n", "Protocol error: command is too large"},
+		{"long line", strings.Repeat("x", respMaxLine+1) + "\r\n", "Protocol error: too big inline request"},
+		{"long header", "*1\r\n$" + strings.Repeat("0", respMaxLine) + "\r\n", "Protocol error: too big inline request"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := readCommand(bufio.NewReader(strings.NewReader(test.input)))
+			if err == nil || err.Error() != test.err {
+				t.Errorf("readCommand failed with %v, wanted %s", err, test.err)
+			}
+		})
+	}
+	arguments, err := readCommand(bufio.NewReader(strings.NewReader(encodeCommand("SET", "key", "value"))))
+	if err != nil || strings.Join(arguments, " ") != "SET key value" {
+		t.Errorf("readCommand returned %q, %v", arguments, err)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		matched      bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:1/profile", true},
+		{"*/profile", "user:1/profile", true},
+		{"user:?", "user:1", true},
+		{"user:?", "user:12", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h[\\]]llo", "h]llo", true},
+		{`user\*`, "user*", true},
+		{`user\*`, "user1", false},
+		{`user\?`, "user?", true},
+		{"a**b", "axyzb", true},
+		{"[abc", "b", true},
+		{"[abc", "bc", false},
+		{`trailing\`, `trailing\`, true},
+		{"*x", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", false},
+	}
+	for _, tt := range tests {
+		if matched := globMatch(tt.pattern, tt.key); matched != tt.matched {
+			t.Errorf("globMatch(%q, %q) = %t", tt.pattern, tt.key, matched)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+var requestTimeout = flag.Duration("request-timeout", 5*time.Second, "how long a request may wait for the storage")
+
+// scoped binds the storage to the request, so the handler gives up
+// when the client disconnects or the request timeout passes.
+func scoped(r *http.Request, ss *safestorage.SafeStorage) (*safestorage.SafeStorage, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(r.Context(), *requestTimeout)
+	return ss.WithContext(ctx), cancel
+}
+
+// storageGaveUp answers if the storage did not take the command and reports whether it did not:
+// 504 or 503 if the call was abandoned or the database is read-only for maintenance,
+// 507 if the write does not fit into the disk quota.
+func storageGaveUp(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, datastore.ErrQuotaExceeded):
+		http.Error(w, "Disk quota exceeded, delete keys to free space", http.StatusInsufficientStorage)
+	case errors.Is(err, datastore.ErrReadOnly):
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Database is read-only for maintenance", http.StatusServiceUnavailable)
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "Storage timeout", http.StatusGatewayTimeout)
+	case errors.Is(err, context.Canceled):
+		http.Error(w, "Request canceled", http.StatusServiceUnavailable)
+	default:
+		return false
+	}
+	return true
+}
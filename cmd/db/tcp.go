@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+// tcpServer runs the handler in its own goroutine for every connection of the listener until stop.
+type tcpServer struct {
+	name     string
+	listener net.Listener
+	handle   func(net.Conn)
+
+	mutex       sync.Mutex
+	connections map[net.Conn]struct{}
+	closed      bool
+	running     sync.WaitGroup
+}
+
+func serveTCP(name string, listener net.Listener, handle func(net.Conn)) *tcpServer {
+	server := &tcpServer{
+		name:        name,
+		listener:    listener,
+		handle:      handle,
+		connections: make(map[net.Conn]struct{}),
+	}
+	server.running.Add(1)
+	go server.accept()
+	return server
+}
+
+func (server *tcpServer) accept() {
+	defer server.running.Done()
+	for {
+		connection, err := server.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("%s listener finished: %s", server.name, err)
+			}
+			return
+		}
+		server.mutex.Lock()
+		if server.closed {
+			server.mutex.Unlock()
+			connection.Close()
+			return
+		}
+		server.connections[connection] = struct{}{}
+		server.running.Add(1)
+		server.mutex.Unlock()
+		go server.serve(connection)
+	}
+}
+
+func (server *tcpServer) serve(connection net.Conn) {
+	defer server.running.Done()
+	defer func() {
+		server.mutex.Lock()
+		delete(server.connections, connection)
+		server.mutex.Unlock()
+		_ = connection.Close()
+	}()
+	server.handle(connection)
+}
+
+// connected returns the number of open connections.
+func (server *tcpServer) connected() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return len(server.connections)
+}
+
+// stop closes the listener and the connections and waits for the handlers,
+// the commands being run finish first.
+func (server *tcpServer) stop() {
+	server.mutex.Lock()
+	server.closed = true
+	_ = server.listener.Close()
+	for connection := range server.connections {
+		_ = connection.Close()
+	}
+	server.mutex.Unlock()
+	server.running.Wait()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+type transactionWrite struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Delete bool   `json:"delete"`
+}
+
+// transactionRequest carries the versions the client has read with GET /db/{key}
+// and the writes to apply if none of those keys has changed. Versions read before
+// the database was restarted always conflict.
+type transactionRequest struct {
+	Expect map[string]uint64  `json:"expect"`
+	Writes []transactionWrite `json:"writes"`
+}
+
+func handleTransaction(w http.ResponseWriter, r *http.Request, ss *safestorage.SafeStorage) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body transactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	for key := range body.Expect {
+		if !authorize(r, rightRead, key) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	for _, write := range body.Writes {
+		if !authorize(r, rightWrite, write.Key) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	err := ss.Update(func(tx *datastore.Tx) error {
+		for key, version := range body.Expect {
+			tx.Expect(key, version)
+		}
+		for _, write := range body.Writes {
+			if write.Delete {
+				tx.Delete(write.Key)
+			} else {
+				tx.Put(write.Key, write.Value)
+			}
+		}
+		return nil
+	})
+	switch {
+	case storageGaveUp(w, err):
+	case errors.Is(err, datastore.ErrConflict):
+		http.Error(w, "Transaction conflict", http.StatusConflict)
+	case errors.Is(err, safestorage.ErrCrossShard):
+		http.Error(w, "Keys of the transaction belong to different shards", http.StatusBadRequest)
+	case err != nil:
+		http.Error(w, "Cannot commit transaction", http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
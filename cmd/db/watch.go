@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+const keepAliveInterval = 15 * time.Second
+
+// stopWatching is closed on shutdown, so the streams do not hold the server.
+var stopWatching = make(chan struct{})
+
+// handleWatch serves GET /db/_watch?prefix= as a stream of Server-Sent Events.
+// Every event has the id of the stream position, a client that reconnects sends it back
+// in the Last-Event-ID header or the from parameter and gets the events it has missed.
+// The stream ends if the client falls behind, the client then resumes the same way.
+func handleWatch(w http.ResponseWriter, r *http.Request, ss *safestorage.SafeStorage) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	from := r.Header.Get("Last-Event-ID")
+	if r.URL.Query().Has("from") {
+		from = r.URL.Query().Get("from")
+	}
+	positions, err := parsePositions(from)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	scopedStorage, cancel := scoped(r, ss)
+	subscription, err := scopedStorage.Watch(r.URL.Query().Get("prefix"), positions)
+	cancel()
+	if storageGaveUp(w, err) {
+		return
+	}
+	switch {
+	case errors.Is(err, datastore.ErrHistoryGone):
+		http.Error(w, "Events after the position are gone, read the keys again", http.StatusGone)
+		return
+	case errors.Is(err, safestorage.ErrShardPositions):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, "Cannot watch", http.StatusInternalServerError)
+		return
+	}
+	defer subscription.Close()
+
+	controller := http.NewResponseController(w)
+	// the stream lives longer than the write timeout of the server
+	_ = controller.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	positions = subscription.Positions
+	// the position alone, so a client that reconnects before any event does not miss one
+	_, _ = fmt.Fprintf(w, "id: %s\n\n", formatPositions(positions))
+	_ = controller.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, open := <-subscription.Events:
+			if !open {
+				return
+			}
+			positions[event.Shard] = event.Version
+			kind := "put"
+			if event.Deleted {
+				kind = "delete"
+			}
+			fields := map[string]any{
+				"key":     event.Key,
+				"value":   event.Value,
+				"version": event.Version,
+			}
+			if event.Streamed {
+				// the value is not in the event, the client reads it with GET /db/{key}
+				delete(fields, "value")
+				fields["streamed"] = true
+			}
+			data, _ := json.Marshal(fields)
+			_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", formatPositions(positions), kind, data)
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-stopWatching:
+			return
+		}
+		if err == nil {
+			err = controller.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// parsePositions reads the comma separated positions of the shards, the empty text means now.
+func parsePositions(text string) ([]uint64, error) {
+	if text == "" {
+		return nil, nil
+	}
+	parts := strings.Split(text, ",")
+	positions := make([]uint64, len(parts))
+	for i, part := range parts {
+		position, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid position %q", text)
+		}
+		positions[i] = position
+	}
+	return positions, nil
+}
+
+func formatPositions(positions []uint64) string {
+	parts := make([]string, len(positions))
+	for i, position := range positions {
+		parts[i] = strconv.FormatUint(position, 10)
+	}
+	return strings.Join(parts, ",")
+}
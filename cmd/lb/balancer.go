@@ -18,6 +18,7 @@ var (
 	port       = flag.Int("port", 8090, "load balancer port")
 	timeoutSec = flag.Int("timeout-sec", 3, "request timeout time in seconds")
 	https      = flag.Bool("https", false, "whether backends support HTTPs")
+	healthPath = flag.String("health-path", "/health", "path the backends are checked at, /readyz also checks their database")
 
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
 )
@@ -41,12 +42,13 @@ func scheme() string {
 func health(dst string) bool {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	url := fmt.Sprintf("%s://%s/health", scheme(), dst)
+	url := fmt.Sprintf("%s://%s%s", scheme(), dst, *healthPath)
 	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return false
 	}
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return false
 	}
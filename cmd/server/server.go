@@ -2,24 +2,34 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/KatePril/architecture-lab-5/dbwire"
 	"github.com/KatePril/architecture-lab-5/httptools"
 	"github.com/KatePril/architecture-lab-5/signal"
 )
 
-var port = flag.Int("port", 8080, "server port")
+var (
+	port            = flag.Int("port", 8080, "server port")
+	dbProtocol      = flag.String("db-protocol", "http", "how values are read from the database, http or binary")
+	dbBinaryAddress = flag.String("db-binary-address", "database-server:8092", "address of the binary protocol port of the database")
+	dbTimeout       = flag.Duration("db-timeout", 5*time.Second, "how long a request waits for the database")
+)
 
 const (
 	dbServiceURL      = "http://database-server:8091/db/"
 	healthCheckURL    = "http://database-server:8091/health"
+	dbLiveURL         = "http://database-server:8091/livez"
 	maxRetryAttempts  = 10
 	confHealthFailure = "CONF_HEALTH_FAILURE"
+	readyTimeout      = 2 * time.Second
 )
 
 func waitForServerReady() {
@@ -74,7 +84,63 @@ func postTeamName() {
 	panic("Failed to POST after multiple attempts")
 }
 
+var errDecode = errors.New("cannot decode the database response")
+
+// fetchHTTP reads the value with a JSON request to the database.
+func fetchHTTP(ctx context.Context, key string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dbServiceURL+key, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("database answered %s", resp.Status)
+	}
+	var result struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", errDecode
+	}
+	return result.Value, nil
+}
+
+// pingHTTP checks that the HTTP port of the database answers.
+func pingHTTP(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dbLiveURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("database answered %s", resp.Status)
+	}
+	return nil
+}
+
 func main() {
+	flag.Parse()
+	fetch, ping := fetchHTTP, pingHTTP
+	switch *dbProtocol {
+	case "http":
+	case "binary":
+		// the requests of all handlers share one persistent connection
+		client := dbwire.New(*dbBinaryAddress)
+		fetch, ping = client.Get, client.Ping
+	default:
+		fmt.Printf("Unknown database protocol %q, use http or binary\n", *dbProtocol)
+		os.Exit(1)
+	}
+
 	h := new(http.ServeMux)
 
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
@@ -88,6 +154,11 @@ func main() {
 		}
 	})
 
+	h.Handle("/livez", httptools.HealthHandler(readyTimeout, nil))
+	h.Handle("/readyz", httptools.HealthHandler(readyTimeout, map[string]httptools.Check{
+		"database": ping,
+	}))
+
 	report := make(Report)
 
 	h.HandleFunc("/api/v1/some-data", func(rw http.ResponseWriter, r *http.Request) {
@@ -98,28 +169,25 @@ func main() {
 			return
 		}
 
-		resp, err := http.DefaultClient.Get(dbServiceURL + key)
-		if err != nil {
-			rw.WriteHeader(http.StatusNotFound)
+		ctx, cancel := context.WithTimeout(r.Context(), *dbTimeout)
+		defer cancel()
+		value, err := fetch(ctx, key)
+		if errors.Is(err, context.DeadlineExceeded) {
+			http.Error(rw, "Database did not answer in time", http.StatusGatewayTimeout)
 			return
 		}
-		if resp.StatusCode != http.StatusOK {
-			rw.WriteHeader(http.StatusNotFound)
+		if errors.Is(err, errDecode) {
+			http.Error(rw, "Failed to decode db response", http.StatusInternalServerError)
 			return
 		}
-
-		var result struct {
-			Key   string `json:"key"`
-			Value string `json:"value"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-			http.Error(rw, "Failed to decode db response", http.StatusInternalServerError)
+		if err != nil {
+			rw.WriteHeader(http.StatusNotFound)
 			return
 		}
 
 		rw.Header().Set("content-type", "application/json")
 		rw.WriteHeader(http.StatusOK)
-		_ = json.NewEncoder(rw).Encode(map[string]string{"value": result.Value})
+		_ = json.NewEncoder(rw).Encode(map[string]string{"value": value})
 	})
 
 	h.Handle("/report", report)
@@ -0,0 +1,143 @@
+package datastore
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Bucket is a namespace inside the database. Keys of different buckets never clash.
+// The bucket is created on the first Put, records refer to it by a numeric id.
+type Bucket struct {
+	database *Db
+	name     string
+}
+
+// Bucket returns a handle of the named bucket, the empty name refers to the root keys of Db.
+func (database *Db) Bucket(name string) *Bucket {
+	return &Bucket{database, name}
+}
+
+func (bucket *Bucket) Get(key string) (string, error) {
+	id, exists := bucket.database.bucketId(bucket.name)
+	if !exists {
+		return "", ErrNotFound
+	}
+	value, err := bucket.database.get(recordKey{id, key})
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+func (bucket *Bucket) Put(key, value string) error {
+	if bucket.name == "" {
+		return bucket.database.Put(key, value)
+	}
+	id, exists := bucket.database.bucketId(bucket.name)
+	if !exists {
+		id = bucket.database.nextBucket
+		if err := bucket.database.putEntry(bucketRecord{id, bucket.name}); err != nil {
+			return err
+		}
+	}
+	return bucket.database.putEntry(bucketEntryRecord{id, entryRecord{key, []byte(value)}})
+}
+
+// Delete removes the key of the bucket, it fails with ErrNotFound if the key does not exist.
+func (bucket *Bucket) Delete(key string) error {
+	if bucket.name == "" {
+		return bucket.database.Delete(key)
+	}
+	id, exists := bucket.database.bucketId(bucket.name)
+	if !exists {
+		return ErrNotFound
+	}
+	if keyStorage, exists := bucket.database.offset[recordKey{id, key}]; !exists || keyStorage.expired() {
+		return ErrNotFound
+	}
+	return bucket.database.putEntry(bucketDeleteRecord{id, deleteRecord(key)})
+}
+
+// Scan returns the sorted keys of the bucket that start with the prefix.
+func (bucket *Bucket) Scan(prefix string) ([]string, error) {
+	id, exists := bucket.database.bucketId(bucket.name)
+	if !exists {
+		return []string{}, nil
+	}
+	keys := make([]string, 0)
+	for key, keyStorage := range bucket.database.offset {
+		if key.bucket == id && strings.HasPrefix(key.key, prefix) && !keyStorage.expired() {
+			keys = append(keys, key.key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+// DropBucket removes all keys of the bucket with a single record.
+// The records of the bucket are discarded by the next merge.
+func (database *Db) DropBucket(name string) error {
+	id, exists := database.bucketId(name)
+	if !exists || id == 0 {
+		return nil
+	}
+	return database.putEntry(dropBucketRecord(id))
+}
+
+func (database *Db) bucketId(name string) (uint32, bool) {
+	if name == "" {
+		return 0, true
+	}
+	id, exists := database.buckets[name]
+	return id, exists
+}
+
+// GetIn, PutIn and ScanIn are shortcuts for the bucket handle methods.
+func (database *Db) GetIn(bucket, key string) (string, error) {
+	return database.Bucket(bucket).Get(key)
+}
+
+func (database *Db) PutIn(bucket, key, value string) error {
+	return database.Bucket(bucket).Put(key, value)
+}
+
+func (database *Db) ScanIn(bucket, prefix string) ([]string, error) {
+	return database.Bucket(bucket).Scan(prefix)
+}
+
+// ScanAfter returns at most limit sorted keys of the bucket that follow the key after.
+// The sorted keys are kept until a key is added or removed, so paging through
+// an unchanged database costs a binary search per page.
+func (database *Db) ScanAfter(bucket, after string, limit int) ([]string, error) {
+	id, exists := database.bucketId(bucket)
+	if !exists {
+		return []string{}, nil
+	}
+	if database.sortedKeys == nil {
+		database.sortedKeys = slices.SortedFunc(maps.Keys(database.offset), compareKeys)
+	}
+	start, found := slices.BinarySearchFunc(database.sortedKeys, recordKey{id, after}, compareKeys)
+	if found {
+		start++
+	}
+	keys := make([]string, 0)
+	for _, key := range database.sortedKeys[start:] {
+		if key.bucket != id || len(keys) == limit {
+			break
+		}
+		if !database.offset[key].expired() {
+			keys = append(keys, key.key)
+		}
+	}
+	return keys, nil
+}
+
+func compareKeys(a, b recordKey) int {
+	return cmp.Or(cmp.Compare(a.bucket, b.bucket), strings.Compare(a.key, b.key))
+}
+
+func (database *Db) DeleteIn(bucket, key string) error {
+	return database.Bucket(bucket).Delete(key)
+}
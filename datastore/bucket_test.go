@@ -0,0 +1,141 @@
+package datastore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBucket(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	users, orders := db.Bucket("users"), db.Bucket("orders")
+
+	t.Run("isolation", func(t *testing.T) {
+		if err := users.Put("k1", "user"); err != nil {
+			t.Fatal(err)
+		}
+		if err := orders.Put("k1", "order"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("k1", "root"); err != nil {
+			t.Fatal(err)
+		}
+		for bucket, expected := range map[*Bucket]string{users: "user", orders: "order", db.Bucket(""): "root"} {
+			value, err := bucket.Get("k1")
+			if err != nil {
+				t.Errorf("Cannot get k1 from %q: %s", bucket.name, err)
+			}
+			if value != expected {
+				t.Errorf("Get(k1) in %q = %q, wanted %q", bucket.name, value, expected)
+			}
+		}
+		if _, err := db.Bucket("missing").Get("k1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound from a missing bucket, got %v", err)
+		}
+	})
+
+	t.Run("scan and delete", func(t *testing.T) {
+		_ = users.Put("k2", "v2")
+		_ = users.Put("x1", "v3")
+		if err := users.Delete("k2"); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := users.Scan("k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, []string{"k1"}) {
+			t.Errorf("Scan(k) = %v", keys)
+		}
+	})
+
+	t.Run("scan after", func(t *testing.T) {
+		for after, expected := range map[string][]string{"": {"k1", "x1"}, "k1": {"x1"}, "k": {"k1", "x1"}, "x1": {}} {
+			keys, err := db.ScanAfter("users", after, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(keys, expected) {
+				t.Errorf("ScanAfter(%q) = %v, wanted %v", after, keys, expected)
+			}
+		}
+		_ = users.Put("k3", "v4")
+		if keys, _ := db.ScanAfter("users", "k1", 1); !reflect.DeepEqual(keys, []string{"k3"}) {
+			t.Errorf("ScanAfter(k1) after a put = %v", keys)
+		}
+		_ = users.Delete("k3")
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		if err := db.DropBucket("users"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := users.Get("k1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Key of a dropped bucket is visible")
+		}
+		if value, _ := orders.Get("k1"); value != "order" {
+			t.Errorf("Drop affected another bucket, got %q", value)
+		}
+		if err := users.Put("k9", "recreated"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("recover", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = Open(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = db.Bucket("users")
+		if _, err := users.Get("k1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Dropped key came back after reopening")
+		}
+		if value, _ := users.Get("k9"); value != "recreated" {
+			t.Errorf("Get(k9) = %q after reopening", value)
+		}
+		if value, _ := db.Bucket("orders").Get("k1"); value != "order" {
+			t.Errorf("Get(k1) = %q after reopening", value)
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		if err := db.mergeFiles(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = Open(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range db.files {
+			for it := range Iterate(entry) {
+				if _, isDrop := it.data.(dropBucketRecord); isDrop {
+					t.Errorf("Drop record survived the merge")
+				}
+			}
+		}
+		if keys, _ := db.Bucket("users").Scan(""); !reflect.DeepEqual(keys, []string{"k9"}) {
+			t.Errorf("Scan after merge = %v", keys)
+		}
+		segments, err := listSegments(OS, tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) != 1 {
+			t.Errorf("Old segments were not removed, got %d segments", len(segments))
+		}
+	})
+}
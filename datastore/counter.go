@@ -0,0 +1,87 @@
+package datastore
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+)
+
+var (
+	ErrNotInteger = errors.New("value is not an integer")
+	ErrOverflow   = errors.New("integer overflow")
+)
+
+// incremented returns the counter stored in value increased by delta, a missing counter is 0.
+func incremented(value []byte, found bool, delta int64) (int64, error) {
+	var counter int64
+	if found {
+		var err error
+		if counter, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+			return 0, ErrNotInteger
+		}
+	}
+	if (delta > 0 && counter > math.MaxInt64-delta) || (delta < 0 && counter < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+	return counter + delta, nil
+}
+
+// current returns the value of the key and when it expires, found is false for a missing or expired key.
+func (database *Db) current(key string) (value []byte, expires int64, found bool, err error) {
+	keyStorage, exists := database.offset[recordKey{0, key}]
+	if !exists || keyStorage.expired() {
+		return nil, 0, false, nil
+	}
+	value, err = database.get(recordKey{0, key})
+	return value, keyStorage.expires, err == nil, err
+}
+
+// replace writes the new value of the key and keeps its expiration time.
+func (database *Db) replace(key string, value []byte, expires int64) error {
+	if expires != 0 {
+		return database.putEntry(expiringRecord{expires, entryRecord{key, value}})
+	}
+	return database.putEntry(entryRecord{key, value})
+}
+
+// Increment adds delta to the decimal integer stored in the key and returns the result.
+// A missing key counts from 0, a value that is not an integer gives ErrNotInteger.
+// Db is used by a single writer, so the read and the write cannot be interleaved by another update.
+func (database *Db) Increment(key string, delta int64) (int64, error) {
+	value, expires, found, err := database.current(key)
+	if err != nil {
+		return 0, err
+	}
+	counter, err := incremented(value, found, delta)
+	if err != nil {
+		return 0, err
+	}
+	return counter, database.replace(key, []byte(strconv.FormatInt(counter, 10)), expires)
+}
+
+// Append adds the suffix to the end of the value, a missing key is created with the suffix.
+func (database *Db) Append(key, suffix string) error {
+	value, expires, _, err := database.current(key)
+	if err != nil {
+		return err
+	}
+	return database.replace(key, append(value, suffix...), expires)
+}
+
+// Increment adds delta to the integer stored in the key like Db.Increment does.
+func (memory *Memory) Increment(key string, delta int64) (int64, error) {
+	entry, found := memory.lookup("", key)
+	counter, err := incremented(entry.value, found, delta)
+	if err != nil {
+		return 0, err
+	}
+	memory.store("", key, []byte(strconv.FormatInt(counter, 10)), entry.expires)
+	return counter, nil
+}
+
+func (memory *Memory) Append(key, suffix string) error {
+	entry, _ := memory.lookup("", key)
+	memory.store("", key, append(slices.Clip(entry.value), suffix...), entry.expires)
+	return nil
+}
@@ -0,0 +1,179 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// absent stands for a deleted or never written key in crashModel.
+const absent = "\x00absent"
+
+// crashModel keeps the values every key may have after Open.
+// An acknowledged write leaves a single value, a failed one adds its value to the old ones,
+// because the write may or may not have reached the disk.
+type crashModel map[string][]string
+
+func (model crashModel) acknowledged(key, value string) {
+	model[key] = []string{value}
+}
+
+func (model crashModel) failed(key, value string) {
+	allowed, exists := model[key]
+	if !exists {
+		allowed = []string{absent}
+	}
+	if !slices.Contains(allowed, value) {
+		model[key] = append(allowed, value)
+	}
+}
+
+func (model crashModel) record(err error, key, value string) {
+	if err == nil {
+		model.acknowledged(key, value)
+	} else {
+		model.failed(key, value)
+	}
+}
+
+// crashWorkload runs random operations until the filesystem crashes or the count is reached.
+// Keys of the bucket are prefixed with "b/" in the model.
+func crashWorkload(db *Db, random *rand.Rand, model crashModel, count int) {
+	key := func() string {
+		return fmt.Sprintf("key-%d", random.IntN(30))
+	}
+	value := func() string {
+		return strings.Repeat(fmt.Sprint(random.Uint32()), 1+random.IntN(30))
+	}
+	for range count {
+		var err error
+		switch operation := random.IntN(100); {
+		case operation < 45:
+			k, v := key(), value()
+			err = db.Put(k, v)
+			model.record(err, k, v)
+		case operation < 60:
+			k := key()
+			err = db.Delete(k)
+			model.record(err, k, absent)
+		case operation < 70:
+			k1, k2, v := key(), key(), value()
+			err = db.Update(func(tx *Tx) error {
+				tx.Put(k1, v)
+				tx.Put(k2, v)
+				return nil
+			})
+			model.record(err, k1, v)
+			model.record(err, k2, v)
+		case operation < 80:
+			k, v := key(), value()
+			err = db.PutStream(k, strings.NewReader(v), int64(len(v)))
+			model.record(err, k, v)
+		case operation < 90:
+			k, v := key(), value()
+			err = db.PutIn("bucket", k, v)
+			model.record(err, "b/"+k, v)
+		default:
+			k, v := key(), value()
+			err = db.PutWithTTL(k, v, time.Hour)
+			model.record(err, k, v)
+		}
+		if errors.Is(err, ErrCrashed) {
+			return
+		}
+	}
+}
+
+// checkModel verifies that every key has one of the allowed values and narrows the model down to it.
+func checkModel(t *testing.T, db *Db, model crashModel, seed uint64) {
+	t.Helper()
+	for key, allowed := range model {
+		var value string
+		var err error
+		if bucketKey, found := strings.CutPrefix(key, "b/"); found {
+			value, err = db.GetIn("bucket", bucketKey)
+		} else {
+			value, err = db.Get(key)
+		}
+		if errors.Is(err, ErrNotFound) {
+			value, err = absent, nil
+		}
+		if err != nil {
+			t.Fatalf("Seed %d: cannot get %s: %s", seed, key, err)
+		}
+		if !slices.Contains(allowed, value) {
+			t.Fatalf("Seed %d: key %s has %.20q after Open, wanted one of %.20q", seed, key, value, allowed)
+		}
+		model.acknowledged(key, value)
+	}
+}
+
+func TestCrashConsistency(t *testing.T) {
+	for seed := range uint64(200) {
+		random := rand.New(rand.NewPCG(seed, 0))
+		fs := NewMemFS()
+		model := make(crashModel)
+
+		for range 3 {
+			db, err := OpenFS(fs, "db")
+			if err != nil {
+				t.Fatalf("Seed %d: cannot open: %s", seed, err)
+			}
+			// small segments, so rotations and merges happen often
+			db.segmentSize = 2048
+			checkModel(t, db, model, seed)
+
+			crashAt := 1 + random.IntN(500)
+			fs.Inject(func(op Op) *Fault {
+				switch {
+				case op.Seq == crashAt:
+					return &Fault{Crash: true, Written: random.IntN(64)}
+				case op.Kind == "write" && random.IntN(50) == 0:
+					return &Fault{Written: random.IntN(64)}
+				}
+				return nil
+			})
+			crashWorkload(db, random, model, 400)
+			fs.Restart()
+		}
+	}
+}
+
+func TestMemFS_FailedWrite(t *testing.T) {
+	fs := NewMemFS()
+	db, err := OpenFS(fs, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Inject(func(op Op) *Fault {
+		if op.Kind == "write" {
+			return &Fault{Written: 3}
+		}
+		return nil
+	})
+	if err := db.Put("lost", "value"); !errors.Is(err, ErrInjected) {
+		t.Errorf("Expected ErrInjected, got %v", err)
+	}
+	fs.Inject(nil)
+	if err := db.Put("kept", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenFS(fs, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("kept"); err != nil || value != "value" {
+		t.Errorf("Write after a short one was lost: %q, %v", value, err)
+	}
+	if _, err := db.Get("lost"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Failed write was stored: %v", err)
+	}
+}
@@ -2,9 +2,14 @@ package datastore
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"time"
 )
 
 const outFileBase = "current-data-"
@@ -14,33 +19,99 @@ const mode = os.O_RDWR | os.O_CREATE
 var ErrNotFound = errors.New("record does not exist")
 
 type KeyStorage struct {
-	file   *os.File
+	file   File
 	offset int64
+	// version grows with every write of the key. Its high bits are the epoch of the Open,
+	// so a version given out before a restart never matches a key again.
+	version uint64
+	// expires is the unix time in nanoseconds when the key disappears, 0 means never
+	expires int64
+}
+
+func (keyStorage KeyStorage) expired() bool {
+	return keyStorage.expires != 0 && time.Now().UnixNano() >= keyStorage.expires
 }
 
 type Db struct {
+	fs        FS
 	directory string
-	files     []*os.File
-	offset    map[string]KeyStorage
+	files     []File
+	// segmentSize is the size after which a new segment is started
+	segmentSize int64
+	offset      map[recordKey]KeyStorage
+	nextId      int
+	buckets     map[string]uint32
+	nextBucket  uint32
+	version     uint64
+	indexes     map[string]*index
+	// sortedKeys are the keys of offset in order, nil after a key was added or removed
+	sortedKeys []recordKey
+	// diskSize is the total size of the files, -1 after a segment was created
+	diskSize int64
+	// watchers is created after the recovery, so recovered records are not reported
+	watchers *watchers
+	readOnly bool
+	options  Options
+
+	merges        int
+	mergeDuration time.Duration
 }
 
 func Open(directory string) (*Db, error) {
+	return OpenFS(OS, directory)
+}
+
+// OpenWithOptions opens the database that keeps to the disk limits of the options.
+func OpenWithOptions(directory string, options Options) (*Db, error) {
+	return openFS(OS, directory, options)
+}
+
+// OpenFS opens the database in a directory of the filesystem.
+func OpenFS(fs FS, directory string) (*Db, error) {
+	return openFS(fs, directory, Options{})
+}
+
+func openFS(fs FS, directory string, options Options) (*Db, error) {
 	database := &Db{
-		directory: directory,
-		files:     make([]*os.File, 0),
-		offset:    make(map[string]KeyStorage),
-	}
-	pattern := filepath.Join(directory, outFileBase+"*")
-	files, _ := filepath.Glob(pattern)
-	for _, filepath := range files {
-		if file, err := os.OpenFile(filepath, os.O_RDWR, 0o600); err == nil {
+		fs:          fs,
+		directory:   directory,
+		options:     options,
+		files:       make([]File, 0),
+		segmentSize: maxFileSize,
+		offset:      make(map[recordKey]KeyStorage),
+		buckets:     make(map[string]uint32),
+		nextBucket:  1,
+		indexes:     make(map[string]*index),
+		diskSize:    -1,
+	}
+	segments, err := listSegments(fs, directory)
+	if err != nil {
+		return nil, err
+	}
+	epoch, err := readEpoch(fs, directory)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the epoch: %w", err)
+	}
+	epoch++
+	database.version = epoch << epochShift
+	for i, segment := range segments {
+		file, err := openSegment(fs, segment.path)
+		if err == nil {
 			database.files = append(database.files, file)
-			if database.recover(file) == nil {
-				continue
+			database.nextId = segment.id + 1
+			var end int64
+			if end, err = database.recover(file); err == nil {
+				if i < len(segments)-1 {
+					continue
+				}
+				// a record torn by a crash would hide everything written after it
+				if err = truncateTail(file, end); err == nil {
+					continue
+				}
 			}
 		}
 		database.Close()
-		return nil, errors.New("cannot read file " + filepath)
+		return nil, fmt.Errorf("cannot read file %s: %w", segment.path, err)
 	}
 	if len(database.files) == 0 {
 		file, err := database.newFile()
@@ -49,13 +120,96 @@ func Open(directory string) (*Db, error) {
 		}
 		database.files = append(database.files, file)
 	}
+	if err := writeEpoch(fs, directory, epoch); err != nil {
+		database.Close()
+		return nil, fmt.Errorf("cannot write the epoch: %w", err)
+	}
+	database.watchers = &watchers{forgotten: database.version}
 	return database, nil
 }
 
-func (database *Db) recover(file *os.File) error {
+// recover applies records of the file and returns the offset after the last one.
+func (database *Db) recover(file File) (int64, error) {
+	end := int64(headerSize)
 	for value := range Iterate(file) {
-		key := value.data.getId()
-		database.offset[key] = KeyStorage{file, value.offset}
+		database.apply(value.data, KeyStorage{file: file, offset: value.offset})
+		end = value.offset + int64(value.size)
+	}
+	return end, nil
+}
+
+func truncateTail(file File, end int64) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() <= end {
+		return nil
+	}
+	return file.Truncate(end)
+}
+
+// apply updates the in-memory index with a record written at the given place.
+func (database *Db) apply(data record, place KeyStorage) {
+	switch rec := data.(type) {
+	case deleteRecord:
+		database.sortedKeys = nil
+		delete(database.offset, rec.getId())
+		database.unindex(string(rec))
+		database.version++
+		database.publish(Event{Key: string(rec), Version: database.version, Deleted: true})
+	case bucketDeleteRecord:
+		database.sortedKeys = nil
+		delete(database.offset, rec.getId())
+	case indexRecord:
+		database.buildIndex(rec.name, rec.path)
+	case bucketRecord:
+		database.buckets[rec.name] = rec.id
+		database.nextBucket = max(database.nextBucket, rec.id+1)
+	case batchRecord:
+		for _, item := range rec {
+			database.apply(item.data, KeyStorage{file: place.file, offset: place.offset + batchHeaderSize + item.offset})
+		}
+	case dropBucketRecord:
+		for name, id := range database.buckets {
+			if id == uint32(rec) {
+				delete(database.buckets, name)
+			}
+		}
+		database.sortedKeys = nil
+		for key := range database.offset {
+			if key.bucket == uint32(rec) {
+				delete(database.offset, key)
+			}
+		}
+	default:
+		database.version++
+		place.version = database.version
+		switch entry := data.(type) {
+		case entryRecord:
+			database.reindex(entry, place)
+			database.publish(Event{Key: entry.key, Value: string(entry.value), Version: place.version})
+		case streamedRecord:
+			database.reindex(entry.entryRecord, place)
+			database.publish(Event{Key: entry.key, Version: place.version, Streamed: true})
+		case expiringRecord:
+			place.expires = entry.expires
+			database.reindex(entry.entry, place)
+			database.publish(Event{Key: entry.entry.key, Value: string(entry.entry.value), Version: place.version})
+		}
+		if _, exists := database.offset[data.getId()]; !exists {
+			database.sortedKeys = nil
+		}
+		database.offset[data.getId()] = place
+	}
+}
+
+// Sync flushes all segments to the disk.
+func (database *Db) Sync() error {
+	for _, file := range database.files {
+		if err := file.Sync(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -69,143 +223,327 @@ func (database *Db) Close() error {
 	return nil
 }
 
-func (database *Db) newFile() (*os.File, error) {
-	filename := outFileBase + strconv.Itoa(len(database.files))
-	filepath := filepath.Join(database.directory, filename)
+// newFile creates the next segment. The header is written under a temporary name,
+// so a crash never leaves a segment without a complete header.
+func (database *Db) newFile() (File, error) {
+	filename := outFileBase + strconv.Itoa(database.nextId)
+	database.nextId++
+	path := filepath.Join(database.directory, filename)
+	newPath := filepath.Join(database.directory, newPrefix+filename)
 
-	err := os.MkdirAll(database.directory, 0o700)
+	err := database.fs.MkdirAll(database.directory, 0o700)
 	if err != nil {
 		return nil, err
 	}
 
-	file, err := os.OpenFile(filepath, mode, 0o600)
+	database.diskSize = -1
+	file, err := database.fs.OpenFile(newPath, mode|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.WriteAt(newHeader().encode(), 0)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = database.fs.Rename(newPath, path)
+	}
 	if err != nil {
+		database.fs.Remove(newPath)
 		return nil, err
 	}
-	return file, nil
+	return database.fs.OpenFile(path, os.O_RDWR, 0o600)
 }
 
 func (database *Db) Get(key string) (string, error) {
+	value, err := database.GetBytes(key)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// GetBytes returns the value without converting it to a string.
+func (database *Db) GetBytes(key string) ([]byte, error) {
+	return database.get(recordKey{0, key})
+}
+
+func (database *Db) get(key recordKey) ([]byte, error) {
 	keyStorage, exists := database.offset[key]
-	if !exists {
-		return "", ErrNotFound
+	if !exists || keyStorage.expired() {
+		return nil, ErrNotFound
 	}
 	data, _, err := ReadRecord(keyStorage.file, keyStorage.offset)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	switch record := data.(type) {
 	case entryRecord:
 		return record.value, nil
-	case deleteRecord:
-		return "", ErrNotFound
+	case bucketEntryRecord:
+		return record.entry.value, nil
+	case expiringRecord:
+		return record.entry.value, nil
 	default:
-		return "", nil
+		return nil, ErrNotFound
 	}
 }
 
 func (database *Db) Put(key, value string) error {
+	return database.putEntry(entryRecord{key, []byte(value)})
+}
+
+// PutBytes stores the value as is, it may contain arbitrary binary data.
+func (database *Db) PutBytes(key string, value []byte) error {
 	return database.putEntry(entryRecord{key, value})
 }
 
+// PutWithTTL stores the value that disappears after the ttl.
+// Expired values are dropped by the next merge.
+func (database *Db) PutWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("ttl must be positive")
+	}
+	expires := time.Now().Add(ttl).UnixNano()
+	return database.putEntry(expiringRecord{expires, entryRecord{key, []byte(value)}})
+}
+
+// Delete removes the key, it fails with ErrNotFound and changes nothing if the key does not exist.
 func (database *Db) Delete(key string) error {
-	_, exists := database.offset[key]
-	if !exists {
-		return nil
+	keyStorage, exists := database.offset[recordKey{0, key}]
+	if !exists || keyStorage.expired() {
+		return ErrNotFound
 	}
 
 	return database.putEntry(deleteRecord(key))
 }
 
-func (database *Db) putEntry(entry record) error {
+// PutStream writes size bytes from the reader directly into the segment file.
+// If the reader ends early nothing is stored.
+func (database *Db) PutStream(key string, reader io.Reader, size int64) error {
+	if size < 0 || size > math.MaxUint32 {
+		return fmt.Errorf("invalid value size %d", size)
+	}
+	if database.readOnly {
+		return ErrReadOnly
+	}
+	prefix := encodeEntryPrefix(key, uint32(size))
+	// the quota goes first, so a rejected write does not start a segment or a merge
+	if err := database.checkQuota(int64(len(prefix)) + size); err != nil {
+		return err
+	}
+	file, fileSize, err := database.activeFile()
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(prefix, fileSize)
+	if err == nil {
+		writer := io.NewOffsetWriter(file, fileSize+int64(len(prefix)))
+		var written int64
+		written, err = io.Copy(writer, io.LimitReader(reader, size))
+		if err == nil && written != size {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err != nil {
+		// drop the partial record, otherwise it would break the next one
+		if truncateErr := file.Truncate(fileSize); truncateErr != nil {
+			database.diskSize = -1
+			return errors.Join(err, truncateErr)
+		}
+		return err
+	}
+	database.grow(int64(len(prefix)) + size)
+	database.apply(streamedRecord{entryRecord{key: key}}, KeyStorage{file: file, offset: fileSize})
+	return nil
+}
+
+// streamedRecord is an entry written by PutStream, its value is only on the disk.
+type streamedRecord struct {
+	entryRecord
+}
+
+type valueStream struct {
+	*io.SectionReader
+	file File
+}
+
+func (stream valueStream) Close() error {
+	return stream.file.Close()
+}
+
+// GetStream returns a reader of the value backed by the segment file.
+// The reader uses its own file descriptor, so it stays valid after merges.
+func (database *Db) GetStream(key string) (io.ReadCloser, error) {
+	keyStorage, exists := database.offset[recordKey{0, key}]
+	if !exists || keyStorage.expired() {
+		return nil, ErrNotFound
+	}
+	valueOffset, length, err := ReadValueSection(keyStorage.file, keyStorage.offset)
+	if err != nil {
+		return nil, err
+	}
+	file, err := database.fs.OpenFile(keyStorage.file.Name(), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return valueStream{io.NewSectionReader(file, valueOffset, int64(length)), file}, nil
+}
+
+// activeFile returns the file new records are appended to and the offset to write at.
+func (database *Db) activeFile() (File, int64, error) {
 	file := database.files[len(database.files)-1]
 	fileStat, err := file.Stat()
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 	fileSize := fileStat.Size()
-	if fileSize >= maxFileSize {
+	if fileSize >= database.segmentSize {
 		if len(database.files) >= 3 {
 			if err := database.mergeFiles(); err != nil {
-				return err
+				return nil, 0, err
 			}
 		}
 		file, err = database.newFile()
 		if err != nil {
-			return err
+			return nil, 0, err
 		}
 		database.files = append(database.files, file)
-		fileSize = 0
+		fileSize = headerSize
+	}
+	return file, fileSize, nil
+}
+
+func (database *Db) putEntry(entry record) error {
+	if database.readOnly {
+		return ErrReadOnly
 	}
 	data := Encode(entry)
+	if !frees(entry) {
+		// rejecting the write up front never leaves a partial record on a full disk,
+		// nor starts a segment or a merge for it
+		if err := database.checkQuota(int64(len(data))); err != nil {
+			return err
+		}
+	}
+	file, fileSize, err := database.activeFile()
+	if err != nil {
+		return err
+	}
 	_, err = file.WriteAt(data, fileSize)
 	if err != nil {
+		// a partial record would hide the records appended after it
+		if truncateErr := file.Truncate(fileSize); truncateErr != nil {
+			database.diskSize = -1
+			return errors.Join(err, truncateErr)
+		}
 		return err
 	}
-	database.offset[entry.getId()] = KeyStorage{file, fileSize}
+	database.grow(int64(len(data)))
+	database.apply(entry, KeyStorage{file: file, offset: fileSize})
 	return nil
 }
 
+// mergeFiles rewrites the live records into new segments. Deleted keys and
+// dropped buckets are not in the index, so they do not survive the merge.
 func (database *Db) mergeFiles() error {
-	records := make(map[string]record)
+	start := time.Now()
+	newFiles, newOffset, err := database.writeMerged()
+	if err != nil {
+		// merged segments have higher ids than the active one,
+		// left on the disk they would override the records written after the failure
+		for _, file := range newFiles {
+			file.Close()
+			if removeErr := database.fs.Remove(file.Name()); removeErr != nil {
+				err = errors.Join(err, removeErr)
+			}
+		}
+		return err
+	}
 
-	for _, file := range database.files {
-		for it := range Iterate(file) {
-			key := it.data.getId()
-			records[key] = it.data
+	// old segments are removed from the oldest one and the ones that failed to be removed
+	// stay in use, so a put never outlives a later delete of the key on Open
+	remaining := database.files
+	for len(remaining) > 0 {
+		if err := database.fs.Remove(remaining[0].Name()); err != nil {
+			break
 		}
+		remaining[0].Close()
+		remaining = remaining[1:]
 	}
 
-	var currentFile *os.File
-	var currentSize int64
-	var newFiles []*os.File
-	fileIndex := 0
+	database.files = slices.Concat(remaining, newFiles)
+	database.offset = newOffset
+	database.sortedKeys = nil
+	database.merges++
+	database.mergeDuration += time.Since(start)
+	return nil
+}
 
-	createNewFile := func() (*os.File, error) {
-		filename := outFileBase + strconv.Itoa(fileIndex)
-		fileIndex++
-		filepath := filepath.Join(database.directory, filename)
-		return os.OpenFile(filepath, mode, 0o600)
-	}
+// writeMerged writes the live records into new segments.
+// On failure it still returns the segments it has created.
+func (database *Db) writeMerged() ([]File, map[recordKey]KeyStorage, error) {
+	var currentFile File
+	var currentSize int64
+	var newFiles []File
 
+	// merged records go to segments with fresh ids, so the old ones
+	// stay intact until the merge is complete
 	var err error
-	currentFile, err = createNewFile()
+	currentFile, err = database.newFile()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	newFiles = append(newFiles, currentFile)
-	currentSize = 0
-	newOffset := make(map[string]KeyStorage)
+	currentSize = headerSize
+	newOffset := make(map[recordKey]KeyStorage)
 
-	for _, rec := range records {
+	write := func(rec record, old KeyStorage) error {
 		data := Encode(rec)
-		if currentSize+int64(len(data)) > maxFileSize {
-			currentFile, err = createNewFile()
+		if currentSize+int64(len(data)) > database.segmentSize {
+			currentFile, err = database.newFile()
 			if err != nil {
 				return err
 			}
 			newFiles = append(newFiles, currentFile)
-			currentSize = 0
+			currentSize = headerSize
 		}
-		if data[0] != DELETE_TYPE {
-			_, err := currentFile.WriteAt(data, currentSize)
-			if err != nil {
-				return err
-			}
-
-			newOffset[rec.getId()] = KeyStorage{currentFile, currentSize}
-			currentSize += int64(len(data))
+		if _, err := currentFile.WriteAt(data, currentSize); err != nil {
+			return err
 		}
+		switch rec.(type) {
+		case bucketRecord, indexRecord:
+		default:
+			newOffset[rec.getId()] = KeyStorage{currentFile, currentSize, old.version, old.expires}
+		}
+		currentSize += int64(len(data))
+		return nil
 	}
 
-	for _, file := range database.files {
-		file.Close()
-		os.Remove(file.Name())
+	// bucket definitions go first, so they are recovered before the bucket records
+	for name, id := range database.buckets {
+		if err := write(bucketRecord{id, name}, KeyStorage{}); err != nil {
+			return newFiles, nil, err
+		}
 	}
-
-	database.files = newFiles
-	database.offset = newOffset
-	return nil
+	for name, index := range database.indexes {
+		if err := write(indexRecord{name, index.path}, KeyStorage{}); err != nil {
+			return newFiles, nil, err
+		}
+	}
+	for _, keyStorage := range database.offset {
+		if keyStorage.expired() {
+			continue
+		}
+		rec, _, err := ReadRecord(keyStorage.file, keyStorage.offset)
+		if err != nil {
+			return newFiles, nil, err
+		}
+		if err := write(rec, keyStorage); err != nil {
+			return newFiles, nil, err
+		}
+	}
+	return newFiles, newOffset, nil
 }
 
 func (database *Db) Size() (int64, error) {
@@ -1,11 +1,14 @@
 package datastore
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestDb(t *testing.T) {
@@ -53,6 +56,13 @@ func TestDb(t *testing.T) {
 		if !errors.Is(err, ErrNotFound) {
 			t.Errorf("Data wasn`t deleted successfully")
 		}
+		size, _ := db.Size()
+		if err := db.Delete(key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Second delete of %s returned %v", key, err)
+		}
+		if sizeAfter, _ := db.Size(); sizeAfter != size {
+			t.Errorf("Second delete wrote to the log, size %d became %d", size, sizeAfter)
+		}
 		db.Put(key, thirdValue)
 		value, err := db.Get(key)
 		if err != nil {
@@ -63,6 +73,57 @@ func TestDb(t *testing.T) {
 		}
 	})
 
+	t.Run("bytes", func(t *testing.T) {
+		key, value := "binary", []byte{0, 1, 2, 0xff, 0xfe, 0}
+		if err := db.PutBytes(key, value); err != nil {
+			t.Errorf("Cannot put %s: %s", key, err)
+		}
+		got, err := db.GetBytes(key)
+		if err != nil {
+			t.Errorf("Cannot get %s: %s", key, err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("Bad value returned expected %v, got %v", value, got)
+		}
+		if _, err := db.GetBytes("missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		key := "large"
+		value := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+		if err := db.PutStream(key, bytes.NewReader(value), int64(len(value))); err != nil {
+			t.Fatalf("Cannot put %s: %s", key, err)
+		}
+		stream, err := db.GetStream(key)
+		if err != nil {
+			t.Fatalf("Cannot get %s: %s", key, err)
+		}
+		got, err := io.ReadAll(stream)
+		stream.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("Bad value returned, got %d bytes, expected %d", len(got), len(value))
+		}
+
+		err = db.PutStream("short", bytes.NewReader([]byte("abc")), 10)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Expected io.ErrUnexpectedEOF for a short reader, got %v", err)
+		}
+		if _, err := db.GetStream("short"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Partially written value is visible")
+		}
+		if err := db.Put("after-short", "ok"); err != nil {
+			t.Fatal(err)
+		}
+		if value, _ := db.Get("after-short"); value != "ok" {
+			t.Errorf("Bad value after a failed stream, got %q", value)
+		}
+	})
+
 	t.Run("file growth", func(t *testing.T) {
 		sizeBefore, err := db.Size()
 		if err != nil {
@@ -130,3 +191,92 @@ func TestDb(t *testing.T) {
 		}
 	})
 }
+
+func TestDb_TTL(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	if err := db.PutWithTTL("short", "v", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("long", "v", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("short"); err != nil || value != "v" {
+		t.Errorf("Get(short) = %q, %v before expiration", value, err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := db.Get("short"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an expired key, got %v", err)
+	}
+	if keys, _ := db.Bucket("").Scan(""); len(keys) != 1 || keys[0] != "long" {
+		t.Errorf("Scan returned %v", keys)
+	}
+	expires := db.offset[recordKey{0, "long"}].expires
+	if err := db.Append("long", "-appended"); err != nil {
+		t.Fatal(err)
+	}
+	if db.offset[recordKey{0, "long"}].expires != expires {
+		t.Errorf("Append changed the expiration time")
+	}
+
+	if err := db.mergeFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("long"); err != nil || value != "v-appended" {
+		t.Errorf("Get(long) = %q, %v after reopening", value, err)
+	}
+	if _, exists := db.offset[recordKey{0, "short"}]; exists {
+		t.Errorf("Expired key survived the merge")
+	}
+}
+
+func TestDb_Stats(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	db.segmentSize = 256
+
+	for i := range 100 {
+		if err := db.Put(fmt.Sprintf("key-%d", i%10), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = db.PutWithTTL("expired", "v", time.Nanosecond)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, _ := db.Size()
+	if stats.Keys != 10 || stats.Size != size || stats.Segments != len(db.files) {
+		t.Errorf("Stats() = %+v, the database has 10 keys, %d bytes and %d segments", stats, size, len(db.files))
+	}
+	if stats.Merges == 0 || stats.MergeDuration <= 0 {
+		t.Errorf("Merges were not counted: %+v", stats)
+	}
+	db.SetReadOnly(true)
+	defer db.SetReadOnly(false)
+	if health, err := db.Health(); err != nil || !health.ReadOnly || health.FreeBytes == 0 || health.Keys != 0 {
+		t.Errorf("Health() = %+v, %v", health, err)
+	}
+}
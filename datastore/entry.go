@@ -2,89 +2,358 @@ package datastore
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"iter"
-	"os"
+	"math"
 	"slices"
 )
 
 const (
 	ENTRY_TYPE = iota
 	DELETE_TYPE
+	BUCKET_TYPE
+	BUCKET_ENTRY_TYPE
+	BUCKET_DELETE_TYPE
+	DROP_BUCKET_TYPE
+	BATCH_TYPE
+	INDEX_TYPE
+	EXPIRING_TYPE
 )
 
-var types = []uint8{ENTRY_TYPE, DELETE_TYPE}
+var types = []uint8{ENTRY_TYPE, DELETE_TYPE, BUCKET_TYPE, BUCKET_ENTRY_TYPE, BUCKET_DELETE_TYPE, DROP_BUCKET_TYPE, BATCH_TYPE, INDEX_TYPE, EXPIRING_TYPE}
+
+// recordKey identifies a key inside a bucket, the root bucket has id 0.
+type recordKey struct {
+	bucket uint32
+	key    string
+}
 
 type record interface {
-	getId() string
+	getId() recordKey
 }
 
 type entryRecord struct {
-	key, value string
+	key   string
+	value []byte
 }
 
-func (entry entryRecord) getId() string {
-	return entry.key
+func (entry entryRecord) getId() recordKey {
+	return recordKey{0, entry.key}
 }
 
 type deleteRecord string
 
-func (entry deleteRecord) getId() string {
-	return string(entry)
+func (entry deleteRecord) getId() recordKey {
+	return recordKey{0, string(entry)}
+}
+
+// bucketRecord assigns an id to a bucket name, records of the bucket refer to it by the id.
+type bucketRecord struct {
+	id   uint32
+	name string
+}
+
+func (entry bucketRecord) getId() recordKey {
+	return recordKey{entry.id, ""}
+}
+
+type bucketEntryRecord struct {
+	bucket uint32
+	entry  entryRecord
+}
+
+func (entry bucketEntryRecord) getId() recordKey {
+	return recordKey{entry.bucket, entry.entry.key}
+}
+
+type bucketDeleteRecord struct {
+	bucket uint32
+	key    deleteRecord
+}
+
+func (entry bucketDeleteRecord) getId() recordKey {
+	return recordKey{entry.bucket, string(entry.key)}
+}
+
+// dropBucketRecord removes the whole bucket.
+type dropBucketRecord uint32
+
+func (entry dropBucketRecord) getId() recordKey {
+	return recordKey{uint32(entry), ""}
+}
+
+// expiringRecord is an entry that disappears at the expires time, in unix nanoseconds.
+type expiringRecord struct {
+	expires int64
+	entry   entryRecord
+}
+
+func (entry expiringRecord) getId() recordKey {
+	return recordKey{0, entry.entry.key}
+}
+
+// indexRecord registers a secondary index over the root keys.
+type indexRecord struct {
+	name, path string
+}
+
+func (entry indexRecord) getId() recordKey {
+	return recordKey{}
+}
+
+// batchRecord wraps records that have to be applied all together or not at all.
+// A batch cut off by a crash does not parse, so none of its records are recovered.
+type batchRecord []batchItem
+
+type batchItem struct {
+	// offset is relative to the first nested record
+	offset int64
+	data   record
+}
+
+const batchHeaderSize = 5
+
+func newBatch(records []record) batchRecord {
+	batch := make(batchRecord, 0, len(records))
+	var offset int64
+	for _, data := range records {
+		batch = append(batch, batchItem{offset, data})
+		offset += int64(len(Encode(data)))
+	}
+	return batch
+}
+
+func (entry batchRecord) getId() recordKey {
+	return recordKey{}
+}
+
+// probeThreshold is the length above which readChunk checks that the data
+// is really there before allocating a buffer for it.
+const probeThreshold = 64 * 1024
+
+func readChunk(reader io.ReaderAt, offset int64, length uint32) ([]byte, error) {
+	if length == 0 {
+		return []byte{}, nil
+	}
+	if length > probeThreshold {
+		if _, err := reader.ReadAt(make([]byte, 1), offset+int64(length)-1); err != nil {
+			return nil, err
+		}
+	}
+	buffer := make([]byte, length)
+	if _, err := reader.ReadAt(buffer, offset); err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+func readLength(reader io.ReaderAt, offset int64) (uint32, error) {
+	lengthBuffer := make([]byte, 4)
+	if _, err := reader.ReadAt(lengthBuffer, offset); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(lengthBuffer), nil
+}
+
+func readUvarint(reader io.ReaderAt, offset int64) (uint32, uint32, error) {
+	buffer := make([]byte, binary.MaxVarintLen32)
+	n, err := reader.ReadAt(buffer, offset)
+	if n == 0 {
+		return 0, 0, err
+	}
+	value, size := binary.Uvarint(buffer[:n])
+	if size <= 0 || value > math.MaxUint32 {
+		return 0, 0, errors.New("invalid bucket id")
+	}
+	return uint32(value), uint32(size), nil
+}
+
+func parseEntry(reader io.ReaderAt, offset int64) (record, uint32, error) {
+	keyLength, err := readLength(reader, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	keyBuffer, err := readChunk(reader, offset+4, keyLength)
+	if err != nil {
+		return nil, 0, err
+	}
+	valLength, err := readLength(reader, offset+4+int64(keyLength))
+	if err != nil {
+		return nil, 0, err
+	}
+	valBuffer, err := readChunk(reader, offset+8+int64(keyLength), valLength)
+	if err != nil {
+		return nil, 0, err
+	}
+	length := 8 + keyLength + valLength
+	return entryRecord{string(keyBuffer), valBuffer}, length, nil
+}
+
+func parseDelete(reader io.ReaderAt, offset int64) (record, uint32, error) {
+	keyLength, err := readLength(reader, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	keyBuffer, err := readChunk(reader, offset+4, keyLength)
+	if err != nil {
+		return nil, 0, err
+	}
+	return deleteRecord(keyBuffer), 4 + keyLength, nil
 }
 
 var parsers = map[uint8]func(io.ReaderAt, int64) (record, uint32, error){
-	ENTRY_TYPE: func(reader io.ReaderAt, offset int64) (record, uint32, error) {
-		lengthBuffer := make([]byte, 4)
-		// it is dangerous to check only first ReadAt, but if offsets are valid it is ok
-		_, err := reader.ReadAt(lengthBuffer, offset)
+	ENTRY_TYPE:  parseEntry,
+	DELETE_TYPE: parseDelete,
+	BUCKET_TYPE: func(reader io.ReaderAt, offset int64) (record, uint32, error) {
+		id, idLength, err := readUvarint(reader, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		name, nameLength, err := parseDelete(reader, offset+int64(idLength))
+		if err != nil {
+			return nil, 0, err
+		}
+		return bucketRecord{id, string(name.(deleteRecord))}, idLength + nameLength, nil
+	},
+	BUCKET_ENTRY_TYPE: func(reader io.ReaderAt, offset int64) (record, uint32, error) {
+		bucket, idLength, err := readUvarint(reader, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		entry, length, err := parseEntry(reader, offset+int64(idLength))
+		if err != nil {
+			return nil, 0, err
+		}
+		return bucketEntryRecord{bucket, entry.(entryRecord)}, idLength + length, nil
+	},
+	BUCKET_DELETE_TYPE: func(reader io.ReaderAt, offset int64) (record, uint32, error) {
+		bucket, idLength, err := readUvarint(reader, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		key, length, err := parseDelete(reader, offset+int64(idLength))
 		if err != nil {
 			return nil, 0, err
 		}
-		keyLength := binary.LittleEndian.Uint32(lengthBuffer)
-		reader.ReadAt(lengthBuffer, offset+int64(keyLength)+4)
-		valLength := binary.LittleEndian.Uint32(lengthBuffer)
-		keyBuffer := make([]byte, keyLength)
-		valBuffer := make([]byte, valLength)
-		reader.ReadAt(keyBuffer, offset+4)
-		reader.ReadAt(valBuffer, offset+8+int64(keyLength))
-		length := 8 + keyLength + valLength
-		return entryRecord{string(keyBuffer), string(valBuffer)}, length, nil
+		return bucketDeleteRecord{bucket, key.(deleteRecord)}, idLength + length, nil
 	},
-	DELETE_TYPE: func(reader io.ReaderAt, offset int64) (record, uint32, error) {
-		lengthBuffer := make([]byte, 4)
-		_, err := reader.ReadAt(lengthBuffer, offset)
+	EXPIRING_TYPE: func(reader io.ReaderAt, offset int64) (record, uint32, error) {
+		expiresBuffer := make([]byte, 8)
+		if _, err := reader.ReadAt(expiresBuffer, offset); err != nil {
+			return nil, 0, err
+		}
+		entry, length, err := parseEntry(reader, offset+8)
 		if err != nil {
 			return nil, 0, err
 		}
-		keyLength := binary.LittleEndian.Uint32(lengthBuffer)
-		keyBuffer := make([]byte, keyLength)
-		reader.ReadAt(keyBuffer, offset+4)
-		return deleteRecord(keyBuffer), 4 + keyLength, nil
+		expires := int64(binary.LittleEndian.Uint64(expiresBuffer))
+		return expiringRecord{expires, entry.(entryRecord)}, 8 + length, nil
 	},
+	INDEX_TYPE: func(reader io.ReaderAt, offset int64) (record, uint32, error) {
+		entry, length, err := parseEntry(reader, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		index := entry.(entryRecord)
+		return indexRecord{index.key, string(index.value)}, length, nil
+	},
+	DROP_BUCKET_TYPE: func(reader io.ReaderAt, offset int64) (record, uint32, error) {
+		bucket, idLength, err := readUvarint(reader, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		return dropBucketRecord(bucket), idLength, nil
+	},
+}
+
+func encodeEntry(data record) []byte {
+	entry, _ := data.(entryRecord)
+	kl, vl := len(entry.key), len(entry.value)
+	size := kl + vl + 8
+	buffer := make([]byte, size)
+	binary.LittleEndian.PutUint32(buffer, uint32(kl))
+	copy(buffer[4:], entry.key)
+	binary.LittleEndian.PutUint32(buffer[kl+4:], uint32(vl))
+	copy(buffer[kl+8:], entry.value)
+	return buffer
+}
+
+func encodeDelete(data record) []byte {
+	record, _ := data.(deleteRecord)
+	length := len(record)
+	buffer := make([]byte, 4+length)
+	binary.LittleEndian.PutUint32(buffer, uint32(length))
+	copy(buffer[4:], []byte(record))
+	return buffer
 }
 
 var encoders = map[uint8]func(data record) []byte{
-	ENTRY_TYPE: func(data record) []byte {
-		entry, _ := data.(entryRecord)
-		kl, vl := len(entry.key), len(entry.value)
-		size := kl + vl + 8
-		buffer := make([]byte, size)
-		binary.LittleEndian.PutUint32(buffer, uint32(kl))
-		copy(buffer[4:], entry.key)
-		binary.LittleEndian.PutUint32(buffer[kl+4:], uint32(vl))
-		copy(buffer[kl+8:], entry.value)
-		return buffer
+	ENTRY_TYPE:  encodeEntry,
+	DELETE_TYPE: encodeDelete,
+	BUCKET_TYPE: func(data record) []byte {
+		bucket, _ := data.(bucketRecord)
+		return append(binary.AppendUvarint(nil, uint64(bucket.id)), encodeDelete(deleteRecord(bucket.name))...)
+	},
+	BUCKET_ENTRY_TYPE: func(data record) []byte {
+		entry, _ := data.(bucketEntryRecord)
+		return append(binary.AppendUvarint(nil, uint64(entry.bucket)), encodeEntry(entry.entry)...)
+	},
+	BUCKET_DELETE_TYPE: func(data record) []byte {
+		entry, _ := data.(bucketDeleteRecord)
+		return append(binary.AppendUvarint(nil, uint64(entry.bucket)), encodeDelete(entry.key)...)
+	},
+	EXPIRING_TYPE: func(data record) []byte {
+		entry, _ := data.(expiringRecord)
+		return append(binary.LittleEndian.AppendUint64(nil, uint64(entry.expires)), encodeEntry(entry.entry)...)
 	},
-	DELETE_TYPE: func(data record) []byte {
-		record, _ := data.(deleteRecord)
-		length := len(record)
-		buffer := make([]byte, 4+length)
-		binary.LittleEndian.PutUint32(buffer, uint32(length))
-		copy(buffer[4:], []byte(record))
-		return buffer
+	INDEX_TYPE: func(data record) []byte {
+		index, _ := data.(indexRecord)
+		return encodeEntry(entryRecord{index.name, []byte(index.path)})
 	},
+	DROP_BUCKET_TYPE: func(data record) []byte {
+		bucket, _ := data.(dropBucketRecord)
+		return binary.AppendUvarint(nil, uint64(bucket))
+	},
+}
+
+func parseBatch(reader io.ReaderAt, offset int64) (record, uint32, error) {
+	length, err := readLength(reader, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	section := io.NewSectionReader(reader, offset+4, int64(length))
+	batch := make(batchRecord, 0)
+	var end int64
+	for it := range iterateFrom(section, 0) {
+		if _, nested := it.data.(batchRecord); nested {
+			return nil, 0, errors.New("nested batch")
+		}
+		batch = append(batch, batchItem{it.offset, it.data})
+		end = it.offset + int64(it.size)
+	}
+	if end != int64(length) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	return batch, 4 + length, nil
+}
+
+func encodeBatch(data record) []byte {
+	batch, _ := data.(batchRecord)
+	buffer := make([]byte, 4)
+	for _, item := range batch {
+		buffer = append(buffer, Encode(item.data)...)
+	}
+	binary.LittleEndian.PutUint32(buffer, uint32(len(buffer)-4))
+	return buffer
+}
+
+// batches are parsed and encoded through the maps themselves,
+// so they are registered after the maps are initialized
+func init() {
+	parsers[BATCH_TYPE] = parseBatch
+	encoders[BATCH_TYPE] = encodeBatch
 }
 
 func Encode(data record) []byte {
@@ -95,6 +364,20 @@ func Encode(data record) []byte {
 		kind = ENTRY_TYPE
 	case deleteRecord:
 		kind = DELETE_TYPE
+	case bucketRecord:
+		kind = BUCKET_TYPE
+	case bucketEntryRecord:
+		kind = BUCKET_ENTRY_TYPE
+	case bucketDeleteRecord:
+		kind = BUCKET_DELETE_TYPE
+	case dropBucketRecord:
+		kind = DROP_BUCKET_TYPE
+	case batchRecord:
+		kind = BATCH_TYPE
+	case indexRecord:
+		kind = INDEX_TYPE
+	case expiringRecord:
+		kind = EXPIRING_TYPE
 	default:
 		return nil
 	}
@@ -119,21 +402,65 @@ func ReadRecord(file io.ReaderAt, offset int64) (record, uint32, error) {
 	return data, size + 1, err
 }
 
+// encodeEntryPrefix encodes an entry record up to its value,
+// the value itself is written right after the prefix by the caller.
+func encodeEntryPrefix(key string, valueLength uint32) []byte {
+	kl := len(key)
+	buffer := make([]byte, kl+9)
+	buffer[0] = ENTRY_TYPE
+	binary.LittleEndian.PutUint32(buffer[1:], uint32(kl))
+	copy(buffer[5:], key)
+	binary.LittleEndian.PutUint32(buffer[kl+5:], valueLength)
+	return buffer
+}
+
+// ReadValueSection locates the value of an entry record without reading it.
+func ReadValueSection(file io.ReaderAt, offset int64) (int64, uint32, error) {
+	kindBuffer := make([]byte, 1)
+	if _, err := file.ReadAt(kindBuffer, offset); err != nil {
+		return 0, 0, err
+	}
+	switch kindBuffer[0] {
+	case ENTRY_TYPE:
+	case EXPIRING_TYPE:
+		offset += 8
+	case DELETE_TYPE:
+		return 0, 0, ErrNotFound
+	default:
+		return 0, 0, fmt.Errorf("unknown record type: %d", kindBuffer[0])
+	}
+	keyLength, err := readLength(file, offset+1)
+	if err != nil {
+		return 0, 0, err
+	}
+	valueLength, err := readLength(file, offset+5+int64(keyLength))
+	if err != nil {
+		return 0, 0, err
+	}
+	return offset + 9 + int64(keyLength), valueLength, nil
+}
+
 // bad name
 type iterator struct {
 	offset int64
+	size   uint32
 	data   record
 }
 
-func Iterate(file *os.File) iter.Seq[iterator] {
+// Iterate yields records of a segment file, skipping its header.
+func Iterate(file io.ReaderAt) iter.Seq[iterator] {
+	return iterateFrom(file, headerSize)
+}
+
+func iterateFrom(file io.ReaderAt, start int64) iter.Seq[iterator] {
 	return func(yield func(iterator) bool) {
-		var offset int64
+		offset := start
 		for {
 			data, size, err := ReadRecord(file, offset)
 			if err != nil {
 				return
 			}
-			if !yield(iterator{offset, data}) {
+			if !yield(iterator{offset, size, data}) {
 				return
 			}
 			offset += int64(size)
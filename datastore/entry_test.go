@@ -6,7 +6,7 @@ import (
 )
 
 func TestEntry_Encode(t *testing.T) {
-	raw := Encode(entryRecord{"key", "value"})
+	raw := Encode(entryRecord{"key", []byte("value")})
 	record, _, _ := ReadRecord(bytes.NewReader(raw), 0)
 	entry, ok := record.(entryRecord)
 	if !ok {
@@ -15,7 +15,7 @@ func TestEntry_Encode(t *testing.T) {
 	if entry.key != "key" {
 		t.Error("incorrect key")
 	}
-	if entry.value != "value" {
+	if string(entry.value) != "value" {
 		t.Error("incorrect value")
 	}
 }
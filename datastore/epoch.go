@@ -0,0 +1,59 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	epochFile = "epoch"
+	// epochShift puts the epoch above the 2^32 versions a database may give out while it is open
+	epochShift = 32
+)
+
+// readEpoch returns the epoch of the last Open of the directory, 0 if it was never opened.
+func readEpoch(files FS, directory string) (uint64, error) {
+	file, err := files.OpenFile(filepath.Join(directory, epochFile), os.O_RDONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	buffer := make([]byte, 8)
+	if _, err := file.ReadAt(buffer, 0); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buffer), nil
+}
+
+// writeEpoch replaces the epoch under a temporary name, like newFile does with segments.
+func writeEpoch(files FS, directory string, epoch uint64) error {
+	path := filepath.Join(directory, epochFile)
+	newPath := filepath.Join(directory, newPrefix+epochFile)
+	if err := files.MkdirAll(directory, 0o700); err != nil {
+		return err
+	}
+	file, err := files.OpenFile(newPath, mode|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(binary.LittleEndian.AppendUint64(nil, epoch), 0)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = files.Rename(newPath, path)
+	}
+	if err != nil {
+		files.Remove(newPath)
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package datastore
+
+import "syscall"
+
+// freeSpace returns the bytes available to the process on the filesystem of the directory.
+func freeSpace(directory string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(directory, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,59 @@
+package datastore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// File is the part of *os.File the database works with.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Writer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// FS is the filesystem the database keeps its segments in.
+// OS is used by Open, MemFS allows to simulate failures in tests.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Remove(name string) error
+	Rename(oldPath, newPath string) error
+	MkdirAll(path string, perm os.FileMode) error
+	Glob(pattern string) ([]string, error)
+}
+
+type osFS struct{}
+
+// OS is the filesystem of the operating system.
+var OS FS = osFS{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// a nil *os.File must not become a non-nil File
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
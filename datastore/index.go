@@ -0,0 +1,159 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+)
+
+var ErrNoIndex = errors.New("index does not exist")
+
+// index maps values of a JSON field to the root keys whose documents have them.
+// Only the definitions are stored, the entries are rebuilt from the records on Open.
+type index struct {
+	path   string
+	fields []string
+	keys   map[string]map[string]struct{}
+	values map[string]string
+}
+
+// RegisterIndex creates an index of the root keys by the JSON field at path,
+// a dotted list of object fields like "user.address.city".
+// Registering the same index again does nothing.
+func (database *Db) RegisterIndex(name, path string) error {
+	if exists, err := checkIndex(database.indexes, name, path); exists || err != nil {
+		return err
+	}
+	return database.putEntry(indexRecord{name, path})
+}
+
+// checkIndex validates a new index and reports whether the same one is already registered.
+func checkIndex(indexes map[string]*index, name, path string) (bool, error) {
+	if name == "" || strings.Trim(path, ".$") == "" {
+		return false, errors.New("index name and path are required")
+	}
+	existing, exists := indexes[name]
+	if exists && existing.path != path {
+		return true, errors.New("index " + name + " already exists with path " + existing.path)
+	}
+	return exists, nil
+}
+
+// QueryIndex returns the sorted keys whose indexed field equals the value.
+// Strings are compared as is, other JSON values by their JSON text.
+func (database *Db) QueryIndex(name, value string) ([]string, error) {
+	index, exists := database.indexes[name]
+	if !exists {
+		return nil, ErrNoIndex
+	}
+	keys := make([]string, 0, len(index.keys[value]))
+	for key := range index.keys[value] {
+		if !database.offset[recordKey{0, key}].expired() {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+func newIndex(path string) *index {
+	return &index{
+		path:   path,
+		fields: strings.Split(strings.TrimPrefix(strings.TrimPrefix(path, "$"), "."), "."),
+		keys:   make(map[string]map[string]struct{}),
+		values: make(map[string]string),
+	}
+}
+
+func (database *Db) buildIndex(name, path string) {
+	index := newIndex(path)
+	database.indexes[name] = index
+	for key := range database.offset {
+		if key.bucket != 0 {
+			continue
+		}
+		if value, err := database.get(key); err == nil {
+			index.add(key.key, value)
+		}
+	}
+}
+
+func (database *Db) reindex(entry entryRecord, place KeyStorage) {
+	if len(database.indexes) == 0 {
+		return
+	}
+	value := entry.value
+	if value == nil {
+		// streamed values are not kept in memory, read them back
+		data, _, err := ReadRecord(place.file, place.offset)
+		if err != nil {
+			return
+		}
+		streamed, isEntry := data.(entryRecord)
+		if !isEntry {
+			return
+		}
+		value = streamed.value
+	}
+	for _, index := range database.indexes {
+		index.remove(entry.key)
+		index.add(entry.key, value)
+	}
+}
+
+func (database *Db) unindex(key string) {
+	for _, index := range database.indexes {
+		index.remove(key)
+	}
+}
+
+func (index *index) add(key string, document []byte) {
+	value, found := extractField(document, index.fields)
+	if !found {
+		return
+	}
+	if index.keys[value] == nil {
+		index.keys[value] = make(map[string]struct{})
+	}
+	index.keys[value][key] = struct{}{}
+	index.values[key] = value
+}
+
+func (index *index) remove(key string) {
+	value, exists := index.values[key]
+	if !exists {
+		return
+	}
+	delete(index.keys[value], key)
+	if len(index.keys[value]) == 0 {
+		delete(index.keys, value)
+	}
+	delete(index.values, key)
+}
+
+func extractField(document []byte, fields []string) (string, bool) {
+	var current any
+	if err := json.Unmarshal(document, &current); err != nil {
+		return "", false
+	}
+	for _, field := range fields {
+		object, isObject := current.(map[string]any)
+		if !isObject {
+			return "", false
+		}
+		var found bool
+		if current, found = object[field]; !found {
+			return "", false
+		}
+	}
+	switch value := current.(type) {
+	case string:
+		return value, true
+	case nil, map[string]any, []any:
+		return "", false
+	default:
+		encoded, _ := json.Marshal(value)
+		return string(encoded), true
+	}
+}
@@ -0,0 +1,81 @@
+package datastore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	_ = db.Put("u1", `{"name": "Ann", "address": {"city": "Kyiv"}, "age": 20}`)
+	_ = db.Put("u2", `{"name": "Bob", "address": {"city": "Lviv"}, "age": 30}`)
+	_ = db.Put("plain", "not a json")
+	if err := db.RegisterIndex("city", "address.city"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RegisterIndex("age", "$.age"); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(name, value string) []string {
+		t.Helper()
+		keys, err := db.QueryIndex(name, value)
+		if err != nil {
+			t.Fatalf("Cannot query %s: %s", name, err)
+		}
+		return keys
+	}
+
+	t.Run("existing values", func(t *testing.T) {
+		if keys := query("city", "Kyiv"); !reflect.DeepEqual(keys, []string{"u1"}) {
+			t.Errorf("QueryIndex(city, Kyiv) = %v", keys)
+		}
+		if keys := query("age", "30"); !reflect.DeepEqual(keys, []string{"u2"}) {
+			t.Errorf("QueryIndex(age, 30) = %v", keys)
+		}
+		if _, err := db.QueryIndex("missing", "x"); !errors.Is(err, ErrNoIndex) {
+			t.Errorf("Expected ErrNoIndex, got %v", err)
+		}
+	})
+
+	t.Run("put and delete", func(t *testing.T) {
+		_ = db.Put("u3", `{"address": {"city": "Kyiv"}}`)
+		_ = db.Put("u1", `{"address": {"city": "Odesa"}}`)
+		_ = db.Delete("u2")
+		if keys := query("city", "Kyiv"); !reflect.DeepEqual(keys, []string{"u3"}) {
+			t.Errorf("QueryIndex(city, Kyiv) = %v", keys)
+		}
+		if keys := query("city", "Lviv"); len(keys) != 0 {
+			t.Errorf("Deleted key is still indexed: %v", keys)
+		}
+	})
+
+	t.Run("recover and merge", func(t *testing.T) {
+		if err := db.mergeFiles(); err != nil {
+			t.Fatal(err)
+		}
+		_ = db.Put("u4", `{"address": {"city": "Odesa"}}`)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = Open(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := query("city", "Odesa"); !reflect.DeepEqual(keys, []string{"u1", "u4"}) {
+			t.Errorf("QueryIndex(city, Odesa) after reopening = %v", keys)
+		}
+		if err := db.RegisterIndex("city", "name"); err == nil {
+			t.Errorf("Index was registered twice with different paths")
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package datastore
+
+import (
+	"errors"
+	"path/filepath"
+)
+
+var ErrReadOnly = errors.New("database is read-only")
+
+// SegmentStats describes a segment file. Live bytes are the records of the keys
+// that are neither overwritten nor deleted, the rest is dead until the next merge.
+type SegmentStats struct {
+	Name      string
+	Size      int64
+	LiveBytes int64
+	DeadBytes int64
+}
+
+// Compact merges all segments now, including the active one,
+// so the space of the overwritten and deleted records is freed.
+func (database *Db) Compact() error {
+	return database.mergeFiles()
+}
+
+// Rotate starts a new active segment even if the current one is not full.
+func (database *Db) Rotate() error {
+	file, err := database.newFile()
+	if err != nil {
+		return err
+	}
+	database.files = append(database.files, file)
+	return nil
+}
+
+// SetReadOnly rejects or allows the writes, a read-only database
+// fails them with ErrReadOnly but can still be compacted, rotated and synced.
+func (database *Db) SetReadOnly(readOnly bool) {
+	database.readOnly = readOnly
+}
+
+// Segments returns the statistics of the segments from the oldest one.
+func (database *Db) Segments() ([]SegmentStats, error) {
+	live := make(map[File]int64)
+	for _, keyStorage := range database.offset {
+		_, size, err := ReadRecord(keyStorage.file, keyStorage.offset)
+		if err != nil {
+			return nil, err
+		}
+		live[keyStorage.file] += int64(size)
+	}
+	segments := make([]SegmentStats, 0, len(database.files))
+	for _, file := range database.files {
+		stat, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, SegmentStats{
+			Name:      filepath.Base(file.Name()),
+			Size:      stat.Size(),
+			LiveBytes: live[file],
+			DeadBytes: stat.Size() - headerSize - live[file],
+		})
+	}
+	return segments, nil
+}
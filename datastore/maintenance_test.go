@@ -0,0 +1,63 @@
+package datastore
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDb_Maintenance(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	for _, value := range []string{"v1", "v2", "v3"} {
+		if err := db.Put("key", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("other", "v"); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := db.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := int64(len(Encode(entryRecord{"key", []byte("v1")})))
+	if len(segments) != 2 {
+		t.Fatalf("Rotate left %d segments", len(segments))
+	}
+	if first := segments[0]; first.LiveBytes != record || first.DeadBytes != 2*record || first.Size != headerSize+3*record {
+		t.Errorf("First segment is %+v, records are %d bytes", first, record)
+	}
+	if second := segments[1]; second.DeadBytes != 0 || second.LiveBytes == 0 {
+		t.Errorf("Second segment is %+v", second)
+	}
+
+	db.SetReadOnly(true)
+	if err := db.Put("key", "v4"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Put in the read-only mode gave %v", err)
+	}
+	if err := db.Delete("key"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Delete in the read-only mode gave %v", err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Cannot compact a read-only database: %s", err)
+	}
+	if segments, _ = db.Segments(); len(segments) != 1 || segments[0].DeadBytes != 0 {
+		t.Errorf("Compaction left %+v", segments)
+	}
+	if value, err := db.Get("key"); err != nil || value != "v3" {
+		t.Errorf("Get after the compaction gave %q, %v", value, err)
+	}
+	db.SetReadOnly(false)
+	if err := db.Put("key", "v4"); err != nil {
+		t.Errorf("Put after the read-only mode gave %v", err)
+	}
+}
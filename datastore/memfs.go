@@ -0,0 +1,337 @@
+package datastore
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCrashed  = errors.New("filesystem crashed")
+	ErrInjected = errors.New("injected fault")
+)
+
+// Op is an operation of MemFS a fault can be injected into.
+// Kind is one of "open", "write", "truncate", "sync", "remove", "rename" and "mkdir".
+type Op struct {
+	Kind string
+	Name string
+	// Seq numbers the operations from 1 since the filesystem was created or restarted.
+	Seq int
+}
+
+// Fault replaces the result of an operation.
+type Fault struct {
+	// Err is returned by the operation, ErrInjected or ErrCrashed if it is nil.
+	Err error
+	// Written is the number of bytes a failed write still stores.
+	Written int
+	// Crash stops the filesystem, every later operation fails with ErrCrashed until Restart.
+	Crash bool
+}
+
+// MemFS keeps files in memory and fails operations chosen by the Inject callback.
+// It models a crash of the process, not of the machine:
+// everything written before the crash is there after Restart, synced or not.
+type MemFS struct {
+	mutex   sync.Mutex
+	files   map[string]*memData
+	dirs    map[string]bool
+	inject  func(Op) *Fault
+	seq     int
+	crashed bool
+	// generation grows on Restart, handles of the previous ones are dead
+	generation int
+}
+
+// memData is the content of a file, it is shared by the open handles
+// and outlives the name, like an inode.
+type memData struct {
+	data     []byte
+	modified time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memData),
+		dirs:  map[string]bool{".": true, "/": true},
+	}
+}
+
+// Inject sets the callback that decides which operations fail, nil disables the faults.
+func (memfs *MemFS) Inject(inject func(Op) *Fault) {
+	memfs.mutex.Lock()
+	defer memfs.mutex.Unlock()
+	memfs.inject = inject
+}
+
+// Restart brings a crashed filesystem back with the data it had at the crash.
+// The faults are disabled, handles opened before the crash stay broken.
+func (memfs *MemFS) Restart() {
+	memfs.mutex.Lock()
+	defer memfs.mutex.Unlock()
+	memfs.inject = nil
+	memfs.seq = 0
+	memfs.crashed = false
+	memfs.generation++
+}
+
+// fault is called before every operation with the mutex held.
+// A non-nil fault means the operation must fail with the returned error.
+func (memfs *MemFS) fault(kind, name string) (*Fault, error) {
+	if memfs.crashed {
+		return &Fault{}, ErrCrashed
+	}
+	memfs.seq++
+	if memfs.inject == nil {
+		return nil, nil
+	}
+	fault := memfs.inject(Op{kind, name, memfs.seq})
+	if fault == nil {
+		return nil, nil
+	}
+	err := fault.Err
+	if fault.Crash {
+		memfs.crashed = true
+		if err == nil {
+			err = ErrCrashed
+		}
+	}
+	if err == nil {
+		err = ErrInjected
+	}
+	return fault, err
+}
+
+func (memfs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	memfs.mutex.Lock()
+	defer memfs.mutex.Unlock()
+	name = filepath.Clean(name)
+	if _, err := memfs.fault("open", name); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	data, exists := memfs.files[name]
+	switch {
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !exists && !memfs.dirs[filepath.Dir(name)]:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !exists:
+		data = &memData{modified: time.Now()}
+		memfs.files[name] = data
+	case flag&os.O_TRUNC != 0:
+		data.data = nil
+	}
+	return &memFile{
+		memfs:      memfs,
+		name:       name,
+		data:       data,
+		readOnly:   flag&(os.O_WRONLY|os.O_RDWR) == 0,
+		generation: memfs.generation,
+	}, nil
+}
+
+func (memfs *MemFS) Remove(name string) error {
+	memfs.mutex.Lock()
+	defer memfs.mutex.Unlock()
+	name = filepath.Clean(name)
+	if _, err := memfs.fault("remove", name); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if _, exists := memfs.files[name]; !exists {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(memfs.files, name)
+	return nil
+}
+
+func (memfs *MemFS) Rename(oldPath, newPath string) error {
+	memfs.mutex.Lock()
+	defer memfs.mutex.Unlock()
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	if _, err := memfs.fault("rename", oldPath); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: err}
+	}
+	data, exists := memfs.files[oldPath]
+	if !exists {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.ErrNotExist}
+	}
+	delete(memfs.files, oldPath)
+	memfs.files[newPath] = data
+	return nil
+}
+
+func (memfs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	memfs.mutex.Lock()
+	defer memfs.mutex.Unlock()
+	path = filepath.Clean(path)
+	if _, err := memfs.fault("mkdir", path); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	for ; !memfs.dirs[path]; path = filepath.Dir(path) {
+		memfs.dirs[path] = true
+	}
+	return nil
+}
+
+func (memfs *MemFS) Glob(pattern string) ([]string, error) {
+	memfs.mutex.Lock()
+	defer memfs.mutex.Unlock()
+	if memfs.crashed {
+		return nil, ErrCrashed
+	}
+	pattern = filepath.Clean(pattern)
+	var names []string
+	for name := range memfs.files {
+		matched, err := filepath.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+type memFile struct {
+	memfs      *MemFS
+	name       string
+	data       *memData
+	position   int64
+	readOnly   bool
+	closed     bool
+	generation int
+}
+
+// check is called before every operation of the file with the mutex held.
+func (file *memFile) check(write bool) error {
+	switch {
+	case file.closed:
+		return fs.ErrClosed
+	case file.memfs.crashed || file.generation != file.memfs.generation:
+		return ErrCrashed
+	case write && file.readOnly:
+		return fs.ErrPermission
+	}
+	return nil
+}
+
+func (file *memFile) Name() string {
+	return file.name
+}
+
+func (file *memFile) ReadAt(buffer []byte, offset int64) (int, error) {
+	file.memfs.mutex.Lock()
+	defer file.memfs.mutex.Unlock()
+	if err := file.check(false); err != nil {
+		return 0, &fs.PathError{Op: "read", Path: file.name, Err: err}
+	}
+	if offset >= int64(len(file.data.data)) {
+		return 0, io.EOF
+	}
+	read := copy(buffer, file.data.data[offset:])
+	if read < len(buffer) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (file *memFile) WriteAt(buffer []byte, offset int64) (int, error) {
+	file.memfs.mutex.Lock()
+	defer file.memfs.mutex.Unlock()
+	if err := file.check(true); err != nil {
+		return 0, &fs.PathError{Op: "write", Path: file.name, Err: err}
+	}
+	fault, err := file.memfs.fault("write", file.name)
+	if fault != nil {
+		written := min(max(fault.Written, 0), len(buffer))
+		file.write(buffer[:written], offset)
+		return written, &fs.PathError{Op: "write", Path: file.name, Err: err}
+	}
+	file.write(buffer, offset)
+	return len(buffer), nil
+}
+
+func (file *memFile) write(buffer []byte, offset int64) {
+	if end := offset + int64(len(buffer)); end > int64(len(file.data.data)) {
+		file.data.data = append(file.data.data, make([]byte, end-int64(len(file.data.data)))...)
+	}
+	copy(file.data.data[offset:], buffer)
+	file.data.modified = time.Now()
+}
+
+func (file *memFile) Write(buffer []byte) (int, error) {
+	written, err := file.WriteAt(buffer, file.position)
+	file.position += int64(written)
+	return written, err
+}
+
+func (file *memFile) Truncate(size int64) error {
+	file.memfs.mutex.Lock()
+	defer file.memfs.mutex.Unlock()
+	if err := file.check(true); err != nil {
+		return &fs.PathError{Op: "truncate", Path: file.name, Err: err}
+	}
+	if _, err := file.memfs.fault("truncate", file.name); err != nil {
+		return &fs.PathError{Op: "truncate", Path: file.name, Err: err}
+	}
+	if size <= int64(len(file.data.data)) {
+		file.data.data = file.data.data[:size]
+	} else {
+		file.write(nil, size)
+	}
+	return nil
+}
+
+func (file *memFile) Sync() error {
+	file.memfs.mutex.Lock()
+	defer file.memfs.mutex.Unlock()
+	if err := file.check(false); err != nil {
+		return &fs.PathError{Op: "sync", Path: file.name, Err: err}
+	}
+	if _, err := file.memfs.fault("sync", file.name); err != nil {
+		return &fs.PathError{Op: "sync", Path: file.name, Err: err}
+	}
+	return nil
+}
+
+func (file *memFile) Close() error {
+	file.memfs.mutex.Lock()
+	defer file.memfs.mutex.Unlock()
+	if file.closed {
+		return &fs.PathError{Op: "close", Path: file.name, Err: fs.ErrClosed}
+	}
+	file.closed = true
+	return nil
+}
+
+func (file *memFile) Stat() (os.FileInfo, error) {
+	file.memfs.mutex.Lock()
+	defer file.memfs.mutex.Unlock()
+	if err := file.check(false); err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: file.name, Err: err}
+	}
+	return memFileInfo{filepath.Base(file.name), int64(len(file.data.data)), file.data.modified}, nil
+}
+
+type memFileInfo struct {
+	name     string
+	size     int64
+	modified time.Time
+}
+
+func (info memFileInfo) Name() string       { return info.name }
+func (info memFileInfo) Size() int64        { return info.size }
+func (info memFileInfo) Mode() os.FileMode  { return 0o600 }
+func (info memFileInfo) ModTime() time.Time { return info.modified }
+func (info memFileInfo) IsDir() bool        { return false }
+func (info memFileInfo) Sys() any           { return nil }
@@ -0,0 +1,258 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+type memoryEntry struct {
+	value   []byte
+	version uint64
+	expires int64
+}
+
+func (entry memoryEntry) expired() bool {
+	return entry.expires != 0 && time.Now().UnixNano() >= entry.expires
+}
+
+// Memory keeps the data in maps and follows the semantics of Db: missing and expired
+// keys give ErrNotFound, versions grow with every write, transactions and indexes work
+// the same way. It is not persisted and is meant for tests.
+type Memory struct {
+	buckets  map[string]map[string]memoryEntry
+	version  uint64
+	indexes  map[string]*index
+	watchers *watchers
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		buckets:  map[string]map[string]memoryEntry{"": {}},
+		indexes:  make(map[string]*index),
+		watchers: &watchers{},
+	}
+}
+
+func (memory *Memory) lookup(bucket, key string) (memoryEntry, bool) {
+	entry, exists := memory.buckets[bucket][key]
+	if !exists || entry.expired() {
+		return memoryEntry{}, false
+	}
+	return entry, true
+}
+
+func (memory *Memory) store(bucket, key string, value []byte, expires int64) {
+	if memory.buckets[bucket] == nil {
+		memory.buckets[bucket] = make(map[string]memoryEntry)
+	}
+	memory.version++
+	memory.buckets[bucket][key] = memoryEntry{slices.Clone(value), memory.version, expires}
+	if bucket == "" {
+		for _, index := range memory.indexes {
+			index.remove(key)
+			index.add(key, value)
+		}
+		memory.watchers.publish(Event{Key: key, Value: string(value), Version: memory.version})
+	}
+}
+
+func (memory *Memory) remove(bucket, key string) {
+	delete(memory.buckets[bucket], key)
+	if bucket == "" {
+		for _, index := range memory.indexes {
+			index.remove(key)
+		}
+		memory.version++
+		memory.watchers.publish(Event{Key: key, Version: memory.version, Deleted: true})
+	}
+}
+
+func (memory *Memory) Get(key string) (string, error) {
+	return memory.GetIn("", key)
+}
+
+func (memory *Memory) GetBytes(key string) ([]byte, error) {
+	entry, exists := memory.lookup("", key)
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return slices.Clone(entry.value), nil
+}
+
+func (memory *Memory) Put(key, value string) error {
+	memory.store("", key, []byte(value), 0)
+	return nil
+}
+
+func (memory *Memory) PutBytes(key string, value []byte) error {
+	memory.store("", key, value, 0)
+	return nil
+}
+
+func (memory *Memory) PutWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("ttl must be positive")
+	}
+	memory.store("", key, []byte(value), time.Now().Add(ttl).UnixNano())
+	return nil
+}
+
+func (memory *Memory) Delete(key string) error {
+	if _, exists := memory.lookup("", key); !exists {
+		return ErrNotFound
+	}
+	memory.remove("", key)
+	return nil
+}
+
+func (memory *Memory) PutStream(key string, reader io.Reader, size int64) error {
+	if size < 0 || size > math.MaxUint32 {
+		return fmt.Errorf("invalid value size %d", size)
+	}
+	var buffer bytes.Buffer
+	written, err := io.Copy(&buffer, io.LimitReader(reader, size))
+	if err != nil {
+		return err
+	}
+	if written != size {
+		return io.ErrUnexpectedEOF
+	}
+	memory.store("", key, buffer.Bytes(), 0)
+	return nil
+}
+
+func (memory *Memory) GetStream(key string) (io.ReadCloser, error) {
+	value, err := memory.GetBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(value)), nil
+}
+
+func (memory *Memory) GetIn(bucket, key string) (string, error) {
+	entry, exists := memory.lookup(bucket, key)
+	if !exists {
+		return "", ErrNotFound
+	}
+	return string(entry.value), nil
+}
+
+func (memory *Memory) PutIn(bucket, key, value string) error {
+	memory.store(bucket, key, []byte(value), 0)
+	return nil
+}
+
+func (memory *Memory) ScanIn(bucket, prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	for key, entry := range memory.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) && !entry.expired() {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+func (memory *Memory) ScanAfter(bucket, after string, limit int) ([]string, error) {
+	keys, _ := memory.ScanIn(bucket, "")
+	start, found := slices.BinarySearch(keys, after)
+	if found {
+		start++
+	}
+	return keys[start:min(start+limit, len(keys))], nil
+}
+
+func (memory *Memory) DeleteIn(bucket, key string) error {
+	if _, exists := memory.lookup(bucket, key); !exists {
+		return ErrNotFound
+	}
+	memory.remove(bucket, key)
+	return nil
+}
+
+func (memory *Memory) DropBucket(name string) error {
+	if name != "" {
+		delete(memory.buckets, name)
+	}
+	return nil
+}
+
+func (memory *Memory) GetVersioned(key string) (string, uint64, error) {
+	entry, exists := memory.lookup("", key)
+	if !exists {
+		return "", 0, ErrNotFound
+	}
+	return string(entry.value), entry.version, nil
+}
+
+func (memory *Memory) Update(fn func(tx *Tx) error) error {
+	tx := NewTx(memory.GetVersioned)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return memory.Commit(tx)
+}
+
+func (memory *Memory) Commit(tx *Tx) error {
+	for key, version := range tx.reads {
+		current, _ := memory.lookup("", key)
+		if current.version != version {
+			return ErrConflict
+		}
+	}
+	for _, key := range tx.Keys() {
+		value, written := tx.writes[key]
+		switch {
+		case !written:
+		case value == nil:
+			// like Db, a delete of a missing key writes nothing and publishes no event
+			if _, exists := memory.buckets[""][key]; exists {
+				memory.remove("", key)
+			}
+		default:
+			memory.store("", key, []byte(*value), 0)
+		}
+	}
+	return nil
+}
+
+func (memory *Memory) RegisterIndex(name, path string) error {
+	if exists, err := checkIndex(memory.indexes, name, path); exists || err != nil {
+		return err
+	}
+	index := newIndex(path)
+	for key, entry := range memory.buckets[""] {
+		index.add(key, entry.value)
+	}
+	memory.indexes[name] = index
+	return nil
+}
+
+func (memory *Memory) QueryIndex(name, value string) ([]string, error) {
+	index, exists := memory.indexes[name]
+	if !exists {
+		return nil, ErrNoIndex
+	}
+	keys := make([]string, 0, len(index.keys[value]))
+	for key := range index.keys[value] {
+		if _, live := memory.lookup("", key); live {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+func (memory *Memory) Sync() error {
+	return nil
+}
+
+func (memory *Memory) Close() error {
+	return nil
+}
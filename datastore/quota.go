@@ -0,0 +1,77 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrQuotaExceeded = errors.New("disk quota exceeded")
+
+// Options limit the disk space the database may take. The zero value sets no limits.
+type Options struct {
+	// MaxDiskBytes is the largest total size of the segments, 0 means no limit
+	MaxDiskBytes int64
+	// MinFreeBytes is the space a write must leave free on the filesystem, 0 disables the check
+	MinFreeBytes uint64
+}
+
+// frees reports whether the record only removes data, those are written even over the quota,
+// so that space can be freed by deleting keys and merging.
+func frees(data record) bool {
+	switch rec := data.(type) {
+	case deleteRecord, bucketDeleteRecord, dropBucketRecord:
+		return true
+	case batchRecord:
+		for _, item := range rec {
+			if !frees(item.data) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// checkQuota fails with ErrQuotaExceeded if size more bytes would not fit into the limits.
+func (database *Db) checkQuota(size int64) error {
+	if limit := database.options.MaxDiskBytes; limit > 0 {
+		used, err := database.usedBytes()
+		if err != nil {
+			return err
+		}
+		if used+size > limit {
+			return fmt.Errorf("%w: %d of %d bytes are used, the write needs %d more", ErrQuotaExceeded, used, limit, size)
+		}
+	}
+	if reserve := database.options.MinFreeBytes; reserve > 0 {
+		free, err := freeSpace(database.directory)
+		if err != nil {
+			return err
+		}
+		if free < reserve+uint64(size) {
+			return fmt.Errorf("%w: %d bytes are free on the disk, the write needs %d and %d are reserved", ErrQuotaExceeded, free, size, reserve)
+		}
+	}
+	return nil
+}
+
+// usedBytes returns the running total of the segment sizes,
+// the files are only looked at again after the set of segments has changed.
+func (database *Db) usedBytes() (int64, error) {
+	if database.diskSize < 0 {
+		size, err := database.Size()
+		if err != nil {
+			return 0, err
+		}
+		database.diskSize = size
+	}
+	return database.diskSize, nil
+}
+
+// grow adds the bytes appended to the active segment to the running total.
+func (database *Db) grow(size int64) {
+	if database.diskSize >= 0 {
+		database.diskSize += size
+	}
+}
@@ -0,0 +1,64 @@
+package datastore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDb_Quota(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{MaxDiskBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	value := strings.Repeat("v", 100)
+	var rejected error
+	for i := 0; rejected == nil; i++ {
+		rejected = db.Put("key-"+string(rune('a'+i)), value)
+	}
+	if !errors.Is(rejected, ErrQuotaExceeded) {
+		t.Fatalf("Write over the quota gave %v", rejected)
+	}
+	size, _ := db.Size()
+	if size > 1024 {
+		t.Errorf("Database grew to %d bytes", size)
+	}
+	if err := db.PutStream("stream", strings.NewReader(value), int64(len(value))); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Stream over the quota gave %v", err)
+	}
+	if after, _ := db.Size(); after != size {
+		t.Errorf("Rejected writes changed the size from %d to %d", size, after)
+	}
+	if used, _ := db.usedBytes(); used != size {
+		t.Errorf("Running total is %d bytes, the segments have %d", used, size)
+	}
+	segments := len(db.files)
+	db.segmentSize = headerSize
+	if err := db.Put("key-z", value); !errors.Is(err, ErrQuotaExceeded) || len(db.files) != segments {
+		t.Errorf("Rejected write gave %v and left %d segments, wanted %d", err, len(db.files), segments)
+	}
+	db.segmentSize = maxFileSize
+
+	// deletes and merges free the space for new writes
+	if err := db.Delete("key-a"); err != nil {
+		t.Fatalf("Delete over the quota gave %v", err)
+	}
+	if err := db.Delete("key-b"); err != nil {
+		t.Fatalf("Delete over the quota gave %v", err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact over the quota gave %v", err)
+	}
+	if err := db.Put("key-a", value); err != nil {
+		t.Errorf("Put after freeing the space gave %v", err)
+	}
+
+	db.options = Options{MinFreeBytes: 1 << 62}
+	if err := db.Put("key-b", value); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Put on a full disk gave %v", err)
+	}
+}
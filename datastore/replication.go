@@ -0,0 +1,108 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var ErrPositionGone = errors.New("log position is no longer available")
+
+// LogPosition is a place in the segment log. The zero position is the beginning of the log.
+type LogPosition struct {
+	Segment int   `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+func segmentId(file File) int {
+	id, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(file.Name()), outFileBase))
+	return id
+}
+
+// LogEnd returns the position after the last record.
+func (database *Db) LogEnd() (LogPosition, error) {
+	last := database.files[len(database.files)-1]
+	stat, err := last.Stat()
+	if err != nil {
+		return LogPosition{}, err
+	}
+	return LogPosition{segmentId(last), stat.Size()}, nil
+}
+
+// ReadLog returns the records after the position as they are stored and the position after them.
+// It returns at most limit bytes unless the first record is larger. After a merge the segments
+// of old positions are gone, ReadLog fails with ErrPositionGone then and the reader has to
+// start again from the zero position: the merged segments have all the live records.
+func (database *Db) ReadLog(position LogPosition, limit int) ([]byte, LogPosition, error) {
+	if position == (LogPosition{}) {
+		position = LogPosition{segmentId(database.files[0]), headerSize}
+	}
+	for i, file := range database.files {
+		if segmentId(file) != position.Segment {
+			continue
+		}
+		stat, err := file.Stat()
+		if err != nil {
+			return nil, position, err
+		}
+		if position.Offset < headerSize || position.Offset > stat.Size() {
+			return nil, position, ErrPositionGone
+		}
+		end := position.Offset
+		for record := range iterateFrom(file, position.Offset) {
+			if end > position.Offset && end-position.Offset+int64(record.size) > int64(limit) {
+				break
+			}
+			end = record.offset + int64(record.size)
+		}
+		if end == position.Offset && i < len(database.files)-1 {
+			return database.ReadLog(LogPosition{segmentId(database.files[i+1]), headerSize}, limit)
+		}
+		data := make([]byte, end-position.Offset)
+		if _, err := file.ReadAt(data, position.Offset); err != nil {
+			return nil, position, err
+		}
+		return data, LogPosition{position.Segment, end}, nil
+	}
+	return nil, position, ErrPositionGone
+}
+
+// ApplyLog writes the records returned by ReadLog of another database.
+func (database *Db) ApplyLog(data []byte) error {
+	var end int64
+	for record := range iterateFrom(bytes.NewReader(data), 0) {
+		if err := database.putEntry(record.data); err != nil {
+			return err
+		}
+		end = record.offset + int64(record.size)
+	}
+	if end != int64(len(data)) {
+		return errors.New("log ends with an incomplete record")
+	}
+	return nil
+}
+
+// Clear removes all the data. Watchers are not told about the removed keys.
+func (database *Db) Clear() error {
+	// the oldest segments go first, as in mergeFiles
+	for len(database.files) > 0 {
+		if err := database.fs.Remove(database.files[0].Name()); err != nil {
+			return err
+		}
+		database.files[0].Close()
+		database.files = database.files[1:]
+	}
+	database.offset = make(map[recordKey]KeyStorage)
+	database.sortedKeys = nil
+	database.buckets = make(map[string]uint32)
+	database.nextBucket = 1
+	database.indexes = make(map[string]*index)
+	file, err := database.newFile()
+	if err != nil {
+		return err
+	}
+	database.files = append(database.files, file)
+	return nil
+}
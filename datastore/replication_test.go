@@ -0,0 +1,105 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// follow applies the log of the leader after the position and returns the new position.
+func follow(t *testing.T, leader, follower *Db, position LogPosition) (LogPosition, error) {
+	t.Helper()
+	for {
+		data, next, err := leader.ReadLog(position, 300)
+		if err != nil {
+			return position, err
+		}
+		if err := follower.ApplyLog(data); err != nil {
+			t.Fatal(err)
+		}
+		position = next
+		if end, _ := leader.LogEnd(); position == end {
+			return position, nil
+		}
+	}
+}
+
+func snapshot(t *testing.T, db *Db) map[string]string {
+	t.Helper()
+	values := make(map[string]string)
+	for _, bucket := range []string{"", "bucket"} {
+		keys, _ := db.ScanIn(bucket, "")
+		for _, key := range keys {
+			value, err := db.GetIn(bucket, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			values[bucket+"/"+key] = value
+		}
+	}
+	return values
+}
+
+func TestReplication(t *testing.T) {
+	leader, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader.segmentSize = 1024
+	follower, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = leader.Close()
+		_ = follower.Close()
+	})
+
+	_ = leader.RegisterIndex("city", "city")
+	for i := range 10 {
+		_ = leader.Put(fmt.Sprintf("key-%d", i), fmt.Sprintf(`{"city": "c%d"}`, i%2))
+		_ = leader.PutIn("bucket", fmt.Sprintf("key-%d", i), "bucket value")
+	}
+	_ = leader.PutStream("stream", strings.NewReader("streamed"), 8)
+	_ = leader.Update(func(tx *Tx) error {
+		tx.Delete("key-1")
+		tx.Put("key-2", `{"city": "c1"}`)
+		return nil
+	})
+
+	position, err := follow(t, leader, follower, LogPosition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := snapshot(t, leader), snapshot(t, follower); !reflect.DeepEqual(want, got) {
+		t.Errorf("Follower has %v, wanted %v", got, want)
+	}
+	if keys, _ := follower.QueryIndex("city", "c1"); !reflect.DeepEqual(keys, []string{"key-2", "key-3", "key-5", "key-7", "key-9"}) {
+		t.Errorf("Index of the follower has %v", keys)
+	}
+	data, next, err := leader.ReadLog(position, 300)
+	if err != nil || len(data) != 0 || next != position {
+		t.Errorf("ReadLog at the end returned %d bytes, %v, %v", len(data), next, err)
+	}
+
+	t.Run("merged log", func(t *testing.T) {
+		for i := range 100 {
+			_ = leader.Put(fmt.Sprintf("key-%d", i%20), strings.Repeat("x", 100))
+		}
+		_ = leader.Delete("key-3")
+		if _, err := follow(t, leader, follower, position); !errors.Is(err, ErrPositionGone) {
+			t.Fatalf("Expected ErrPositionGone after merges, got %v", err)
+		}
+		if err := follower.Clear(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := follow(t, leader, follower, LogPosition{}); err != nil {
+			t.Fatal(err)
+		}
+		if want, got := snapshot(t, leader), snapshot(t, follower); !reflect.DeepEqual(want, got) {
+			t.Errorf("Follower has %d keys after the resync, wanted %d", len(got), len(want))
+		}
+	})
+}
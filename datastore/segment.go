@@ -0,0 +1,158 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	headerMagic   = "KVSG"
+	formatVersion = 1
+	headerSize    = 16
+	upgradePrefix = "upgrade-"
+	newPrefix     = "new-"
+)
+
+var ErrUnsupportedVersion = errors.New("unsupported segment format version")
+
+var errNoHeader = errors.New("segment has no header")
+
+// header is written at the beginning of every segment file:
+// 4 bytes of magic, uint32 format version and int64 creation time in unix nanoseconds.
+type header struct {
+	version uint32
+	created time.Time
+}
+
+func newHeader() header {
+	return header{formatVersion, time.Now()}
+}
+
+func (h header) encode() []byte {
+	buffer := make([]byte, headerSize)
+	copy(buffer, headerMagic)
+	binary.LittleEndian.PutUint32(buffer[4:], h.version)
+	binary.LittleEndian.PutUint64(buffer[8:], uint64(h.created.UnixNano()))
+	return buffer
+}
+
+func readHeader(file io.ReaderAt) (header, error) {
+	buffer := make([]byte, headerSize)
+	if _, err := file.ReadAt(buffer, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return header{}, errNoHeader
+		}
+		return header{}, err
+	}
+	if string(buffer[:len(headerMagic)]) != headerMagic {
+		return header{}, errNoHeader
+	}
+	h := header{
+		version: binary.LittleEndian.Uint32(buffer[4:]),
+		created: time.Unix(0, int64(binary.LittleEndian.Uint64(buffer[8:]))),
+	}
+	if h.version == 0 || h.version > formatVersion {
+		return h, fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.version)
+	}
+	return h, nil
+}
+
+type segmentName struct {
+	id   int
+	path string
+}
+
+// listSegments returns segment files of the directory ordered by their id.
+func listSegments(fs FS, directory string) ([]segmentName, error) {
+	paths, err := fs.Glob(filepath.Join(directory, outFileBase+"*"))
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]segmentName, 0, len(paths))
+	for _, path := range paths {
+		id, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(path), outFileBase))
+		if err != nil || id < 0 {
+			return nil, errors.New("unexpected file " + path)
+		}
+		segments = append(segments, segmentName{id, path})
+	}
+	slices.SortFunc(segments, func(a, b segmentName) int {
+		return a.id - b.id
+	})
+	return segments, nil
+}
+
+// openSegment opens an existing segment and checks its header.
+// Headerless files written before the header was introduced are upgraded in place.
+func openSegment(fs FS, path string) (File, error) {
+	file, err := fs.OpenFile(path, os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = readHeader(file)
+	if errors.Is(err, errNoHeader) {
+		file.Close()
+		if err := upgradeLegacy(fs, path); err != nil {
+			return nil, err
+		}
+		return openSegment(fs, path)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// upgradeLegacy rewrites a headerless segment with a header. Like the last segment on
+// Open, a record torn by a crash at the end is dropped, a file without a single complete
+// record is not a segment.
+func upgradeLegacy(fs FS, path string) error {
+	file, err := fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	var end int64
+	for it := range iterateFrom(file, 0) {
+		end = it.offset + int64(it.size)
+	}
+	if end == 0 && stat.Size() > 0 {
+		return errors.New("not a datastore segment")
+	}
+
+	upgradePath := filepath.Join(filepath.Dir(path), upgradePrefix+filepath.Base(path))
+	upgraded, err := fs.OpenFile(upgradePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer fs.Remove(upgradePath)
+	if _, err := upgraded.Write(newHeader().encode()); err != nil {
+		upgraded.Close()
+		return err
+	}
+	if _, err := io.Copy(upgraded, io.NewSectionReader(file, 0, end)); err != nil {
+		upgraded.Close()
+		return err
+	}
+	if err := upgraded.Sync(); err != nil {
+		upgraded.Close()
+		return err
+	}
+	if err := upgraded.Close(); err != nil {
+		return err
+	}
+	return fs.Rename(upgradePath, path)
+}
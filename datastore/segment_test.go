@@ -0,0 +1,110 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSegment_Header(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(tmp, outFileBase+"0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw[:len(headerMagic)]) != headerMagic {
+		t.Errorf("Segment does not start with magic, got %q", raw[:len(headerMagic)])
+	}
+	if version := binary.LittleEndian.Uint32(raw[4:]); version != formatVersion {
+		t.Errorf("Bad format version %d", version)
+	}
+}
+
+func TestSegment_UpgradeLegacy(t *testing.T) {
+	tmp := t.TempDir()
+	var legacy []byte
+	legacy = append(legacy, Encode(entryRecord{"k1", []byte("v1")})...)
+	legacy = append(legacy, Encode(entryRecord{"k2", []byte("v2")})...)
+	legacy = append(legacy, Encode(deleteRecord("k1"))...)
+	complete := len(legacy)
+	// a record torn by a crash
+	legacy = append(legacy, Encode(entryRecord{"k3", []byte("v3")})[:7]...)
+	path := filepath.Join(tmp, outFileBase+"0")
+	if err := os.WriteFile(path, legacy, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	if value, err := db.Get("k2"); err != nil || value != "v2" {
+		t.Errorf("Get(k2) = %q, %v after upgrade", value, err)
+	}
+	if _, err := db.Get("k1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Deleted key is visible after upgrade")
+	}
+	if _, err := db.Get("k3"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Torn record is visible after upgrade")
+	}
+	if stat, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if stat.Size() != int64(headerSize+complete) {
+		t.Errorf("Segment has %d bytes, the torn tail was not dropped", stat.Size())
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := readHeader(file); err != nil {
+		t.Errorf("Segment was not upgraded: %s", err)
+	}
+}
+
+func TestSegment_Reject(t *testing.T) {
+	t.Run("foreign file", func(t *testing.T) {
+		tmp := t.TempDir()
+		path := filepath.Join(tmp, outFileBase+"0")
+		if err := os.WriteFile(path, []byte("definitely not a segment"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Open(tmp); err == nil {
+			t.Error("Foreign file was accepted")
+		}
+		raw, _ := os.ReadFile(path)
+		if string(raw) != "definitely not a segment" {
+			t.Error("Foreign file was modified")
+		}
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		tmp := t.TempDir()
+		h := newHeader()
+		h.version = formatVersion + 1
+		path := filepath.Join(tmp, outFileBase+"0")
+		if err := os.WriteFile(path, h.encode(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Open(tmp); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("Expected ErrUnsupportedVersion, got %v", err)
+		}
+	})
+}
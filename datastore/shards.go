@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	shardsFile = "shards"
+	shardBase  = "shard-"
+)
+
+var ErrShardCount = errors.New("data was written with a different shard count")
+
+// OpenShards opens count independent databases in subdirectories of the directory.
+// The count is saved on the first open, a different count is refused later,
+// because keys are placed into shards by their hash.
+// A single shard uses the directory itself, as Open does.
+func OpenShards(directory string, count int) ([]*Db, error) {
+	return OpenShardsWithOptions(directory, count, Options{})
+}
+
+// OpenShardsWithOptions opens the shards like OpenShards, every shard keeps to the options on its own.
+func OpenShardsWithOptions(directory string, count int, options Options) ([]*Db, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("invalid shard count %d", count)
+	}
+	saved, err := savedShardCount(directory)
+	if err != nil {
+		return nil, err
+	}
+	if saved != 0 && saved != count {
+		return nil, fmt.Errorf("%w: %d, requested %d", ErrShardCount, saved, count)
+	}
+	if count == 1 {
+		db, err := OpenWithOptions(directory, options)
+		if err != nil {
+			return nil, err
+		}
+		return []*Db{db}, nil
+	}
+	if err := os.MkdirAll(directory, 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(directory, shardsFile), []byte(strconv.Itoa(count)), 0o600); err != nil {
+		return nil, err
+	}
+
+	shards := make([]*Db, 0, count)
+	for i := range count {
+		db, err := OpenWithOptions(filepath.Join(directory, shardBase+strconv.Itoa(i)), options)
+		if err != nil {
+			for _, opened := range shards {
+				opened.Close()
+			}
+			return nil, err
+		}
+		shards = append(shards, db)
+	}
+	return shards, nil
+}
+
+// savedShardCount returns the count the data was written with,
+// the count of a new directory is unknown, so any count is accepted.
+func savedShardCount(directory string) (int, error) {
+	raw, err := os.ReadFile(filepath.Join(directory, shardsFile))
+	if err == nil {
+		return strconv.Atoi(strings.TrimSpace(string(raw)))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	segments, err := listSegments(OS, directory)
+	if err != nil {
+		return 0, err
+	}
+	if len(segments) > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,61 @@
+package datastore
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOpenShards(t *testing.T) {
+	tmp := t.TempDir()
+	shards, err := OpenShards(tmp, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, db := range shards {
+		if err := db.Put("key", string(rune('a'+i))); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := OpenShards(tmp, 2); !errors.Is(err, ErrShardCount) {
+		t.Errorf("Expected ErrShardCount, got %v", err)
+	}
+	if _, err := OpenShards(tmp, 1); !errors.Is(err, ErrShardCount) {
+		t.Errorf("Expected ErrShardCount for a single shard, got %v", err)
+	}
+
+	shards, err = OpenShards(tmp, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, db := range shards {
+		if value, _ := db.Get("key"); value != string(rune('a'+i)) {
+			t.Errorf("Shard %d is not independent, got %q", i, value)
+		}
+		db.Close()
+	}
+
+	t.Run("unsharded data", func(t *testing.T) {
+		tmp := t.TempDir()
+		db, err := Open(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = db.Put("key", "value")
+		db.Close()
+		if _, err := OpenShards(tmp, 4); !errors.Is(err, ErrShardCount) {
+			t.Errorf("Expected ErrShardCount, got %v", err)
+		}
+		shards, err := OpenShards(tmp, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, _ := shards[0].Get("key"); value != "value" {
+			t.Errorf("Get(key) = %q", value)
+		}
+		shards[0].Close()
+	})
+}
@@ -0,0 +1,51 @@
+package datastore
+
+import "time"
+
+// Stats describes the state of the database for monitoring.
+type Stats struct {
+	// Size is the total size of the segments in bytes
+	Size     int64
+	Segments int
+	// Keys counts the live keys of all buckets, expired keys are not counted
+	Keys          int
+	Merges        int
+	MergeDuration time.Duration
+	// FreeBytes is the space left on the filesystem of the database
+	FreeBytes uint64
+	ReadOnly  bool
+}
+
+// Stats returns the current size of the database and the totals of merges since it was opened.
+func (database *Db) Stats() (Stats, error) {
+	size, err := database.Size()
+	if err != nil {
+		return Stats{}, err
+	}
+	stats := Stats{
+		Size:          size,
+		Segments:      len(database.files),
+		Merges:        database.merges,
+		MergeDuration: database.mergeDuration,
+		ReadOnly:      database.readOnly,
+	}
+	if stats.FreeBytes, err = freeSpace(database.directory); err != nil {
+		return Stats{}, err
+	}
+	for _, keyStorage := range database.offset {
+		if !keyStorage.expired() {
+			stats.Keys++
+		}
+	}
+	return stats, nil
+}
+
+// Health returns only ReadOnly and FreeBytes of Stats, they are cheap to get
+// because neither the segments nor the keys are looked at.
+func (database *Db) Health() (Stats, error) {
+	free, err := freeSpace(database.directory)
+	if err != nil {
+		return Stats{}, err
+	}
+	return Stats{FreeBytes: free, ReadOnly: database.readOnly}, nil
+}
@@ -0,0 +1,122 @@
+package datastore
+
+import (
+	"errors"
+	"slices"
+)
+
+var ErrConflict = errors.New("transaction conflict")
+
+// Tx buffers the writes of a transaction and remembers versions of the keys it has read.
+// The commit fails with ErrConflict if any of those keys has changed since.
+type Tx struct {
+	get    func(key string) (string, uint64, error)
+	reads  map[string]uint64
+	writes map[string]*string
+}
+
+// NewTx creates a transaction reading through get, which returns the value with its version.
+func NewTx(get func(key string) (string, uint64, error)) *Tx {
+	return &Tx{
+		get:    get,
+		reads:  make(map[string]uint64),
+		writes: make(map[string]*string),
+	}
+}
+
+// Get returns the value written earlier in the transaction or the stored one.
+func (tx *Tx) Get(key string) (string, error) {
+	if value, written := tx.writes[key]; written {
+		if value == nil {
+			return "", ErrNotFound
+		}
+		return *value, nil
+	}
+	value, version, err := tx.get(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", err
+	}
+	if _, read := tx.reads[key]; !read {
+		tx.reads[key] = version
+	}
+	return value, err
+}
+
+func (tx *Tx) Put(key, value string) {
+	tx.writes[key] = &value
+}
+
+func (tx *Tx) Delete(key string) {
+	tx.writes[key] = nil
+}
+
+// Expect makes the commit fail unless the key still has the version.
+// It is used when the value was read outside of the transaction, version 0 means a missing key.
+func (tx *Tx) Expect(key string, version uint64) {
+	tx.reads[key] = version
+}
+
+// Keys returns the sorted keys the transaction has read or written.
+func (tx *Tx) Keys() []string {
+	keys := make([]string, 0, len(tx.reads)+len(tx.writes))
+	for key := range tx.reads {
+		keys = append(keys, key)
+	}
+	for key := range tx.writes {
+		if _, read := tx.reads[key]; !read {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// GetVersioned returns the value with its current version.
+func (database *Db) GetVersioned(key string) (string, uint64, error) {
+	value, err := database.Get(key)
+	if err != nil {
+		return "", 0, err
+	}
+	return value, database.offset[recordKey{0, key}].version, nil
+}
+
+// Update runs fn in a transaction and commits it if fn returns no error.
+func (database *Db) Update(fn func(tx *Tx) error) error {
+	tx := NewTx(database.GetVersioned)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return database.Commit(tx)
+}
+
+// Commit checks the versions read by the transaction and writes
+// all of its changes as a single batch record.
+func (database *Db) Commit(tx *Tx) error {
+	for key, version := range tx.reads {
+		current := database.offset[recordKey{0, key}]
+		if current.expired() {
+			current.version = 0
+		}
+		if current.version != version {
+			return ErrConflict
+		}
+	}
+	keys := make([]string, 0, len(tx.writes))
+	for key := range tx.writes {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	records := make([]record, 0, len(keys))
+	for _, key := range keys {
+		if value := tx.writes[key]; value != nil {
+			records = append(records, entryRecord{key, []byte(*value)})
+		} else if _, exists := database.offset[recordKey{0, key}]; exists {
+			records = append(records, deleteRecord(key))
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return database.putEntry(newBatch(records))
+}
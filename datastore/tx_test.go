@@ -0,0 +1,143 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestTx(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	_ = db.Put("from", "10")
+	_ = db.Put("to", "0")
+
+	t.Run("commit", func(t *testing.T) {
+		err := db.Update(func(tx *Tx) error {
+			if _, err := tx.Get("from"); err != nil {
+				return err
+			}
+			tx.Put("from", "5")
+			tx.Put("to", "5")
+			tx.Delete("missing")
+			if value, _ := tx.Get("to"); value != "5" {
+				t.Errorf("Transaction does not see its own write, got %q", value)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, expected := range map[string]string{"from": "5", "to": "5"} {
+			if value, _ := db.Get(key); value != expected {
+				t.Errorf("Get(%q) = %q, wanted %q", key, value, expected)
+			}
+		}
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		tx := NewTx(db.GetVersioned)
+		if _, err := tx.Get("from"); err != nil {
+			t.Fatal(err)
+		}
+		tx.Put("to", "changed")
+		_ = db.Put("from", "concurrent")
+		if err := db.Commit(tx); !errors.Is(err, ErrConflict) {
+			t.Errorf("Expected ErrConflict, got %v", err)
+		}
+		if value, _ := db.Get("to"); value != "5" {
+			t.Errorf("Write of a conflicting transaction is visible, got %q", value)
+		}
+	})
+
+	t.Run("expect", func(t *testing.T) {
+		_, version, err := db.GetVersioned("to")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := NewTx(db.GetVersioned)
+		tx.Expect("to", version)
+		tx.Expect("missing", 0)
+		tx.Put("to", "6")
+		if err := db.Commit(tx); err != nil {
+			t.Errorf("Cannot commit with actual versions: %s", err)
+		}
+		tx = NewTx(db.GetVersioned)
+		tx.Expect("to", version)
+		if err := db.Commit(tx); !errors.Is(err, ErrConflict) {
+			t.Errorf("Expected ErrConflict for a stale version, got %v", err)
+		}
+	})
+
+	t.Run("torn batch", func(t *testing.T) {
+		err := db.Update(func(tx *Tx) error {
+			tx.Put("from", "torn")
+			tx.Put("to", "torn")
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		active := db.files[len(db.files)-1]
+		stat, err := active.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// cut the last byte of the batch as if the process crashed during the write
+		if err := os.Truncate(active.Name(), stat.Size()-1); err != nil {
+			t.Fatal(err)
+		}
+		db, err = Open(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, expected := range map[string]string{"from": "concurrent", "to": "6"} {
+			if value, _ := db.Get(key); value != expected {
+				t.Errorf("Get(%q) = %q after a torn batch, wanted %q", key, value, expected)
+			}
+		}
+		_ = db.Put("after", "ok")
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = Open(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, _ := db.Get("after"); value != "ok" {
+			t.Errorf("Write after a torn batch was lost, got %q", value)
+		}
+	})
+
+	t.Run("versions after reopen", func(t *testing.T) {
+		_, before, err := db.GetVersioned("after")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = Open(tmp); err != nil {
+			t.Fatal(err)
+		}
+		// the replay gives out versions again, they must not repeat the old ones
+		if _, after, _ := db.GetVersioned("after"); after <= before {
+			t.Errorf("Version %d after reopen is not newer than %d", after, before)
+		}
+		tx := NewTx(db.GetVersioned)
+		tx.Expect("after", before)
+		tx.Put("after", "stale")
+		if err := db.Commit(tx); !errors.Is(err, ErrConflict) {
+			t.Errorf("Version from before reopen was accepted, error %v", err)
+		}
+	})
+}
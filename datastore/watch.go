@@ -0,0 +1,138 @@
+package datastore
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+const (
+	// watchHistory is the number of recent events kept for the watchers that resume
+	watchHistory = 1024
+	// watchBuffer is the number of events a watcher may fall behind by before it is dropped
+	watchBuffer = 256
+)
+
+// ErrHistoryGone is returned for positions older than the kept events and for positions
+// ahead of the current version, which were given out before the database was reopened.
+var ErrHistoryGone = errors.New("events after the position are no longer kept")
+
+// Event is a put or a delete of a root key. Version is the position of the event,
+// it grows with every change and, like the versions of keys, is only meaningful while
+// the database is open. Value is empty for deletes. Db does not keep the values written
+// with PutStream in memory, their events are Streamed and the reader fetches them with GetStream.
+type Event struct {
+	Key      string
+	Value    string
+	Version  uint64
+	Deleted  bool
+	Streamed bool
+}
+
+type watcher struct {
+	prefix string
+	events chan Event
+}
+
+// watchers delivers events to the subscribed channels and keeps the recent ones.
+// Events are published by the writer, subscriptions may end from any goroutine.
+type watchers struct {
+	mutex   sync.Mutex
+	active  map[*watcher]struct{}
+	history []Event
+	// forgotten is the version of the last event that is not in the history
+	forgotten uint64
+}
+
+func (hub *watchers) publish(event Event) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if len(hub.history) == watchHistory {
+		hub.forgotten = hub.history[0].Version
+		hub.history = hub.history[1:]
+	}
+	hub.history = append(hub.history, event)
+	for watcher := range hub.active {
+		if !strings.HasPrefix(event.Key, watcher.prefix) {
+			continue
+		}
+		select {
+		case watcher.events <- event:
+		default:
+			// the reader is too slow, it has to resume from the last event it got
+			delete(hub.active, watcher)
+			close(watcher.events)
+		}
+	}
+}
+
+func (database *Db) publish(event Event) {
+	if database.watchers != nil {
+		database.watchers.publish(event)
+	}
+}
+
+func (hub *watchers) watch(prefix string, position, current uint64) (<-chan Event, func(), error) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if position < hub.forgotten || position > current {
+		return nil, nil, ErrHistoryGone
+	}
+	var missed []Event
+	for _, event := range hub.history {
+		if event.Version > position && strings.HasPrefix(event.Key, prefix) {
+			missed = append(missed, event)
+		}
+	}
+	subscribed := &watcher{prefix, make(chan Event, watchBuffer+len(missed))}
+	for _, event := range missed {
+		subscribed.events <- event
+	}
+	if hub.active == nil {
+		hub.active = make(map[*watcher]struct{})
+	}
+	hub.active[subscribed] = struct{}{}
+	cancel := func() {
+		hub.mutex.Lock()
+		defer hub.mutex.Unlock()
+		if _, exists := hub.active[subscribed]; exists {
+			delete(hub.active, subscribed)
+			close(subscribed.events)
+		}
+	}
+	return subscribed.events, cancel, nil
+}
+
+// Watch returns a channel of the changes of root keys starting with the prefix
+// and a function that ends the subscription. Expiration of keys is not reported.
+// The channel is closed when the subscription ends or the reader falls too far behind,
+// the reader may then continue with WatchFrom and the version of the last event it got.
+func (database *Db) Watch(prefix string) (<-chan Event, func()) {
+	events, cancel, _ := database.watchers.watch(prefix, database.version, database.version)
+	return events, cancel
+}
+
+// WatchFrom is Watch that first delivers the kept events after the position.
+// It fails with ErrHistoryGone if some of them are no longer kept
+// or the position is ahead of the current version.
+func (database *Db) WatchFrom(prefix string, position uint64) (<-chan Event, func(), error) {
+	return database.watchers.watch(prefix, position, database.version)
+}
+
+// Position returns the version of the last change, watching from it gives the changes after now.
+func (database *Db) Position() uint64 {
+	return database.version
+}
+
+func (memory *Memory) Watch(prefix string) (<-chan Event, func()) {
+	events, cancel, _ := memory.watchers.watch(prefix, memory.version, memory.version)
+	return events, cancel
+}
+
+func (memory *Memory) WatchFrom(prefix string, position uint64) (<-chan Event, func(), error) {
+	return memory.watchers.watch(prefix, position, memory.version)
+}
+
+func (memory *Memory) Position() uint64 {
+	return memory.version
+}
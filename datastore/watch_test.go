@@ -0,0 +1,131 @@
+package datastore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func receive(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	default:
+		t.Fatal("No event")
+		return Event{}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	if err := db.Put("user:1", "before"); err != nil {
+		t.Fatal(err)
+	}
+
+	events, cancel := db.Watch("user:")
+	_ = db.Put("user:1", "a")
+	_ = db.Put("order:1", "b")
+	_ = db.PutIn("bucket", "user:2", "c")
+	_ = db.Update(func(tx *Tx) error {
+		tx.Put("user:2", "d")
+		tx.Delete("user:1")
+		return nil
+	})
+
+	put := receive(t, events)
+	if put.Key != "user:1" || put.Value != "a" || put.Deleted {
+		t.Errorf("Unexpected event %+v", put)
+	}
+	if _, version, _ := db.GetVersioned("user:1"); version != 0 && version != put.Version {
+		t.Errorf("Event version %d differs from the key version %d", put.Version, version)
+	}
+	// a transaction writes its keys in the sorted order
+	batched := []Event{receive(t, events), receive(t, events)}
+	if batched[0].Key != "user:1" || !batched[0].Deleted {
+		t.Errorf("Unexpected event %+v", batched[0])
+	}
+	if batched[1].Key != "user:2" || batched[1].Value != "d" || batched[1].Version <= batched[0].Version {
+		t.Errorf("Unexpected event %+v", batched[1])
+	}
+	if len(events) != 0 {
+		t.Errorf("Events of other prefixes or buckets were delivered")
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		streams, cancelStreams := db.Watch("large")
+		defer cancelStreams()
+		_ = db.PutStream("large", strings.NewReader(""), 0)
+		_ = db.Put("large", "")
+		if event := receive(t, streams); !event.Streamed || event.Value != "" {
+			t.Errorf("Streamed put gave %+v", event)
+		}
+		if event := receive(t, streams); event.Streamed {
+			t.Errorf("Put of an empty value is reported as streamed")
+		}
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		resumed, cancelResumed, err := db.WatchFrom("user:", put.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cancelResumed()
+		if event := receive(t, resumed); event != batched[0] {
+			t.Errorf("Resumed with %+v, wanted %+v", event, batched[0])
+		}
+		if event := receive(t, resumed); event != batched[1] {
+			t.Errorf("Resumed with %+v, wanted %+v", event, batched[1])
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		cancel()
+		cancel()
+		if _, open := <-events; open {
+			t.Errorf("Channel was not closed")
+		}
+	})
+
+	t.Run("slow watcher", func(t *testing.T) {
+		slow, cancelSlow := db.Watch("")
+		defer cancelSlow()
+		for range watchBuffer + 1 {
+			if err := db.Put("key", "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		received := 0
+		for range slow {
+			received++
+		}
+		if received != watchBuffer {
+			t.Errorf("Slow watcher got %d events before it was dropped", received)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = Open(db.directory); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := db.WatchFrom("", put.Version); !errors.Is(err, ErrHistoryGone) {
+			t.Errorf("Events from before Open were resumed, error %v", err)
+		}
+		// the version starts over on Open, a position given out before may be ahead of it
+		if _, _, err := db.WatchFrom("", db.Position()+1); !errors.Is(err, ErrHistoryGone) {
+			t.Errorf("Watched from a position ahead of the version, error %v", err)
+		}
+		if _, _, err := db.WatchFrom("", db.Position()); err != nil {
+			t.Errorf("Cannot watch from the current position: %s", err)
+		}
+	})
+}
@@ -0,0 +1,223 @@
+package dbwire
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("key not found")
+	ErrClosed   = errors.New("client is closed")
+)
+
+// ServerError is an error reported by the server.
+type ServerError string
+
+func (err ServerError) Error() string {
+	return "database: " + string(err)
+}
+
+// Client sends the requests of all its callers over one persistent connection.
+// A broken connection fails the requests waiting on it, the next request dials again.
+type Client struct {
+	address     string
+	dialTimeout time.Duration
+
+	mutex      sync.Mutex
+	connection *connection
+	closed     bool
+}
+
+type answer struct {
+	response Response
+	err      error
+}
+
+type connection struct {
+	conn net.Conn
+
+	writeMutex sync.Mutex
+	writer     *bufio.Writer
+
+	mutex   sync.Mutex
+	pending map[uint32]chan answer
+	nextID  uint32
+	// err is set when the connection is broken
+	err error
+}
+
+// New returns a client of the binary port of the database, it connects on the first request.
+func New(address string) *Client {
+	return &Client{address: address, dialTimeout: 5 * time.Second}
+}
+
+// Dial returns a client that is already connected to the binary port of the database.
+func Dial(address string) (*Client, error) {
+	client := New(address)
+	if _, err := client.connect(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// connect returns the open connection or dials a new one if it is broken.
+func (client *Client) connect() (*connection, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.closed {
+		return nil, ErrClosed
+	}
+	if client.connection != nil && client.connection.broken() == nil {
+		return client.connection, nil
+	}
+	conn, err := net.DialTimeout("tcp", client.address, client.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	client.connection = &connection{
+		conn:    conn,
+		writer:  bufio.NewWriter(conn),
+		pending: make(map[uint32]chan answer),
+	}
+	go client.connection.read()
+	return client.connection, nil
+}
+
+// Close closes the connection, the requests waiting for answers fail with ErrClosed.
+func (client *Client) Close() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.closed = true
+	if client.connection == nil || client.connection.broken() != nil {
+		return nil
+	}
+	client.connection.fail(ErrClosed)
+	return client.connection.conn.Close()
+}
+
+func (c *connection) broken() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+// fail breaks the connection and fails all requests that wait for answers.
+func (c *connection) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	for id, waiting := range c.pending {
+		waiting <- answer{err: err}
+		delete(c.pending, id)
+	}
+	_ = c.conn.Close()
+}
+
+// read delivers the responses to the requests waiting for them.
+func (c *connection) read() {
+	reader := bufio.NewReader(c.conn)
+	for {
+		response, err := ReadResponse(reader)
+		if err != nil {
+			c.fail(fmt.Errorf("connection to the database is broken: %w", err))
+			return
+		}
+		c.mutex.Lock()
+		waiting, found := c.pending[response.ID]
+		delete(c.pending, response.ID)
+		c.mutex.Unlock()
+		// the caller may have given up on the request already
+		if found {
+			waiting <- answer{response: response}
+		}
+	}
+}
+
+// send writes the request with a new id and returns the id and the channel of the answer.
+func (c *connection) send(request Request) (uint32, chan answer, error) {
+	waiting := make(chan answer, 1)
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return 0, nil, c.err
+	}
+	c.nextID++
+	request.ID = c.nextID
+	c.pending[request.ID] = waiting
+	c.mutex.Unlock()
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	err := WriteRequest(c.writer, request)
+	if err == nil {
+		err = c.writer.Flush()
+	}
+	if err != nil {
+		c.fail(err)
+	}
+	return request.ID, waiting, nil
+}
+
+func (c *connection) forget(id uint32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.pending, id)
+}
+
+func (client *Client) do(ctx context.Context, request Request) (Response, error) {
+	c, err := client.connect()
+	if err != nil {
+		return Response{}, err
+	}
+	id, waiting, err := c.send(request)
+	if err != nil {
+		return Response{}, err
+	}
+	select {
+	case answer := <-waiting:
+		if answer.err != nil {
+			return Response{}, answer.err
+		}
+		switch answer.response.Status {
+		case StatusOK:
+			return answer.response, nil
+		case StatusNotFound:
+			return Response{}, ErrNotFound
+		default:
+			return Response{}, ServerError(answer.response.Value)
+		}
+	case <-ctx.Done():
+		c.forget(id)
+		return Response{}, ctx.Err()
+	}
+}
+
+func (client *Client) Ping(ctx context.Context) error {
+	_, err := client.do(ctx, Request{Op: OpPing})
+	return err
+}
+
+// Get returns the value of the key or ErrNotFound.
+func (client *Client) Get(ctx context.Context, key string) (string, error) {
+	response, err := client.do(ctx, Request{Op: OpGet, Key: key})
+	return string(response.Value), err
+}
+
+func (client *Client) Put(ctx context.Context, key, value string) error {
+	_, err := client.do(ctx, Request{Op: OpPut, Key: key, Value: []byte(value)})
+	return err
+}
+
+// Delete removes the key, it fails with ErrNotFound if the key does not exist.
+func (client *Client) Delete(ctx context.Context, key string) error {
+	_, err := client.do(ctx, Request{Op: OpDelete, Key: key})
+	return err
+}
@@ -0,0 +1,137 @@
+package dbwire
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFrames(t *testing.T) {
+	var buffer bytes.Buffer
+	request := Request{ID: 7, Op: OpPut, Key: "key", Value: []byte{0, 1, 2}}
+	if err := WriteRequest(&buffer, request); err != nil {
+		t.Fatal(err)
+	}
+	if read, err := ReadRequest(&buffer); err != nil || !reflect.DeepEqual(read, request) {
+		t.Errorf("Read %+v, %v, wanted %+v", read, err, request)
+	}
+	response := Response{ID: 7, Status: StatusError, Value: []byte("message")}
+	if err := WriteResponse(&buffer, response); err != nil {
+		t.Fatal(err)
+	}
+	if read, err := ReadResponse(&buffer); err != nil || !reflect.DeepEqual(read, response) {
+		t.Errorf("Read %+v, %v, wanted %+v", read, err, response)
+	}
+	if _, err := ReadRequest(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})); !errors.Is(err, ErrFrameSize) {
+		t.Errorf("Oversized frame gave %v", err)
+	}
+	if _, err := ReadRequest(bytes.NewReader([]byte{0, 0, 0, 7, 0, 0, 0, 1, 2, 0, 9})); err == nil {
+		t.Error("Key longer than the frame was accepted")
+	}
+}
+
+// fakeServer answers the requests of a connection in reverse order once it has count of them.
+func fakeServer(t *testing.T, count int) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer connection.Close()
+				reader := bufio.NewReader(connection)
+				var requests []Request
+				for len(requests) < count {
+					request, err := ReadRequest(reader)
+					if err != nil {
+						return
+					}
+					requests = append(requests, request)
+				}
+				for i := len(requests) - 1; i >= 0; i-- {
+					response := Response{ID: requests[i].ID, Status: StatusOK, Value: []byte(requests[i].Key)}
+					if requests[i].Key == "missing" {
+						response.Status = StatusNotFound
+					}
+					_ = WriteResponse(connection, response)
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestClient_Multiplexing(t *testing.T) {
+	listener := fakeServer(t, 3)
+	client, err := Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	type result struct {
+		key, value string
+		err        error
+	}
+	results := make(chan result)
+	for _, key := range []string{"a", "b", "missing"} {
+		go func() {
+			value, err := client.Get(context.Background(), key)
+			results <- result{key, value, err}
+		}()
+	}
+	for range 3 {
+		got := <-results
+		switch {
+		case got.key == "missing" && !errors.Is(got.err, ErrNotFound):
+			t.Errorf("Missing key gave %q, %v", got.value, got.err)
+		case got.key != "missing" && (got.err != nil || got.value != got.key):
+			t.Errorf("Get(%s) got the answer %q, %v", got.key, got.value, got.err)
+		}
+	}
+}
+
+func TestClient_BrokenConnection(t *testing.T) {
+	// the server answers only after the second request and closes the connection then
+	listener := fakeServer(t, 2)
+	client := New(listener.Addr().String())
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.Get(ctx, "abandoned"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Get without an answer gave %v", err)
+	}
+	if value, err := client.Get(context.Background(), "second"); err != nil || value != "second" {
+		t.Errorf("Get after an abandoned request gave %q, %v", value, err)
+	}
+
+	listener.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for client.connection.broken() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := client.Ping(context.Background()); err == nil {
+		t.Error("Request after the server has gone succeeded")
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Request after Close gave %v", err)
+	}
+}
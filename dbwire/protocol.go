@@ -0,0 +1,136 @@
+// Package dbwire is the binary protocol of the database server and its Go client.
+//
+// Every frame is a 4-byte big-endian length followed by that many bytes.
+// A request frame holds the request id (4 bytes), the operation (1 byte),
+// the key length (2 bytes), the key and the value. A response frame holds
+// the id of the request, the status (1 byte) and the value or the error message.
+// A connection carries many requests at once, the server answers them
+// in any order and the ids pair the responses with the requests.
+package dbwire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+type Op byte
+
+const (
+	OpPing Op = iota + 1
+	OpGet
+	OpPut
+	OpDelete
+)
+
+type Status byte
+
+const (
+	StatusOK Status = iota
+	StatusNotFound
+	StatusError
+)
+
+// MaxFrame is the largest frame a peer accepts, it limits the size of a value.
+const MaxFrame = 64 << 20
+
+const (
+	requestHeaderSize  = 4 + 1 + 2
+	responseHeaderSize = 4 + 1
+)
+
+var ErrFrameSize = errors.New("frame size is out of range")
+
+type Request struct {
+	ID    uint32
+	Op    Op
+	Key   string
+	Value []byte
+}
+
+type Response struct {
+	ID     uint32
+	Status Status
+	// Value is the value of a get or the message of StatusError
+	Value []byte
+}
+
+func readFrame(reader io.Reader, minimum int) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size < uint32(minimum) || size > MaxFrame {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameSize, size)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func ReadRequest(reader io.Reader) (Request, error) {
+	frame, err := readFrame(reader, requestHeaderSize)
+	if err != nil {
+		return Request{}, err
+	}
+	keyLength := int(binary.BigEndian.Uint16(frame[5:7]))
+	if requestHeaderSize+keyLength > len(frame) {
+		return Request{}, errors.New("key is longer than the frame")
+	}
+	return Request{
+		ID:    binary.BigEndian.Uint32(frame[:4]),
+		Op:    Op(frame[4]),
+		Key:   string(frame[requestHeaderSize : requestHeaderSize+keyLength]),
+		Value: frame[requestHeaderSize+keyLength:],
+	}, nil
+}
+
+func WriteRequest(writer io.Writer, request Request) error {
+	if len(request.Key) > math.MaxUint16 {
+		return errors.New("key is longer than 65535 bytes")
+	}
+	size := requestHeaderSize + len(request.Key) + len(request.Value)
+	if size > MaxFrame {
+		return fmt.Errorf("%w: %d bytes", ErrFrameSize, size)
+	}
+	frame := make([]byte, 4, 4+size)
+	binary.BigEndian.PutUint32(frame, uint32(size))
+	frame = binary.BigEndian.AppendUint32(frame, request.ID)
+	frame = append(frame, byte(request.Op))
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(request.Key)))
+	frame = append(frame, request.Key...)
+	frame = append(frame, request.Value...)
+	_, err := writer.Write(frame)
+	return err
+}
+
+func ReadResponse(reader io.Reader) (Response, error) {
+	frame, err := readFrame(reader, responseHeaderSize)
+	if err != nil {
+		return Response{}, err
+	}
+	return Response{
+		ID:     binary.BigEndian.Uint32(frame[:4]),
+		Status: Status(frame[4]),
+		Value:  frame[responseHeaderSize:],
+	}, nil
+}
+
+func WriteResponse(writer io.Writer, response Response) error {
+	size := responseHeaderSize + len(response.Value)
+	if size > MaxFrame {
+		return fmt.Errorf("%w: %d bytes", ErrFrameSize, size)
+	}
+	frame := make([]byte, 4, 4+size)
+	binary.BigEndian.PutUint32(frame, uint32(size))
+	frame = binary.BigEndian.AppendUint32(frame, response.ID)
+	frame = append(frame, byte(response.Status))
+	frame = append(frame, response.Value...)
+	_, err := writer.Write(frame)
+	return err
+}
@@ -0,0 +1,53 @@
+package httptools
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Check tests a part of the service and returns nil when it is healthy.
+type Check func(ctx context.Context) error
+
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthHandler runs the checks concurrently and answers 200 if all of them pass
+// within the timeout and 503 otherwise, with the result of every check:
+//
+//	{"status": "failing", "checks": {"disk": {"status": "ok"}, "queue": {"status": "failing", "error": "..."}}}
+func HealthHandler(timeout time.Duration, checks map[string]Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		var mutex sync.Mutex
+		var wait sync.WaitGroup
+		results := make(map[string]checkResult, len(checks))
+		status, code := "ok", http.StatusOK
+		for name, check := range checks {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				result := checkResult{Status: "ok"}
+				if err := check(ctx); err != nil {
+					result = checkResult{Status: "failing", Error: err.Error()}
+				}
+				mutex.Lock()
+				defer mutex.Unlock()
+				results[name] = result
+				if err := result.Error; err != "" {
+					status, code = "failing", http.StatusServiceUnavailable
+				}
+			}()
+		}
+		wait.Wait()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(map[string]any{"status": status, "checks": results})
+	})
+}
@@ -1,6 +1,8 @@
 package httptools
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,6 +11,7 @@ import (
 
 type Server interface {
 	Start()
+	Shutdown(ctx context.Context) error
 }
 
 type server struct {
@@ -19,10 +22,18 @@ func (s server) Start() {
 	go func() {
 		log.Println("Staring the HTTP server...")
 		err := s.httpServer.ListenAndServe()
+		if errors.Is(err, http.ErrServerClosed) {
+			return
+		}
 		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
 	}()
 }
 
+// Shutdown stops accepting connections and waits for the active requests.
+func (s server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
 func CreateServer(port int, handler http.Handler) Server {
 	return server{
 		httpServer: &http.Server{
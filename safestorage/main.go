@@ -1,61 +1,480 @@
 package safestorage
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+)
+
 type Storage interface {
 	Put(key, value string) error
 	Get(key string) (string, error)
+	PutBytes(key string, value []byte) error
+	GetBytes(key string) ([]byte, error)
+	Delete(key string) error
+	Increment(key string, delta int64) (int64, error)
+	Append(key, suffix string) error
+	PutStream(key string, reader io.Reader, size int64) error
+	GetStream(key string) (io.ReadCloser, error)
+	GetIn(bucket, key string) (string, error)
+	PutIn(bucket, key, value string) error
+	ScanIn(bucket, prefix string) ([]string, error)
+	ScanAfter(bucket, after string, limit int) ([]string, error)
+	DeleteIn(bucket, key string) error
+	DropBucket(name string) error
+	GetVersioned(key string) (string, uint64, error)
+	Commit(tx *datastore.Tx) error
+	RegisterIndex(name, path string) error
+	QueryIndex(name, value string) ([]string, error)
+	PutWithTTL(key, value string, ttl time.Duration) error
+	WatchFrom(prefix string, position uint64) (<-chan datastore.Event, func(), error)
+	Position() uint64
+	Sync() error
+	Close() error
 }
 
+var ErrClosed = errors.New("storage is closed")
+
 type result struct {
-	value string
-	err error
+	value    string
+	version  uint64
+	counter  int64
+	data     []byte
+	stream   io.ReadCloser
+	keys     []string
+	events   <-chan datastore.Event
+	cancel   func()
+	next     datastore.LogPosition
+	end      datastore.LogPosition
+	stats    datastore.Stats
+	segments []datastore.SegmentStats
+	err      error
 }
 
 type command struct {
 	action, key, value string
-	result chan result
+	bucket             string
+	data               []byte
+	reader             io.Reader
+	size               int64
+	delta              int64
+	limit              int
+	ttl                time.Duration
+	tx                 *datastore.Tx
+	position           uint64
+	resume             bool
+	readOnly           bool
+	logPosition        datastore.LogPosition
+	ctx                context.Context
+	result             chan result
 }
 
+// SafeStorage serializes access to the storage through a worker goroutine.
+// A sharded storage runs a worker per shard, see InitSharded.
 type SafeStorage struct {
-	Storage Storage
-	commands chan command	
+	shards []chan command
+	ctx    context.Context
+	state  *state
 }
 
-var cases = map[string] func(Storage, command) result {
+// state is shared by all views of the storage.
+type state struct {
+	// senders hold the read lock while queueing a command, so Close
+	// waits for the commands that are already on their way
+	mutex  sync.RWMutex
+	closed bool
+	done   chan error
+	// queued counts the commands waiting for the worker of every shard
+	queued []atomic.Int64
+}
+
+var cases = map[string]func(Storage, command) result{
 	"get": func(storage Storage, cmd command) result {
 		value, err := storage.Get(cmd.key)
-		return result{ value, err }
+		return result{value: value, err: err}
 	},
 	"put": func(storage Storage, cmd command) result {
 		err := storage.Put(cmd.key, cmd.value)
-		return result{ "", err }
+		return result{err: err}
+	},
+	"getBytes": func(storage Storage, cmd command) result {
+		data, err := storage.GetBytes(cmd.key)
+		return result{data: data, err: err}
+	},
+	"putBytes": func(storage Storage, cmd command) result {
+		err := storage.PutBytes(cmd.key, cmd.data)
+		return result{err: err}
+	},
+	"delete": func(storage Storage, cmd command) result {
+		err := storage.Delete(cmd.key)
+		return result{err: err}
+	},
+	"increment": func(storage Storage, cmd command) result {
+		counter, err := storage.Increment(cmd.key, cmd.delta)
+		return result{counter: counter, err: err}
+	},
+	"append": func(storage Storage, cmd command) result {
+		err := storage.Append(cmd.key, cmd.value)
+		return result{err: err}
+	},
+	"getStream": func(storage Storage, cmd command) result {
+		stream, err := storage.GetStream(cmd.key)
+		return result{stream: stream, err: err}
+	},
+	"putStream": func(storage Storage, cmd command) result {
+		err := storage.PutStream(cmd.key, cmd.reader, cmd.size)
+		return result{err: err}
+	},
+	"getIn": func(storage Storage, cmd command) result {
+		value, err := storage.GetIn(cmd.bucket, cmd.key)
+		return result{value: value, err: err}
+	},
+	"putIn": func(storage Storage, cmd command) result {
+		err := storage.PutIn(cmd.bucket, cmd.key, cmd.value)
+		return result{err: err}
+	},
+	"deleteIn": func(storage Storage, cmd command) result {
+		err := storage.DeleteIn(cmd.bucket, cmd.key)
+		return result{err: err}
+	},
+	"dropBucket": func(storage Storage, cmd command) result {
+		err := storage.DropBucket(cmd.bucket)
+		return result{err: err}
+	},
+	"scanIn": func(storage Storage, cmd command) result {
+		keys, err := storage.ScanIn(cmd.bucket, cmd.key)
+		return result{keys: keys, err: err}
+	},
+	"scanAfter": func(storage Storage, cmd command) result {
+		keys, err := storage.ScanAfter(cmd.bucket, cmd.key, cmd.limit)
+		return result{keys: keys, err: err}
+	},
+	"getVersioned": func(storage Storage, cmd command) result {
+		value, version, err := storage.GetVersioned(cmd.key)
+		return result{value: value, version: version, err: err}
+	},
+	"commit": func(storage Storage, cmd command) result {
+		err := storage.Commit(cmd.tx)
+		return result{err: err}
+	},
+	"putWithTTL": func(storage Storage, cmd command) result {
+		err := storage.PutWithTTL(cmd.key, cmd.value, cmd.ttl)
+		return result{err: err}
+	},
+	"registerIndex": func(storage Storage, cmd command) result {
+		err := storage.RegisterIndex(cmd.key, cmd.value)
+		return result{err: err}
+	},
+	"queryIndex": func(storage Storage, cmd command) result {
+		keys, err := storage.QueryIndex(cmd.key, cmd.value)
+		return result{keys: keys, err: err}
+	},
+	"watch": func(storage Storage, cmd command) result {
+		position := cmd.position
+		if !cmd.resume {
+			position = storage.Position()
+		}
+		events, cancel, err := storage.WatchFrom(cmd.key, position)
+		return result{events: events, cancel: cancel, version: position, err: err}
 	},
 }
 
 func Init(storage Storage) *SafeStorage {
-	safeStorage := SafeStorage{ storage, make(chan command) }
-	go func ()  {
-		for cmd := range safeStorage.commands {
-			produce, exists := cases[cmd.action]
-			if exists {
-				cmd.result <- produce(storage, cmd)
-			}
-		}
-	}()
+	return InitSharded([]Storage{storage})
+}
+
+// InitSharded runs a worker per storage. Keys are routed to the shards by hash,
+// so commands of the same key are applied in order by the same worker.
+func InitSharded(storages []Storage) *SafeStorage {
+	safeStorage := SafeStorage{
+		shards: make([]chan command, len(storages)),
+		ctx:    context.Background(),
+		state:  &state{done: make(chan error, len(storages)), queued: make([]atomic.Int64, len(storages))},
+	}
+	for i, storage := range storages {
+		commands := make(chan command)
+		safeStorage.shards[i] = commands
+		go work(storage, commands, &safeStorage.state.queued[i], safeStorage.state.done)
+	}
 	return &safeStorage
 }
 
+func work(storage Storage, commands chan command, queued *atomic.Int64, done chan error) {
+	for cmd := range commands {
+		queued.Add(-1)
+		// the caller has already given up, do not apply its command
+		if err := cmd.ctx.Err(); err != nil {
+			cmd.result <- result{err: err}
+			continue
+		}
+		produce, exists := cases[cmd.action]
+		if exists {
+			cmd.result <- produce(storage, cmd)
+		} else {
+			cmd.result <- result{err: errors.New("unknown command " + cmd.action)}
+		}
+	}
+	done <- errors.Join(storage.Sync(), storage.Close())
+}
+
+// Close stops accepting commands, waits for the queued ones and then syncs
+// and closes the underlying storage. Later calls fail with ErrClosed.
+func (safeStorage *SafeStorage) Close() error {
+	safeStorage.state.mutex.Lock()
+	if safeStorage.state.closed {
+		safeStorage.state.mutex.Unlock()
+		return ErrClosed
+	}
+	safeStorage.state.closed = true
+	for _, commands := range safeStorage.shards {
+		close(commands)
+	}
+	safeStorage.state.mutex.Unlock()
+	var errs []error
+	for range safeStorage.shards {
+		errs = append(errs, <-safeStorage.state.done)
+	}
+	return errors.Join(errs...)
+}
+
+// WithContext returns a view of the storage whose commands give up with the context error
+// when ctx is done, both while waiting in the queue and for the result.
+// A command that has already reached the worker may still be applied.
+func (safeStorage *SafeStorage) WithContext(ctx context.Context) *SafeStorage {
+	view := *safeStorage
+	view.ctx = ctx
+	return &view
+}
+
+func (safeStorage *SafeStorage) execute(cmd command) result {
+	return safeStorage.executeOn(safeStorage.shardOf(cmd.key), cmd)
+}
+
+func (safeStorage *SafeStorage) executeOn(shard int, cmd command) result {
+	cmd.ctx = safeStorage.ctx
+	// buffered, so the worker never blocks on a caller that has gone
+	cmd.result = make(chan result, 1)
+	safeStorage.state.mutex.RLock()
+	if safeStorage.state.closed {
+		safeStorage.state.mutex.RUnlock()
+		return result{err: ErrClosed}
+	}
+	safeStorage.state.queued[shard].Add(1)
+	select {
+	case safeStorage.shards[shard] <- cmd:
+		safeStorage.state.mutex.RUnlock()
+	case <-cmd.ctx.Done():
+		safeStorage.state.queued[shard].Add(-1)
+		safeStorage.state.mutex.RUnlock()
+		return result{err: cmd.ctx.Err()}
+	}
+	select {
+	case answer := <-cmd.result:
+		return answer
+	case <-cmd.ctx.Done():
+		go func() {
+			answer := <-cmd.result
+			if answer.stream != nil {
+				answer.stream.Close()
+			}
+			if answer.cancel != nil {
+				answer.cancel()
+			}
+		}()
+		return result{err: cmd.ctx.Err()}
+	}
+}
+
+// QueueDepth returns the number of commands waiting for the worker of every shard.
+func (safeStorage *SafeStorage) QueueDepth() []int {
+	depths := make([]int, len(safeStorage.shards))
+	for shard := range depths {
+		depths[shard] = int(safeStorage.state.queued[shard].Load())
+	}
+	return depths
+}
+
+func (safeStorage *SafeStorage) PutContext(ctx context.Context, key, value string) error {
+	return safeStorage.WithContext(ctx).Put(key, value)
+}
+
+func (safeStorage *SafeStorage) GetContext(ctx context.Context, key string) (string, error) {
+	return safeStorage.WithContext(ctx).Get(key)
+}
+
 func (safeStorage *SafeStorage) Put(key, value string) error {
-	resultChannel := make(chan result)
-	cmd := command{ "put", key, value, resultChannel }
-	safeStorage.commands <- cmd
-	answer := <-resultChannel
+	answer := safeStorage.execute(command{action: "put", key: key, value: value})
 	return answer.err
 }
 
 func (safeStorage *SafeStorage) Get(key string) (string, error) {
-	resultChannel := make(chan result)
-	cmd := command{ "get", key, "", resultChannel }
-	safeStorage.commands <- cmd
-	answer := <-resultChannel
+	answer := safeStorage.execute(command{action: "get", key: key})
+	return answer.value, answer.err
+}
+
+func (safeStorage *SafeStorage) PutWithTTL(key, value string, ttl time.Duration) error {
+	answer := safeStorage.execute(command{action: "putWithTTL", key: key, value: value, ttl: ttl})
+	return answer.err
+}
+
+func (safeStorage *SafeStorage) PutBytes(key string, value []byte) error {
+	answer := safeStorage.execute(command{action: "putBytes", key: key, data: value})
+	return answer.err
+}
+
+func (safeStorage *SafeStorage) GetBytes(key string) ([]byte, error) {
+	answer := safeStorage.execute(command{action: "getBytes", key: key})
+	return answer.data, answer.err
+}
+
+// Delete removes the key, it fails with datastore.ErrNotFound if the key does not exist.
+// Deleting a key again changes nothing, so retrying a delete is safe.
+func (safeStorage *SafeStorage) Delete(key string) error {
+	answer := safeStorage.execute(command{action: "delete", key: key})
+	return answer.err
+}
+
+// Increment adds delta to the integer stored in the key and returns the result,
+// the worker applies it without any command in between.
+func (safeStorage *SafeStorage) Increment(key string, delta int64) (int64, error) {
+	answer := safeStorage.execute(command{action: "increment", key: key, delta: delta})
+	return answer.counter, answer.err
+}
+
+// Append adds the suffix to the end of the value, a missing key is created.
+func (safeStorage *SafeStorage) Append(key, suffix string) error {
+	answer := safeStorage.execute(command{action: "append", key: key, value: suffix})
+	return answer.err
+}
+
+// PutStream first copies the value to a temporary file in the caller, so a slow reader
+// does not hold the worker and the reader is not used after PutStream returns.
+// The copy gives up with the context error when the context of the view is done.
+func (safeStorage *SafeStorage) PutStream(key string, reader io.Reader, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("invalid value size %d", size)
+	}
+	spool, err := os.CreateTemp("", "safestorage-stream-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	// a worker still reading after the caller gave up fails and drops the partial value
+	defer spool.Close()
+	copied, err := io.Copy(spool, contextReader{safeStorage.ctx, io.LimitReader(reader, size)})
+	if err != nil {
+		return err
+	}
+	if copied != size {
+		return io.ErrUnexpectedEOF
+	}
+	answer := safeStorage.execute(command{action: "putStream", key: key, reader: io.NewSectionReader(spool, 0, size), size: size})
+	return answer.err
+}
+
+// contextReader stops reading once the context is done.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (reader contextReader) Read(p []byte) (int, error) {
+	if err := reader.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return reader.reader.Read(p)
+}
+
+// GetStream only locates the value in the worker, reading happens in the caller.
+func (safeStorage *SafeStorage) GetStream(key string) (io.ReadCloser, error) {
+	answer := safeStorage.execute(command{action: "getStream", key: key})
+	return answer.stream, answer.err
+}
+
+func (safeStorage *SafeStorage) GetIn(bucket, key string) (string, error) {
+	answer := safeStorage.execute(command{action: "getIn", bucket: bucket, key: key})
 	return answer.value, answer.err
 }
+
+func (safeStorage *SafeStorage) PutIn(bucket, key, value string) error {
+	answer := safeStorage.execute(command{action: "putIn", bucket: bucket, key: key, value: value})
+	return answer.err
+}
+
+// DeleteIn removes the key of the bucket, it fails with datastore.ErrNotFound if the key does not exist.
+func (safeStorage *SafeStorage) DeleteIn(bucket, key string) error {
+	answer := safeStorage.execute(command{action: "deleteIn", bucket: bucket, key: key})
+	return answer.err
+}
+
+// DropBucket removes all keys of the bucket on every shard, dropping a missing bucket changes nothing.
+func (safeStorage *SafeStorage) DropBucket(name string) error {
+	for shard := range safeStorage.shards {
+		answer := safeStorage.executeOn(shard, command{action: "dropBucket", bucket: name})
+		if answer.err != nil {
+			return answer.err
+		}
+	}
+	return nil
+}
+
+func (safeStorage *SafeStorage) ScanIn(bucket, prefix string) ([]string, error) {
+	return safeStorage.collectKeys(command{action: "scanIn", bucket: bucket, key: prefix})
+}
+
+// ScanAfter returns at most limit sorted keys of the bucket that follow the key after,
+// so a caller pages through the keys by passing the last key of the previous page.
+func (safeStorage *SafeStorage) ScanAfter(bucket, after string, limit int) ([]string, error) {
+	keys, err := safeStorage.collectKeys(command{action: "scanAfter", bucket: bucket, key: after, limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	return keys[:min(limit, len(keys))], nil
+}
+
+func (safeStorage *SafeStorage) GetVersioned(key string) (string, uint64, error) {
+	answer := safeStorage.execute(command{action: "getVersioned", key: key})
+	return answer.value, answer.version, answer.err
+}
+
+// Commit fails with ErrCrossShard if the transaction touches keys of several shards.
+func (safeStorage *SafeStorage) Commit(tx *datastore.Tx) error {
+	shard, err := safeStorage.shardOfTx(tx)
+	if err != nil {
+		return err
+	}
+	answer := safeStorage.executeOn(shard, command{action: "commit", tx: tx})
+	return answer.err
+}
+
+// Update runs fn in the calling goroutine, so other commands are served meanwhile.
+// Reads and the final commit go through the worker, the commit fails with
+// datastore.ErrConflict if a key read by fn was changed in between.
+func (safeStorage *SafeStorage) Update(fn func(tx *datastore.Tx) error) error {
+	tx := datastore.NewTx(safeStorage.GetVersioned)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return safeStorage.Commit(tx)
+}
+
+func (safeStorage *SafeStorage) RegisterIndex(name, path string) error {
+	for shard := range safeStorage.shards {
+		answer := safeStorage.executeOn(shard, command{action: "registerIndex", key: name, value: path})
+		if answer.err != nil {
+			return answer.err
+		}
+	}
+	return nil
+}
+
+func (safeStorage *SafeStorage) QueryIndex(name, value string) ([]string, error) {
+	return safeStorage.collectKeys(command{action: "queryIndex", key: name, value: value})
+}
@@ -0,0 +1,304 @@
+package safestorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+)
+
+// blockingStorage answers Get only after release is closed.
+type blockingStorage struct {
+	Storage
+	release chan struct{}
+	puts    []string
+}
+
+func (storage *blockingStorage) Get(key string) (string, error) {
+	<-storage.release
+	return "value", nil
+}
+
+func (storage *blockingStorage) Put(key, value string) error {
+	storage.puts = append(storage.puts, key)
+	return nil
+}
+
+func TestSafeStorage_Context(t *testing.T) {
+	storage := &blockingStorage{release: make(chan struct{})}
+	ss := Init(storage)
+
+	go func() {
+		_, _ = ss.Get("stuck")
+	}()
+	// let the worker pick the first command up
+	time.Sleep(10 * time.Millisecond)
+
+	t.Run("deadline in queue", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		err := ss.PutContext(ctx, "queued", "value")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+		}
+	})
+
+	t.Run("cancel while waiting", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			cancel()
+		}()
+		if _, err := ss.GetContext(ctx, "stuck"); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	})
+
+	t.Run("queue depth", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			_ = ss.PutContext(ctx, "waiting", "value")
+			close(done)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		if depth := ss.QueueDepth(); !reflect.DeepEqual(depth, []int{1}) {
+			t.Errorf("QueueDepth() = %v with a waiting command", depth)
+		}
+		cancel()
+		<-done
+		if depth := ss.QueueDepth(); !reflect.DeepEqual(depth, []int{0}) {
+			t.Errorf("QueueDepth() = %v after the command gave up", depth)
+		}
+	})
+
+	close(storage.release)
+
+	t.Run("abandoned command", func(t *testing.T) {
+		if err := ss.Put("after", "value"); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range storage.puts {
+			if key == "queued" {
+				t.Errorf("Command of a caller that gave up was applied")
+			}
+		}
+	})
+
+	t.Run("live context", func(t *testing.T) {
+		value, err := ss.GetContext(context.Background(), "key")
+		if err != nil || value != "value" {
+			t.Errorf("GetContext() = %q, %v", value, err)
+		}
+	})
+}
+
+// closingStorage records the order of the final calls.
+type closingStorage struct {
+	Storage
+	calls []string
+}
+
+func (storage *closingStorage) Put(key, value string) error {
+	time.Sleep(5 * time.Millisecond)
+	storage.calls = append(storage.calls, "put "+key)
+	return nil
+}
+
+func (storage *closingStorage) Sync() error {
+	storage.calls = append(storage.calls, "sync")
+	return nil
+}
+
+func (storage *closingStorage) Close() error {
+	storage.calls = append(storage.calls, "close")
+	return nil
+}
+
+func TestSafeStorage_Close(t *testing.T) {
+	storage := &closingStorage{}
+	ss := Init(storage)
+
+	queued := make(chan error, 3)
+	for _, key := range []string{"a", "b", "c"} {
+		go func() {
+			queued <- ss.Put(key, "value")
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	if err := ss.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if err := <-queued; err != nil && !errors.Is(err, ErrClosed) {
+			t.Errorf("Unexpected error of a queued command: %s", err)
+		}
+	}
+
+	last := storage.calls[len(storage.calls)-2:]
+	if last[0] != "sync" || last[1] != "close" {
+		t.Errorf("Storage was not synced and closed last, calls %v", storage.calls)
+	}
+	if err := ss.Put("late", "value"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed after Close, got %v", err)
+	}
+	if err := ss.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from the second Close, got %v", err)
+	}
+}
+
+func TestSafeStorage_Sharded(t *testing.T) {
+	shards, err := datastore.OpenShards(t.TempDir(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storages := make([]Storage, len(shards))
+	for i, db := range shards {
+		storages[i] = db
+	}
+	ss := InitSharded(storages)
+	t.Cleanup(func() {
+		_ = ss.Close()
+	})
+
+	keys := make([]string, 0, 50)
+	for i := range 50 {
+		key := fmt.Sprintf("key-%02d", i)
+		keys = append(keys, key)
+		if err := ss.Put(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range keys {
+		if value, err := ss.Get(key); err != nil || value != key {
+			t.Errorf("Get(%q) = %q, %v", key, value, err)
+		}
+	}
+	if scanned, _ := ss.ScanIn("", "key-"); !reflect.DeepEqual(scanned, keys) {
+		t.Errorf("ScanIn returned %d keys, wanted %d", len(scanned), len(keys))
+	}
+	used := make(map[int]bool)
+	for _, key := range keys {
+		used[ShardOf(key, len(shards))] = true
+	}
+	if len(used) != len(shards) {
+		t.Errorf("Keys were spread over %d shards only", len(used))
+	}
+
+	t.Run("delete", func(t *testing.T) {
+		for _, key := range keys[:10] {
+			if err := ss.Delete(key); err != nil {
+				t.Errorf("Cannot delete %s: %s", key, err)
+			}
+			if err := ss.Delete(key); !errors.Is(err, datastore.ErrNotFound) {
+				t.Errorf("Second delete of %s returned %v", key, err)
+			}
+		}
+		if scanned, _ := ss.ScanIn("", "key-"); !reflect.DeepEqual(scanned, keys[10:]) {
+			t.Errorf("ScanIn returned %v after the deletes", scanned)
+		}
+	})
+
+	t.Run("transactions", func(t *testing.T) {
+		var first, other string
+		for _, key := range keys[1:] {
+			if ShardOf(key, len(shards)) != ShardOf(keys[0], len(shards)) {
+				other = key
+			} else {
+				first = key
+			}
+		}
+		err := ss.Update(func(tx *datastore.Tx) error {
+			tx.Put(keys[0], "tx")
+			tx.Put(first, "tx")
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Single shard transaction failed: %s", err)
+		}
+		err = ss.Update(func(tx *datastore.Tx) error {
+			tx.Put(keys[0], "tx")
+			tx.Put(other, "tx")
+			return nil
+		})
+		if !errors.Is(err, ErrCrossShard) {
+			t.Errorf("Expected ErrCrossShard, got %v", err)
+		}
+	})
+	t.Run("watch", func(t *testing.T) {
+		subscription, err := ss.Watch("key-", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		positions := subscription.Positions
+		for _, key := range keys[:10] {
+			if err := ss.Put(key, "watched"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		seen := make(map[string]bool)
+		for range 10 {
+			event := <-subscription.Events
+			if event.Shard != ShardOf(event.Key, len(shards)) || event.Value != "watched" {
+				t.Errorf("Unexpected event %+v", event)
+			}
+			seen[event.Key] = true
+			positions[event.Shard] = event.Version
+		}
+		subscription.Close()
+		if len(seen) != 10 {
+			t.Errorf("Got events of %d keys, wanted 10", len(seen))
+		}
+		for range subscription.Events {
+		}
+
+		if err := ss.Put(keys[20], "missed"); err != nil {
+			t.Fatal(err)
+		}
+		resumed, err := ss.Watch("key-", positions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resumed.Close()
+		if event := <-resumed.Events; event.Key != keys[20] || event.Value != "missed" {
+			t.Errorf("Resumed with %+v", event)
+		}
+		if _, err := ss.Watch("", positions[1:]); !errors.Is(err, ErrShardPositions) {
+			t.Errorf("Expected ErrShardPositions, got %v", err)
+		}
+	})
+}
+
+func TestSafeStorage_PutStream(t *testing.T) {
+	ss := Init(datastore.NewMemory())
+	t.Cleanup(func() {
+		_ = ss.Close()
+	})
+	// the uploader stalls after a part of the value
+	stalled, upload := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- ss.PutStream("upload", stalled, 10)
+	}()
+	if _, err := upload.Write([]byte("part")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ss.PutContext(ctx, "other", "value"); err != nil {
+		t.Errorf("Stalled upload held the worker: %v", err)
+	}
+	_ = upload.CloseWithError(errors.New("client went away"))
+	if err := <-done; err == nil {
+		t.Error("Broken upload was stored")
+	}
+	if _, err := ss.Get("upload"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("Broken upload is visible, error %v", err)
+	}
+}
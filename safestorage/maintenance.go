@@ -0,0 +1,81 @@
+package safestorage
+
+import (
+	"errors"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+)
+
+var ErrNoMaintenance = errors.New("storage has no segments to maintain")
+
+// MaintenanceStorage is a storage whose segments can be managed by an operator, like datastore.Db.
+type MaintenanceStorage interface {
+	Compact() error
+	Rotate() error
+	Segments() ([]datastore.SegmentStats, error)
+	SetReadOnly(readOnly bool)
+}
+
+func init() {
+	cases["compact"] = withMaintenance(func(storage MaintenanceStorage, cmd command) result {
+		return result{err: storage.Compact()}
+	})
+	cases["rotate"] = withMaintenance(func(storage MaintenanceStorage, cmd command) result {
+		return result{err: storage.Rotate()}
+	})
+	cases["segments"] = withMaintenance(func(storage MaintenanceStorage, cmd command) result {
+		segments, err := storage.Segments()
+		return result{segments: segments, err: err}
+	})
+	cases["setReadOnly"] = withMaintenance(func(storage MaintenanceStorage, cmd command) result {
+		storage.SetReadOnly(cmd.readOnly)
+		return result{}
+	})
+	cases["sync"] = func(storage Storage, cmd command) result {
+		return result{err: storage.Sync()}
+	}
+}
+
+func withMaintenance(produce func(MaintenanceStorage, command) result) func(Storage, command) result {
+	return func(storage Storage, cmd command) result {
+		maintained, canMaintain := storage.(MaintenanceStorage)
+		if !canMaintain {
+			return result{err: ErrNoMaintenance}
+		}
+		return produce(maintained, cmd)
+	}
+}
+
+// Compact merges the segments of the shard, the shard serves no other commands meanwhile.
+func (safeStorage *SafeStorage) Compact(shard int) error {
+	answer := safeStorage.executeOn(shard, command{action: "compact"})
+	return answer.err
+}
+
+// Rotate starts a new active segment of the shard.
+func (safeStorage *SafeStorage) Rotate(shard int) error {
+	answer := safeStorage.executeOn(shard, command{action: "rotate"})
+	return answer.err
+}
+
+func (safeStorage *SafeStorage) Segments(shard int) ([]datastore.SegmentStats, error) {
+	answer := safeStorage.executeOn(shard, command{action: "segments"})
+	return answer.segments, answer.err
+}
+
+// SetReadOnly switches every shard, the writes fail with datastore.ErrReadOnly while it is on.
+func (safeStorage *SafeStorage) SetReadOnly(readOnly bool) error {
+	for shard := range safeStorage.shards {
+		answer := safeStorage.executeOn(shard, command{action: "setReadOnly", readOnly: readOnly})
+		if answer.err != nil {
+			return answer.err
+		}
+	}
+	return nil
+}
+
+// Sync flushes the shard to the disk.
+func (safeStorage *SafeStorage) Sync(shard int) error {
+	answer := safeStorage.executeOn(shard, command{action: "sync"})
+	return answer.err
+}
@@ -0,0 +1,75 @@
+package safestorage
+
+import (
+	"errors"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+)
+
+var ErrNoLog = errors.New("storage has no segment log to replicate")
+
+// LogStorage is a storage that can be replicated by shipping its segment log, like datastore.Db.
+type LogStorage interface {
+	ReadLog(position datastore.LogPosition, limit int) ([]byte, datastore.LogPosition, error)
+	LogEnd() (datastore.LogPosition, error)
+	ApplyLog(data []byte) error
+	Clear() error
+}
+
+func init() {
+	cases["readLog"] = withLog(func(storage LogStorage, cmd command) result {
+		data, next, err := storage.ReadLog(cmd.logPosition, int(cmd.size))
+		if err != nil {
+			return result{err: err}
+		}
+		end, err := storage.LogEnd()
+		return result{data: data, next: next, end: end, err: err}
+	})
+	cases["logEnd"] = withLog(func(storage LogStorage, cmd command) result {
+		end, err := storage.LogEnd()
+		return result{end: end, err: err}
+	})
+	cases["applyLog"] = withLog(func(storage LogStorage, cmd command) result {
+		return result{err: storage.ApplyLog(cmd.data)}
+	})
+	cases["clear"] = withLog(func(storage LogStorage, cmd command) result {
+		return result{err: storage.Clear()}
+	})
+}
+
+func withLog(produce func(LogStorage, command) result) func(Storage, command) result {
+	return func(storage Storage, cmd command) result {
+		logStorage, hasLog := storage.(LogStorage)
+		if !hasLog {
+			return result{err: ErrNoLog}
+		}
+		return produce(logStorage, cmd)
+	}
+}
+
+// Shards returns the number of shards, the log of every shard is replicated on its own.
+func (safeStorage *SafeStorage) Shards() int {
+	return len(safeStorage.shards)
+}
+
+// ReadLog returns at most limit bytes of the shard log after the position,
+// the position after them and the end of the log.
+func (safeStorage *SafeStorage) ReadLog(shard int, position datastore.LogPosition, limit int) ([]byte, datastore.LogPosition, datastore.LogPosition, error) {
+	answer := safeStorage.executeOn(shard, command{action: "readLog", logPosition: position, size: int64(limit)})
+	return answer.data, answer.next, answer.end, answer.err
+}
+
+func (safeStorage *SafeStorage) LogEnd(shard int) (datastore.LogPosition, error) {
+	answer := safeStorage.executeOn(shard, command{action: "logEnd"})
+	return answer.end, answer.err
+}
+
+func (safeStorage *SafeStorage) ApplyLog(shard int, data []byte) error {
+	answer := safeStorage.executeOn(shard, command{action: "applyLog", data: data})
+	return answer.err
+}
+
+func (safeStorage *SafeStorage) Clear(shard int) error {
+	answer := safeStorage.executeOn(shard, command{action: "clear"})
+	return answer.err
+}
@@ -0,0 +1,51 @@
+package safestorage
+
+import (
+	"errors"
+	"hash/fnv"
+	"slices"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+)
+
+var ErrCrossShard = errors.New("transaction keys belong to different shards")
+
+// ShardOf returns the shard of the key. Data is placed by this hash,
+// so it must not change as long as sharded data exists.
+func ShardOf(key string, shards int) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(shards))
+}
+
+func (safeStorage *SafeStorage) shardOf(key string) int {
+	return ShardOf(key, len(safeStorage.shards))
+}
+
+func (safeStorage *SafeStorage) shardOfTx(tx *datastore.Tx) (int, error) {
+	keys := tx.Keys()
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	shard := safeStorage.shardOf(keys[0])
+	for _, key := range keys[1:] {
+		if safeStorage.shardOf(key) != shard {
+			return 0, ErrCrossShard
+		}
+	}
+	return shard, nil
+}
+
+// collectKeys runs the command on every shard and merges the sorted keys.
+func (safeStorage *SafeStorage) collectKeys(cmd command) ([]string, error) {
+	keys := make([]string, 0)
+	for shard := range safeStorage.shards {
+		answer := safeStorage.executeOn(shard, cmd)
+		if answer.err != nil {
+			return nil, answer.err
+		}
+		keys = append(keys, answer.keys...)
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
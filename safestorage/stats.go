@@ -0,0 +1,47 @@
+package safestorage
+
+import (
+	"errors"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+)
+
+var ErrNoStats = errors.New("storage does not report statistics")
+
+// StatsStorage is a storage that reports its size and activity, like datastore.Db.
+type StatsStorage interface {
+	Stats() (datastore.Stats, error)
+	Health() (datastore.Stats, error)
+}
+
+func init() {
+	cases["stats"] = func(storage Storage, cmd command) result {
+		statsStorage, hasStats := storage.(StatsStorage)
+		if !hasStats {
+			return result{err: ErrNoStats}
+		}
+		stats, err := statsStorage.Stats()
+		return result{stats: stats, err: err}
+	}
+	cases["health"] = func(storage Storage, cmd command) result {
+		statsStorage, hasStats := storage.(StatsStorage)
+		if !hasStats {
+			return result{err: ErrNoStats}
+		}
+		stats, err := statsStorage.Health()
+		return result{stats: stats, err: err}
+	}
+}
+
+// Stats returns the statistics of the shard.
+func (safeStorage *SafeStorage) Stats(shard int) (datastore.Stats, error) {
+	answer := safeStorage.executeOn(shard, command{action: "stats"})
+	return answer.stats, answer.err
+}
+
+// Health returns the read-only state and the free disk space of the shard. Unlike Stats
+// it is cheap, so it also tells that the worker of the shard answers.
+func (safeStorage *SafeStorage) Health(shard int) (datastore.Stats, error) {
+	answer := safeStorage.executeOn(shard, command{action: "health"})
+	return answer.stats, answer.err
+}
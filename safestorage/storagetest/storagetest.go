@@ -0,0 +1,408 @@
+// Package storagetest checks that an implementation of safestorage.Storage
+// follows the semantics of the disk-backed datastore.Db.
+package storagetest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+// Run runs the conformance tests, every subtest gets a new empty storage from open.
+// The storage is closed when the subtest finishes.
+func Run(t *testing.T, open func(t *testing.T) safestorage.Storage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, storage safestorage.Storage)
+	}{
+		{"put/get", testPutGet},
+		{"not found", testNotFound},
+		{"delete", testDelete},
+		{"counters", testCounters},
+		{"bytes", testBytes},
+		{"stream", testStream},
+		{"buckets", testBuckets},
+		{"ttl", testTTL},
+		{"transactions", testTransactions},
+		{"indexes", testIndexes},
+		{"watch", testWatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := open(t)
+			t.Cleanup(func() {
+				if err := storage.Close(); err != nil {
+					t.Errorf("Cannot close storage: %s", err)
+				}
+			})
+			tt.test(t, storage)
+		})
+	}
+}
+
+func mustPut(t *testing.T, storage safestorage.Storage, key, value string) {
+	t.Helper()
+	if err := storage.Put(key, value); err != nil {
+		t.Fatalf("Cannot put %s: %s", key, err)
+	}
+}
+
+func expectValue(t *testing.T, storage safestorage.Storage, key, expected string) {
+	t.Helper()
+	value, err := storage.Get(key)
+	if err != nil {
+		t.Errorf("Cannot get %s: %s", key, err)
+		return
+	}
+	if value != expected {
+		t.Errorf("Get(%q) = %q, wanted %q", key, value, expected)
+	}
+}
+
+func expectNotFound(t *testing.T, storage safestorage.Storage, key string) {
+	t.Helper()
+	if _, err := storage.Get(key); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("Get(%q) error = %v, wanted ErrNotFound", key, err)
+	}
+}
+
+func testPutGet(t *testing.T, storage safestorage.Storage) {
+	mustPut(t, storage, "k1", "v1")
+	mustPut(t, storage, "k2", "v2")
+	mustPut(t, storage, "k1", "v1.1")
+	mustPut(t, storage, "empty", "")
+	expectValue(t, storage, "k1", "v1.1")
+	expectValue(t, storage, "k2", "v2")
+	expectValue(t, storage, "empty", "")
+}
+
+func testNotFound(t *testing.T, storage safestorage.Storage) {
+	expectNotFound(t, storage, "missing")
+	if _, err := storage.GetBytes("missing"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("GetBytes error = %v, wanted ErrNotFound", err)
+	}
+	if _, err := storage.GetStream("missing"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("GetStream error = %v, wanted ErrNotFound", err)
+	}
+	if _, err := storage.GetIn("missing", "missing"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("GetIn error = %v, wanted ErrNotFound", err)
+	}
+	if _, _, err := storage.GetVersioned("missing"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("GetVersioned error = %v, wanted ErrNotFound", err)
+	}
+}
+
+func testDelete(t *testing.T, storage safestorage.Storage) {
+	mustPut(t, storage, "gone", "v1")
+	if err := storage.Delete("gone"); err != nil {
+		t.Fatalf("Cannot delete: %s", err)
+	}
+	expectNotFound(t, storage, "gone")
+	// repeating a delete reports the missing key and leaves the storage as it was
+	for _, key := range []string{"gone", "never"} {
+		if err := storage.Delete(key); !errors.Is(err, datastore.ErrNotFound) {
+			t.Errorf("Delete of missing %s error = %v, wanted ErrNotFound", key, err)
+		}
+		expectNotFound(t, storage, key)
+	}
+	mustPut(t, storage, "gone", "v2")
+	expectValue(t, storage, "gone", "v2")
+}
+
+func testCounters(t *testing.T, storage safestorage.Storage) {
+	for _, step := range []struct {
+		delta, expected int64
+	}{{1, 1}, {41, 42}, {-50, -8}} {
+		if counter, err := storage.Increment("counter", step.delta); err != nil || counter != step.expected {
+			t.Errorf("Increment(counter, %d) = %d, %v, wanted %d", step.delta, counter, err, step.expected)
+		}
+	}
+	expectValue(t, storage, "counter", "-8")
+	mustPut(t, storage, "text", "abc")
+	if _, err := storage.Increment("text", 1); !errors.Is(err, datastore.ErrNotInteger) {
+		t.Errorf("Increment of a text error = %v, wanted ErrNotInteger", err)
+	}
+	mustPut(t, storage, "big", "9223372036854775807")
+	if _, err := storage.Increment("big", 1); !errors.Is(err, datastore.ErrOverflow) {
+		t.Errorf("Increment over the maximum error = %v, wanted ErrOverflow", err)
+	}
+	expectValue(t, storage, "big", "9223372036854775807")
+
+	for _, suffix := range []string{"a", "b", "c"} {
+		if err := storage.Append("log", suffix); err != nil {
+			t.Fatalf("Cannot append: %s", err)
+		}
+	}
+	expectValue(t, storage, "log", "abc")
+	if err := storage.Append("text", "def"); err != nil {
+		t.Fatalf("Cannot append: %s", err)
+	}
+	expectValue(t, storage, "text", "abcdef")
+
+	if err := storage.PutWithTTL("short", "5", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	// an expired counter starts again from 0 and does not expire
+	if counter, err := storage.Increment("short", 1); err != nil || counter != 1 {
+		t.Errorf("Increment of an expired key = %d, %v", counter, err)
+	}
+}
+
+func testBytes(t *testing.T, storage safestorage.Storage) {
+	value := []byte{0, 1, 2, 0xff, 0}
+	if err := storage.PutBytes("binary", value); err != nil {
+		t.Fatal(err)
+	}
+	value[0] = 42
+	got, err := storage.GetBytes("binary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte{0, 1, 2, 0xff, 0}) {
+		t.Errorf("GetBytes() = %v, the storage must not keep the caller's slice", got)
+	}
+}
+
+func testStream(t *testing.T, storage safestorage.Storage) {
+	value := bytes.Repeat([]byte("stream"), 100000)
+	if err := storage.PutStream("large", bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := storage.GetStream("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(stream)
+	stream.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("GetStream returned %d bytes, wanted %d", len(got), len(value))
+	}
+
+	err = storage.PutStream("short", strings.NewReader("abc"), 10)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("PutStream with a short reader error = %v, wanted io.ErrUnexpectedEOF", err)
+	}
+	expectNotFound(t, storage, "short")
+	mustPut(t, storage, "after-short", "ok")
+	expectValue(t, storage, "after-short", "ok")
+}
+
+func testBuckets(t *testing.T, storage safestorage.Storage) {
+	mustPut(t, storage, "key", "root")
+	for bucket, value := range map[string]string{"users": "user", "orders": "order"} {
+		if err := storage.PutIn(bucket, "key", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = storage.PutIn("users", "other", "user")
+	expectValue(t, storage, "key", "root")
+	if value, _ := storage.GetIn("users", "key"); value != "user" {
+		t.Errorf("GetIn(users, key) = %q", value)
+	}
+	if value, _ := storage.GetIn("", "key"); value != "root" {
+		t.Errorf("GetIn of the root bucket = %q", value)
+	}
+	keys, err := storage.ScanIn("users", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"key", "other"}) {
+		t.Errorf("ScanIn(users) = %v", keys)
+	}
+	if keys, _ := storage.ScanIn("missing", ""); len(keys) != 0 {
+		t.Errorf("ScanIn of a missing bucket = %v", keys)
+	}
+
+	if err := storage.DeleteIn("users", "other"); err != nil {
+		t.Errorf("Cannot delete a bucket key: %s", err)
+	}
+	for _, bucket := range []string{"users", "missing"} {
+		if err := storage.DeleteIn(bucket, "other"); !errors.Is(err, datastore.ErrNotFound) {
+			t.Errorf("DeleteIn(%s, other) of a missing key error = %v, wanted ErrNotFound", bucket, err)
+		}
+	}
+	if value, _ := storage.GetIn("users", "key"); value != "user" {
+		t.Errorf("Delete of a bucket key removed its neighbour, GetIn(users, key) = %q", value)
+	}
+
+	if err := storage.DropBucket("users"); err != nil {
+		t.Fatalf("Cannot drop a bucket: %s", err)
+	}
+	if keys, _ := storage.ScanIn("users", ""); len(keys) != 0 {
+		t.Errorf("ScanIn of a dropped bucket = %v", keys)
+	}
+	if _, err := storage.GetIn("users", "key"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("GetIn of a dropped bucket error = %v, wanted ErrNotFound", err)
+	}
+	if err := storage.DropBucket("missing"); err != nil {
+		t.Errorf("Drop of a missing bucket gave %v", err)
+	}
+	expectValue(t, storage, "key", "root")
+	if value, _ := storage.GetIn("orders", "key"); value != "order" {
+		t.Errorf("Drop removed another bucket, GetIn(orders, key) = %q", value)
+	}
+	// a dropped bucket can be filled again
+	if err := storage.PutIn("users", "key", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := storage.GetIn("users", "key"); value != "new" {
+		t.Errorf("GetIn of a refilled bucket = %q", value)
+	}
+}
+
+func testTTL(t *testing.T, storage safestorage.Storage) {
+	if err := storage.PutWithTTL("short", "v", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.PutWithTTL("long", "v", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.PutWithTTL("invalid", "v", 0); err == nil {
+		t.Errorf("Zero ttl was accepted")
+	}
+	expectValue(t, storage, "short", "v")
+	time.Sleep(30 * time.Millisecond)
+	expectNotFound(t, storage, "short")
+	expectValue(t, storage, "long", "v")
+	if keys, _ := storage.ScanIn("", ""); !reflect.DeepEqual(keys, []string{"long"}) {
+		t.Errorf("ScanIn returned %v with an expired key", keys)
+	}
+	mustPut(t, storage, "short", "again")
+	expectValue(t, storage, "short", "again")
+}
+
+func testTransactions(t *testing.T, storage safestorage.Storage) {
+	mustPut(t, storage, "a", "1")
+	mustPut(t, storage, "b", "2")
+	_, versionA, err := storage.GetVersioned("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, storage, "b", "3")
+	if _, versionB, _ := storage.GetVersioned("b"); versionB <= versionA {
+		t.Errorf("Version did not grow, %d after %d", versionB, versionA)
+	}
+
+	tx := datastore.NewTx(storage.GetVersioned)
+	if value, _ := tx.Get("a"); value != "1" {
+		t.Errorf("tx.Get(a) = %q", value)
+	}
+	tx.Put("a", "10")
+	tx.Delete("b")
+	if err := storage.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, storage, "a", "10")
+	expectNotFound(t, storage, "b")
+
+	tx = datastore.NewTx(storage.GetVersioned)
+	_, _ = tx.Get("a")
+	tx.Put("c", "lost")
+	mustPut(t, storage, "a", "concurrent")
+	if err := storage.Commit(tx); !errors.Is(err, datastore.ErrConflict) {
+		t.Errorf("Commit error = %v, wanted ErrConflict", err)
+	}
+	expectNotFound(t, storage, "c")
+
+	tx = datastore.NewTx(storage.GetVersioned)
+	tx.Expect("missing", 0)
+	tx.Put("missing", "created")
+	if err := storage.Commit(tx); err != nil {
+		t.Errorf("Cannot commit with an expected missing key: %s", err)
+	}
+	expectValue(t, storage, "missing", "created")
+
+	position := storage.Position()
+	tx = datastore.NewTx(storage.GetVersioned)
+	tx.Delete("never")
+	if err := storage.Commit(tx); err != nil {
+		t.Errorf("Cannot commit a delete of a missing key: %s", err)
+	}
+	expectNotFound(t, storage, "never")
+	if storage.Position() != position {
+		t.Errorf("Delete of a missing key moved the position from %d to %d", position, storage.Position())
+	}
+}
+
+func testIndexes(t *testing.T, storage safestorage.Storage) {
+	mustPut(t, storage, "u1", `{"city": "Kyiv"}`)
+	mustPut(t, storage, "u2", `{"city": "Lviv"}`)
+	if err := storage.RegisterIndex("city", "city"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.RegisterIndex("city", "city"); err != nil {
+		t.Errorf("Registering the same index again failed: %s", err)
+	}
+	if err := storage.RegisterIndex("city", "other"); err == nil {
+		t.Errorf("Index was registered twice with different paths")
+	}
+	mustPut(t, storage, "u3", `{"city": "Kyiv"}`)
+	mustPut(t, storage, "u1", `{"city": "Odesa"}`)
+	keys, err := storage.QueryIndex("city", "Kyiv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"u3"}) {
+		t.Errorf("QueryIndex(city, Kyiv) = %v", keys)
+	}
+	if _, err := storage.QueryIndex("missing", "x"); !errors.Is(err, datastore.ErrNoIndex) {
+		t.Errorf("QueryIndex error = %v, wanted ErrNoIndex", err)
+	}
+}
+
+func testWatch(t *testing.T, storage safestorage.Storage) {
+	mustPut(t, storage, "w:old", "v")
+	start := storage.Position()
+	events, cancel, err := storage.WatchFrom("w:", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, storage, "w:1", "v1")
+	mustPut(t, storage, "other", "v")
+	tx := datastore.NewTx(storage.GetVersioned)
+	tx.Delete("w:old")
+	if err := storage.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	var got []datastore.Event
+	for event := range events {
+		got = append(got, event)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Got events %+v, wanted a put and a delete", got)
+	}
+	if got[0].Key != "w:1" || got[0].Value != "v1" || got[0].Deleted || got[0].Version <= start {
+		t.Errorf("Unexpected put event %+v", got[0])
+	}
+	if got[1].Key != "w:old" || !got[1].Deleted || got[1].Version <= got[0].Version {
+		t.Errorf("Unexpected delete event %+v", got[1])
+	}
+	if storage.Position() != got[1].Version {
+		t.Errorf("Position() = %d after the event %d", storage.Position(), got[1].Version)
+	}
+
+	resumed, cancel, err := storage.WatchFrom("w:", got[0].Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if event := <-resumed; event != got[1] {
+		t.Errorf("Resumed with %+v, wanted %+v", event, got[1])
+	}
+	if _, _, err := storage.WatchFrom("w:", storage.Position()+1); !errors.Is(err, datastore.ErrHistoryGone) {
+		t.Errorf("WatchFrom a position ahead of the version error = %v, wanted ErrHistoryGone", err)
+	}
+}
@@ -0,0 +1,24 @@
+package storagetest
+
+import (
+	"testing"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+	"github.com/KatePril/architecture-lab-5/safestorage"
+)
+
+func TestBitcask(t *testing.T) {
+	Run(t, func(t *testing.T) safestorage.Storage {
+		db, err := datastore.Open(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
+
+func TestMemory(t *testing.T) {
+	Run(t, func(t *testing.T) safestorage.Storage {
+		return datastore.NewMemory()
+	})
+}
@@ -0,0 +1,93 @@
+package safestorage
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/KatePril/architecture-lab-5/datastore"
+)
+
+var ErrShardPositions = errors.New("a position is required for every shard")
+
+// ShardEvent is a change of a key in one of the shards.
+type ShardEvent struct {
+	Shard int
+	datastore.Event
+}
+
+// Subscription delivers the changes of all shards. Every shard numbers its events
+// on its own, so the position of a subscription is the list of the shard positions.
+type Subscription struct {
+	Events <-chan ShardEvent
+	// Positions are the positions of the shards the subscription started after.
+	Positions []uint64
+	stop      func()
+}
+
+// Close ends the subscription, Events is closed after it.
+func (subscription *Subscription) Close() {
+	subscription.stop()
+}
+
+// Watch subscribes to the changes of root keys starting with the prefix.
+// Positions resume the subscription after the given position of every shard,
+// nil starts it from now. Events is closed when any shard drops the subscription
+// because the reader is too slow, the reader then resumes from the last positions it got.
+func (safeStorage *SafeStorage) Watch(prefix string, positions []uint64) (*Subscription, error) {
+	if positions != nil && len(positions) != len(safeStorage.shards) {
+		return nil, ErrShardPositions
+	}
+	started := make([]uint64, len(safeStorage.shards))
+	channels := make([]<-chan datastore.Event, len(safeStorage.shards))
+	cancels := make([]func(), 0, len(safeStorage.shards))
+	stopShards := func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+	for shard := range safeStorage.shards {
+		cmd := command{action: "watch", key: prefix}
+		if positions != nil {
+			cmd.position, cmd.resume = positions[shard], true
+		}
+		answer := safeStorage.executeOn(shard, cmd)
+		if answer.err != nil {
+			stopShards()
+			return nil, answer.err
+		}
+		started[shard] = answer.version
+		channels[shard] = answer.events
+		cancels = append(cancels, answer.cancel)
+	}
+
+	merged := make(chan ShardEvent)
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			stopShards()
+		})
+	}
+	var forwarders sync.WaitGroup
+	for shard, events := range channels {
+		forwarders.Add(1)
+		go func() {
+			defer forwarders.Done()
+			// a dropped shard ends the whole subscription, the others must not run ahead
+			defer stop()
+			for event := range events {
+				select {
+				case merged <- ShardEvent{shard, event}:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		forwarders.Wait()
+		close(merged)
+	}()
+	return &Subscription{Events: merged, Positions: started, stop: stop}, nil
+}